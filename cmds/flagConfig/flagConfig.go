@@ -0,0 +1,272 @@
+// Package flagConfig go-flagsのオプションを設定ファイルと環境変数からも指定できるようにする
+//
+// オプションは 既定値、設定ファイル、環境変数、コマンドライン引数 の順に上書きされる
+// 設定ファイルはYAML形式で、キーにはオプションのlong名を使用する
+//
+//	addr: localhost:8080
+//	retentionMaxCount:
+//	  - "nightly-:10"
+//	  - "release-:100"
+//
+// 環境変数名は接頭辞とlong名を大文字のスネークケースにしたもの(例:LOGSERVER_S3_SECRET_KEY)
+// 設定ファイルのパスは config オプションで指定する
+//
+// オプションには次のタグを追加で指定できる
+//
+//	config:"-"     設定ファイルでの指定と設定内容の表示から除外する
+//	secret:"true"  設定内容の表示で値を伏せる
+package flagConfig
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigOption 設定ファイルのパスを指定するオプションのlong名
+const ConfigOption = "config"
+
+// redacted 設定内容の表示で秘密の値の代わりに表示する文字列
+const redacted = "********"
+
+// Parse コマンドライン引数を読み込み、設定ファイルと環境変数で指定された値とあわせてdataに設定する
+// envPrefixが空の場合は環境変数から読み込まない
+// エラーはgo-flagsのflags.Parseと同様に標準出力へ表示する
+func Parse(data interface{}, envPrefix string) (*flags.Parser, error) {
+	return ParseArgs(data, envPrefix, os.Args[1:])
+}
+
+// ParseArgs 指定した引数をコマンドライン引数としてParseと同様に読み込む
+func ParseArgs(data interface{}, envPrefix string, args []string) (*flags.Parser, error) {
+	newData := func() interface{} { return reflect.New(reflect.TypeOf(data).Elem()).Interface() }
+
+	// 設定ファイルのパスと、コマンドライン引数と環境変数で指定されたオプションを調べる
+	// 必須のオプションは設定ファイルで指定されている場合があるため、ここではエラーとしない
+	// それ以外のエラーは最後の読み込みで改めて表示する
+	first := newParser(newData(), envPrefix, flags.PassDoubleDash)
+	_, err := first.ParseArgs(args)
+	var configArgs []string
+	if err == nil || isRequiredError(err) {
+		configArgs, err = readConfigArgs(first, newData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 設定ファイルの値はコマンドライン引数の前に指定したものとして読み込む
+	parser := newParser(data, envPrefix, flags.Default)
+	_, err = parser.ParseArgs(append(configArgs, args...))
+	return parser, err
+}
+
+// newParser 環境変数名を設定したParserを作成する
+func newParser(data interface{}, envPrefix string, options flags.Options) *flags.Parser {
+	parser := flags.NewParser(data, options)
+	if envPrefix == "" {
+		return parser
+	}
+	eachOption(parser, func(option *flags.Option) {
+		if option.EnvDefaultKey != "" || option.LongName == "" {
+			return
+		}
+		option.EnvDefaultKey = envPrefix + "_" + upperSnakeCase(option.LongName)
+		if reflect.TypeOf(option.Value()).Kind() == reflect.Slice && option.EnvDefaultDelim == "" {
+			option.EnvDefaultDelim = ","
+		}
+	})
+	return parser
+}
+
+// eachOption すべてのオプションを列挙する
+func eachOption(parser *flags.Parser, f func(option *flags.Option)) {
+	var walk func(groups []*flags.Group)
+	walk = func(groups []*flags.Group) {
+		for _, group := range groups {
+			for _, option := range group.Options() {
+				f(option)
+			}
+			walk(group.Groups())
+		}
+	}
+	walk(parser.Groups())
+}
+
+// upperSnakeCase キャメルケースの名前を大文字のスネークケースにする(例:signedURLLifetime → SIGNED_URL_LIFETIME)
+func upperSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextIsLower {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func isRequiredError(err error) bool {
+	var flagsErr *flags.Error
+	return errors.As(err, &flagsErr) && flagsErr.Type == flags.ErrRequired
+}
+
+// excluded 設定ファイルでの指定と設定内容の表示から除外するオプションか
+func excluded(option *flags.Option) bool {
+	return option.LongName == ConfigOption || option.Field().Tag.Get("config") == "-"
+}
+
+// readConfigArgs 設定ファイルの内容をコマンドライン引数の形式で返す
+// コマンドライン引数または環境変数で指定されたオプションは含めない
+// newDataは値の誤りを確認するために読み込み先を作成する
+func readConfigArgs(parser *flags.Parser, newData func() interface{}) ([]string, error) {
+	configOption := parser.FindOptionByLongName(ConfigOption)
+	if configOption == nil {
+		return nil, nil
+	}
+	path, _ := configOption.Value().(string)
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("設定ファイルの読み込みに失敗しました: %v", err)
+	}
+	var items yaml.MapSlice
+	if err := yaml.UnmarshalStrict(b, &items); err != nil {
+		return nil, fmt.Errorf("設定ファイル %v をYAMLとして読み込めません: %v", path, err)
+	}
+
+	var args []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		key := fmt.Sprint(item.Key)
+		option := parser.FindOptionByLongName(key)
+		if option == nil || excluded(option) {
+			return nil, fmt.Errorf("設定ファイル %v: 不明な設定項目です: %v", path, key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("設定ファイル %v: %v が複数回指定されています", path, key)
+		}
+		seen[key] = true
+		if option.IsSet() && !option.IsSetDefault() {
+			continue
+		}
+		if envKey := option.EnvKeyWithNamespace(); envKey != "" {
+			if _, ok := os.LookupEnv(envKey); ok {
+				continue
+			}
+		}
+
+		values := []interface{}{item.Value}
+		if list, ok := item.Value.([]interface{}); ok {
+			if reflect.TypeOf(option.Value()).Kind() != reflect.Slice {
+				return nil, fmt.Errorf("設定ファイル %v: %v には複数の値を指定できません", path, key)
+			}
+			values = list
+		}
+		for _, value := range values {
+			switch value := value.(type) {
+			case nil:
+			case map[interface{}]interface{}, yaml.MapSlice, []interface{}:
+				return nil, fmt.Errorf("設定ファイル %v: %v には値または値のリストを指定してください", path, key)
+			case bool:
+				if reflect.TypeOf(option.Value()).Kind() != reflect.Bool {
+					args = append(args, fmt.Sprintf("--%v=%v", key, value))
+				} else if value {
+					args = append(args, "--"+key)
+				}
+			default:
+				args = append(args, fmt.Sprintf("--%v=%v", key, value))
+			}
+		}
+	}
+
+	// 値の誤りは設定ファイルのものとわかるように先に確認する
+	check := newParser(newData(), "", flags.None)
+	if _, err := check.ParseArgs(args); err != nil && !isRequiredError(err) {
+		return nil, fmt.Errorf("設定ファイル %v: %v", path, err)
+	}
+	return args, nil
+}
+
+// Print 有効な設定内容を設定ファイルと同じ形式で出力する。秘密の値は伏せる
+func Print(w io.Writer, parser *flags.Parser) error {
+	var config yaml.MapSlice
+	eachOption(parser, func(option *flags.Option) {
+		// ヘルプの表示のように関数を呼び出すオプションは設定ではない
+		value := option.Value()
+		if option.LongName == "" || excluded(option) || reflect.TypeOf(value).Kind() == reflect.Func {
+			return
+		}
+
+		switch {
+		case option.Field().Tag.Get("secret") == "true":
+			if !reflect.ValueOf(value).IsZero() {
+				value = redacted
+			}
+		case reflect.TypeOf(value).Kind() == reflect.Slice:
+		default:
+			if stringer, ok := value.(fmt.Stringer); ok {
+				value = stringer.String()
+			}
+		}
+		config = append(config, yaml.MapItem{Key: option.LongName, Value: value})
+	})
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadSecretFile pathが指定されていれば、ファイルの内容を秘密の値としてvalueに設定する。前後の空白は取り除く
+// 秘密の値をコマンドライン引数や設定ファイルに直接書かずに受け渡すために使用する
+// nameはエラーメッセージに表示するオプションのlong名
+func ReadSecretFile(value *string, path string, name string) error {
+	if path == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%v と %vFile は同時に指定できません", name, name)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%vFile の読み込みに失敗しました: %v", name, err)
+	}
+	*value = strings.TrimSpace(string(b))
+	if *value == "" {
+		return fmt.Errorf("%vFile に指定したファイルが空です: %v", name, path)
+	}
+	return nil
+}
+
+// Errors 設定の検証で見つかった問題
+type Errors []string
+
+// Addf 問題を追加する
+func (errs *Errors) Addf(format string, a ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, a...))
+}
+
+// Err 問題があればまとめて1つのエラーとして返す
+func (errs Errors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("設定が正しくありません:\n  %v", strings.Join(errs, "\n  "))
+}
@@ -0,0 +1,147 @@
+package flagConfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOptions struct {
+	Config      string        `long:"config" description:"設定ファイル"`
+	PrintConfig bool          `long:"printConfig" description:"設定内容を表示して終了する" config:"-"`
+	Addr        string        `long:"addr" description:"アドレス" default:"localhost:8080"`
+	Dir         string        `long:"dir" description:"保存先" required:"true"`
+	Password    string        `long:"password" description:"パスワード" secret:"true"`
+	Interval    time.Duration `long:"interval" description:"間隔" default:"1h"`
+	MaxCount    []string      `long:"maxCount" description:"最大数"`
+	SelfSigned  bool          `long:"selfSigned" description:"自己署名"`
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseArgs(t *testing.T) {
+	path := writeConfig(t, `
+addr: config:8080
+dir: ./data
+interval: 30m
+maxCount:
+  - "nightly-:10"
+  - "release-:100"
+selfSigned: true
+`)
+
+	// 既定値 < 設定ファイル < 環境変数 < コマンドライン引数 の順に上書きする
+	os.Setenv("FLAGCONFIGTEST_INTERVAL", "5m")
+	defer os.Unsetenv("FLAGCONFIGTEST_INTERVAL")
+	var opt testOptions
+	_, err := ParseArgs(&opt, "FLAGCONFIGTEST", []string{"--config", path, "--addr", "flag:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.Addr != "flag:8080" || opt.Dir != "./data" || opt.Interval != 5*time.Minute || !opt.SelfSigned {
+		t.Fatal(opt)
+	}
+	if strings.Join(opt.MaxCount, ",") != "nightly-:10,release-:100" {
+		t.Fatal(opt.MaxCount)
+	}
+
+	// リストはコマンドライン引数で指定した場合は置き換える
+	opt = testOptions{}
+	_, err = ParseArgs(&opt, "FLAGCONFIGTEST", []string{"--config", path, "--maxCount", "a:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(opt.MaxCount, ",") != "a:1" {
+		t.Fatal(opt.MaxCount)
+	}
+
+	// 設定ファイルがなければ必須のオプションが足りない
+	opt = testOptions{}
+	if _, err := ParseArgs(&opt, "FLAGCONFIGTEST", []string{}); err == nil {
+		t.Fatal("必須のオプションがなくてもエラーになりません")
+	}
+}
+
+func TestParseArgsInvalidConfig(t *testing.T) {
+	for _, content := range []string{
+		"dir: ./data\nunknown: 1\n",
+		"dir: ./data\nprintConfig: true\n",
+		"dir: ./data\ninterval: 3600\n",
+		"dir: [a, b]\n",
+		"dir: ./data\ndir: ./other\n",
+	} {
+		var opt testOptions
+		_, err := ParseArgs(&opt, "", []string{"--config", writeConfig(t, content)})
+		if err == nil || !strings.Contains(err.Error(), "設定ファイル") {
+			t.Fatal(content, err)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	var opt testOptions
+	parser, err := ParseArgs(&opt, "", []string{"--dir", "./data", "--password", "secret", "--maxCount", "a:1", "--printConfig"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := Print(&b, parser); err != nil {
+		t.Fatal(err)
+	}
+	printed := b.String()
+	expected := "addr: localhost:8080\ndir: ./data\npassword: '********'\ninterval: 1h0m0s\nmaxCount:\n- a:1\nselfSigned: false\n"
+	if printed != expected {
+		t.Fatal(printed)
+	}
+
+	// 表示した内容はそのまま設定ファイルとして使用できる
+	var reloaded testOptions
+	if _, err := ParseArgs(&reloaded, "", []string{"--config", writeConfig(t, printed)}); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Dir != opt.Dir || reloaded.Interval != opt.Interval || reloaded.MaxCount[0] != "a:1" {
+		t.Fatal(reloaded)
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var password string
+	if err := ReadSecretFile(&password, path, "password"); err != nil || password != "secret" {
+		t.Fatal(password, err)
+	}
+
+	// 値とファイルの両方は指定できない
+	if err := ReadSecretFile(&password, path, "password"); err == nil {
+		t.Fatal("値とファイルの両方を指定してもエラーになりません")
+	}
+}
+
+func TestUpperSnakeCase(t *testing.T) {
+	for name, expected := range map[string]string{
+		"addr":              "ADDR",
+		"s3SecretKey":       "S3_SECRET_KEY",
+		"signedURLLifetime": "SIGNED_URL_LIFETIME",
+		"caCert":            "CA_CERT",
+		"ueExePath":         "UE_EXE_PATH",
+	} {
+		if actual := upperSnakeCase(name); actual != expected {
+			t.Fatal(name, actual)
+		}
+	}
+}
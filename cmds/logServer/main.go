@@ -1,58 +1,268 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
-	"github.com/jessevdk/go-flags"
+	"github.com/y-akahori-ramen/ue4Runner/cmds/flagConfig"
 	"github.com/y-akahori-ramen/ue4Runner/logServer"
 )
 
 type options struct {
-	Addr     string `short:"a" long:"addr" description:"ログファイルサーバーのアドレス" default:"localhost:8080"`
-	Dir      string `short:"d" long:"dir" description:"ログファイルサーバーのデータ保存先ディレクトリ" required:"true"`
-	User     string `short:"u" long:"user" description:"ログファイルサーバーのBasic認証のユーザー名" required:"true"`
-	Password string `short:"p" long:"password" description:"ログファイルサーバーのBasic認証のパスワード" required:"true"`
+	Config      string `long:"config" description:"設定ファイル(YAML)のパス。キーにはオプションのlong名を使用する。環境変数とコマンドライン引数の指定が優先される"`
+	PrintConfig bool   `long:"printConfig" description:"有効な設定を秘密の値を伏せて表示し、終了する" config:"-"`
+
+	Addr         string `short:"a" long:"addr" description:"ログファイルサーバーのアドレス" default:"localhost:8080"`
+	Dir          string `short:"d" long:"dir" description:"ログファイルサーバーのデータ保存先ディレクトリ。local以外の保存先では受信途中のファイルや索引の保存に使用する" required:"true"`
+	User         string `short:"u" long:"user" description:"ログファイルサーバーのBasic認証のユーザー名。管理者として扱う。userFileを指定した場合は使用しない"`
+	Password     string `short:"p" long:"password" description:"ログファイルサーバーのBasic認証のパスワード" secret:"true"`
+	PasswordFile string `long:"passwordFile" description:"ログファイルサーバーのBasic認証のパスワードを記述したファイル"`
+	UserFile     string `long:"userFile" description:"ユーザーファイルのパス。1行に1ユーザーを user:bcryptハッシュ:role(reader|uploader|admin) の形式で記述する。更新すると再起動せずに反映される"`
+
+	Storage         string `long:"storage" description:"ファイルの保存先" choice:"local" choice:"s3" default:"local"`
+	S3Endpoint      string `long:"s3Endpoint" description:"S3互換ストレージの接続先(例:http://localhost:9000)"`
+	S3Bucket        string `long:"s3Bucket" description:"S3互換ストレージのバケット名"`
+	S3Region        string `long:"s3Region" description:"S3互換ストレージのリージョン" default:"us-east-1"`
+	S3Prefix        string `long:"s3Prefix" description:"バケット内で使用するキーの接頭辞"`
+	S3AccessKey     string `long:"s3AccessKey" description:"S3互換ストレージのアクセスキー"`
+	S3SecretKey     string `long:"s3SecretKey" description:"S3互換ストレージのシークレットキー" secret:"true"`
+	S3SecretKeyFile string `long:"s3SecretKeyFile" description:"S3互換ストレージのシークレットキーを記述したファイル"`
+
+	TLSCert       string   `long:"tlsCert" description:"HTTPSで使用するサーバー証明書(PEM形式)のパス。tlsKeyと合わせて指定する"`
+	TLSKey        string   `long:"tlsKey" description:"HTTPSで使用するサーバー証明書の秘密鍵(PEM形式)のパス"`
+	TLSSelfSigned bool     `long:"tlsSelfSigned" description:"自己署名CAとサーバー証明書を作成してHTTPSで待ち受ける。初回起動時に作成し、以降は保存したものを使用する"`
+	TLSHosts      []string `long:"tlsHost" description:"自己署名のサーバー証明書に含めるホスト名またはIPアドレス。複数指定可。省略した場合はaddrのホスト、localhost、このマシンのホスト名"`
+
+	SignedURLMaxLifetime time.Duration `long:"signedURLMaxLifetime" description:"発行する署名付きURLの有効期間の上限" default:"720h"`
+
+	WebhookMaxAttempts int           `long:"webhookMaxAttempts" description:"Webhookの送信に失敗した場合の最大試行回数" default:"5"`
+	WebhookBackoff     time.Duration `long:"webhookBackoff" description:"Webhookの最初の再送間隔。失敗するたびに倍にする" default:"1s"`
+
+	RetentionMaxAge        time.Duration `long:"retentionMaxAge" description:"アップロードからこの時間が経過したファイルを削除する(例:720h)。0は無制限" default:"0"`
+	RetentionMaxTotalBytes int64         `long:"retentionMaxTotalBytes" description:"保存ファイルの合計サイズ上限(バイト)。超えた分は古いファイルから削除する。過去の版とゴミ箱のファイルは含めない。0は無制限" default:"0"`
+	RetentionMaxCount      []string      `long:"retentionMaxCount" description:"コンテンツIDの前方一致ごとの最大保持数 prefix:count 形式。複数指定可"`
+	RetentionMaxVersions   int           `long:"retentionMaxVersions" description:"ファイルごとに保持する過去の版の最大数。ピン留めした版は数えない。0は無制限" default:"0"`
+	RetentionInterval      time.Duration `long:"retentionInterval" description:"保持ポリシーを適用する間隔" default:"1h"`
+	TrashPurgeDelay        time.Duration `long:"trashPurgeDelay" description:"削除したファイルをゴミ箱に残す期間。過ぎたものは保持ポリシーの適用時に完全に削除する" default:"168h"`
+
+	ShutdownTimeout time.Duration `long:"shutdownTimeout" description:"終了時に処理中のアップロードなどのリクエストの完了を待つ時間。過ぎた場合は接続を切断して終了する" default:"1m"`
 }
 
-type basicAuthHandler struct {
-	nextHandler http.Handler
-	user        string
-	password    string
+// readSecretFiles ファイルで指定された秘密の値を読み込む
+func readSecretFiles(opt *options) error {
+	if err := flagConfig.ReadSecretFile(&opt.Password, opt.PasswordFile, "password"); err != nil {
+		return err
+	}
+	return flagConfig.ReadSecretFile(&opt.S3SecretKey, opt.S3SecretKeyFile, "s3SecretKey")
 }
 
-func (b *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	user, pw, ok := r.BasicAuth()
-	if !ok || user != b.user || pw != b.password {
-		w.Header().Add("WWW-Authenticate", `Basic`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+// validate 起動前に設定の組み合わせと値の範囲を確認する
+func validate(opt options) error {
+	var errs flagConfig.Errors
+	if opt.UserFile == "" && (opt.User == "" || opt.Password == "") {
+		errs.Addf("userFile または user と password を指定してください")
+	}
+	if opt.Storage == "s3" && (opt.S3Endpoint == "" || opt.S3Bucket == "") {
+		errs.Addf("storage が s3 の場合は s3Endpoint と s3Bucket を指定してください")
+	}
+	if (opt.TLSCert == "") != (opt.TLSKey == "") {
+		errs.Addf("tlsCert と tlsKey は両方指定してください")
+	}
+	if opt.TLSSelfSigned && opt.TLSCert != "" {
+		errs.Addf("tlsSelfSigned と tlsCert は同時に指定できません")
+	}
+	if opt.SignedURLMaxLifetime <= 0 {
+		errs.Addf("signedURLMaxLifetime には正の値を指定してください: %v", opt.SignedURLMaxLifetime)
+	}
+	if opt.WebhookMaxAttempts < 1 {
+		errs.Addf("webhookMaxAttempts には1以上を指定してください: %v", opt.WebhookMaxAttempts)
 	}
+	if opt.WebhookBackoff <= 0 {
+		errs.Addf("webhookBackoff には正の値を指定してください: %v", opt.WebhookBackoff)
+	}
+	if opt.RetentionMaxAge < 0 || opt.RetentionMaxTotalBytes < 0 || opt.RetentionMaxVersions < 0 {
+		errs.Addf("retentionMaxAge, retentionMaxTotalBytes, retentionMaxVersions には0以上を指定してください")
+	}
+	if _, err := logServer.ParseMaxCountPerPrefix(opt.RetentionMaxCount); err != nil {
+		errs.Addf("retentionMaxCount: %v", err)
+	}
+	if opt.RetentionInterval <= 0 {
+		errs.Addf("retentionInterval には正の値を指定してください: %v", opt.RetentionInterval)
+	}
+	if opt.TrashPurgeDelay < 0 {
+		errs.Addf("trashPurgeDelay には0以上を指定してください: %v", opt.TrashPurgeDelay)
+	}
+	if opt.ShutdownTimeout <= 0 {
+		errs.Addf("shutdownTimeout には正の値を指定してください: %v", opt.ShutdownTimeout)
+	}
+	return errs.Err()
+}
 
-	b.nextHandler.ServeHTTP(w, r)
+// newAuthenticator 指定された認証方法を作成する
+func newAuthenticator(opt options) (logServer.Authenticator, error) {
+	if opt.UserFile != "" {
+		return logServer.LoadUserFile(opt.UserFile)
+	}
+	return logServer.NewSingleUserAuthenticator(opt.User, opt.Password), nil
+}
+
+// newLogServer 指定された保存先を使用するログファイルサーバーを作成する
+func newLogServer(opt options) (*logServer.LogServer, error) {
+	switch opt.Storage {
+	case "s3":
+		storage, err := logServer.NewS3Storage(logServer.S3Config{
+			Endpoint:  opt.S3Endpoint,
+			Bucket:    opt.S3Bucket,
+			Region:    opt.S3Region,
+			Prefix:    opt.S3Prefix,
+			AccessKey: opt.S3AccessKey,
+			SecretKey: opt.S3SecretKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return logServer.NewLogServerWithStorage(storage, opt.Dir)
+	default:
+		return logServer.NewLogServer(opt.Dir)
+	}
+}
+
+// defaultTLSHosts 自己署名のサーバー証明書に含めるホストの既定値
+func defaultTLSHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1"}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" && host != "localhost" && host != "127.0.0.1" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// listenAndServe 指定された設定に応じてHTTPまたはHTTPSで待ち受ける
+func listenAndServe(httpServer *http.Server, opt options, server *logServer.LogServer) error {
+	switch {
+	case opt.TLSCert != "":
+		httpServer.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		log.Printf("HTTPSで待ち受けます 証明書:%v", opt.TLSCert)
+		return httpServer.ListenAndServeTLS(opt.TLSCert, opt.TLSKey)
+	case opt.TLSSelfSigned:
+		hosts := opt.TLSHosts
+		if len(hosts) == 0 {
+			hosts = defaultTLSHosts(opt.Addr)
+		}
+		cert, err := server.SelfSignedTLSCert(hosts)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert.Certificate}, MinVersion: tls.VersionTLS12}
+		log.Printf("自己署名証明書を使用してHTTPSで待ち受けます ホスト:%v\nアップロード側には次のCA証明書を配布してください:%v", hosts, cert.CAPath)
+		return httpServer.ListenAndServeTLS("", "")
+	default:
+		return httpServer.ListenAndServe()
+	}
 }
 
 func main() {
 	var opt options
 
-	_, err := flags.Parse(&opt)
+	parser, err := flagConfig.Parse(&opt, "LOGSERVER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = readSecretFiles(&opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opt.PrintConfig {
+		err = flagConfig.Print(os.Stdout, parser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = validate(opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := newLogServer(opt)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server, err := logServer.NewLogServer(opt.Dir)
+	auth, err := newAuthenticator(opt)
 	if err != nil {
 		log.Fatal(err)
 	}
+	server.SetAuthenticator(auth)
+	server.SetMaxSignedURLLifetime(opt.SignedURLMaxLifetime)
+	server.SetWebhookRetry(opt.WebhookMaxAttempts, opt.WebhookBackoff)
+
+	maxCountPerPrefix, err := logServer.ParseMaxCountPerPrefix(opt.RetentionMaxCount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetRetentionPolicy(logServer.RetentionPolicy{
+		MaxAge:            opt.RetentionMaxAge,
+		MaxTotalBytes:     opt.RetentionMaxTotalBytes,
+		MaxCountPerPrefix: maxCountPerPrefix,
+		MaxVersions:       opt.RetentionMaxVersions,
+	})
+	server.SetTrashPurgeDelay(opt.TrashPurgeDelay)
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	sweeperDone := make(chan struct{})
+	go func() {
+		defer close(sweeperDone)
+		server.RunRetentionSweeper(sweeperCtx, opt.RetentionInterval)
+	}()
 
 	dirPathAbs, err := filepath.Abs(opt.Dir)
-	log.Printf("サーバー起動します\n対象ディレクトリ:%v\nAddr:%v/files/", dirPathAbs, opt.Addr)
+	log.Printf("サーバー起動します\n保存先:%v\n対象ディレクトリ:%v\nAddr:%v/files/", opt.Storage, dirPathAbs, opt.Addr)
 
-	handler := basicAuthHandler{nextHandler: server.NewHTTPHandler(), user: opt.User, password: opt.Password}
+	// 終了時は配信中のイベントとライブログの接続を切断し、処理中のリクエストの完了を待つ
+	httpServer := &http.Server{Addr: opt.Addr, Handler: server.NewHTTPHandler()}
+	httpServer.RegisterOnShutdown(server.CloseStreams)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(httpServer, opt, server)
+	}()
 
-	err = http.ListenAndServe(opt.Addr, &handler)
-	if err != nil {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("%v を受信しました。処理中のリクエストの完了を待って終了します", sig)
+	}
+	// 再度シグナルを受信した場合は待たずに終了する
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opt.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Print("処理中のリクエストが時間内に完了しなかったため切断します:", err)
+		httpServer.Close()
+	}
+
+	// 保持ポリシーの適用中であれば完了を待ってから停止する
+	stopSweeper()
+	select {
+	case <-sweeperDone:
+	case <-ctx.Done():
+		log.Print("保持ポリシーの適用が時間内に完了しませんでした")
 	}
+	server.Close()
+	log.Print("サーバーを終了しました")
 }
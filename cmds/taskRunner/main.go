@@ -1,29 +1,81 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/jessevdk/go-flags"
 	"github.com/y-akahori-ramen/gojobcoordinatortest"
+	"github.com/y-akahori-ramen/ue4Runner/cmds/flagConfig"
 	"github.com/y-akahori-ramen/ue4Runner/ueRunnerTask"
 )
 
 type options struct {
-	Addr               string `long:"addr" description:"実行サーバーアドレス" default:"localhost:8080"`
-	UEExe              string `long:"ueExePath" description:"起動するUEのExeパス" required:"true"`
-	FileServerURL      string `long:"fileServer" description:"実行結果のアップロード先サーバー" required:"true"`
-	FileServerUserName string `long:"user" description:"アップロード先サーバーのユーザー名" default:""`
-	FileServerPassword string `long:"password" description:"アップロード先サーバーのパスワード" default:""`
-	TimeOutSec         int    `long:"timeOutSec" description:"一定時間ログ更新がなければフリーズとして扱う時間" default:"60"`
+	Config      string `long:"config" description:"設定ファイル(YAML)のパス。キーにはオプションのlong名を使用する。環境変数とコマンドライン引数の指定が優先される"`
+	PrintConfig bool   `long:"printConfig" description:"有効な設定を秘密の値を伏せて表示し、終了する" config:"-"`
+
+	Addr               string        `long:"addr" description:"実行サーバーアドレス" default:"localhost:8080"`
+	UEExe              string        `long:"ueExePath" description:"起動するUEのExeパス" required:"true"`
+	FileServerURL      string        `long:"fileServer" description:"実行結果のアップロード先サーバー" required:"true"`
+	FileServerUserName string        `long:"user" description:"アップロード先サーバーのユーザー名" default:""`
+	FileServerPassword string        `long:"password" description:"アップロード先サーバーのパスワード" default:"" secret:"true"`
+	PasswordFile       string        `long:"passwordFile" description:"アップロード先サーバーのパスワードを記述したファイル" default:""`
+	TokenFile          string        `long:"tokenFile" description:"アップロード先サーバーのAPIトークンを記述したファイル" default:""`
+	TokenEnv           string        `long:"tokenEnv" description:"アップロード先サーバーのAPIトークンを設定した環境変数名。tokenFileを指定した場合は使用しない" default:"LOGSERVER_TOKEN"`
+	CACert             string        `long:"caCert" description:"アップロード先サーバーの証明書を検証するCA証明書(PEM形式)。logServerの自己署名CAを指定する。指定した場合はこのCAのみを信頼する" default:""`
+	TimeOutSec         int           `long:"timeOutSec" description:"一定時間ログ更新がなければフリーズとして扱う時間" default:"60"`
+	SignedURLLifetime  time.Duration `long:"signedURLLifetime" description:"実行結果に含める署名付きURLの有効期間(例:168h)。0の場合は発行しない" default:"168h"`
+	LiveLogInterval    time.Duration `long:"liveLogInterval" description:"実行中のUEログをアップロード先サーバーへ送信する間隔。0の場合は送信しない" default:"2s"`
+	DrainTimeout       time.Duration `long:"drainTimeout" description:"終了時に実行中のタスクが完了するのを待つ時間。過ぎた場合はUEを強制終了させる。0の場合は待たない" default:"0"`
+	ShutdownTimeout    time.Duration `long:"shutdownTimeout" description:"UEを強制終了させてから、それまでの実行結果のアップロードが完了するのを待つ時間" default:"5m"`
+}
+
+// validate 起動前に設定の組み合わせと値の範囲を確認する
+func validate(opt options) error {
+	var errs flagConfig.Errors
+	if u, err := url.Parse(opt.FileServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.Addf("fileServer にはhttpまたはhttpsのURLを指定してください: %v", opt.FileServerURL)
+	}
+	if opt.FileServerPassword != "" && opt.FileServerUserName == "" {
+		errs.Addf("password を指定する場合は user も指定してください")
+	}
+	if opt.TimeOutSec <= 0 {
+		errs.Addf("timeOutSec には正の値を指定してください: %v", opt.TimeOutSec)
+	}
+	if opt.SignedURLLifetime < 0 || opt.LiveLogInterval < 0 || opt.DrainTimeout < 0 {
+		errs.Addf("signedURLLifetime, liveLogInterval, drainTimeout には0以上を指定してください")
+	}
+	if opt.ShutdownTimeout <= 0 {
+		errs.Addf("shutdownTimeout には正の値を指定してください: %v", opt.ShutdownTimeout)
+	}
+	return errs.Err()
 }
 
 func main() {
 	var opt options
 
-	_, err := flags.Parse(&opt)
+	parser, err := flagConfig.Parse(&opt, "TASKRUNNER")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = flagConfig.ReadSecretFile(&opt.FileServerPassword, opt.PasswordFile, "password")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opt.PrintConfig {
+		err = flagConfig.Print(os.Stdout, parser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = validate(opt)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -31,20 +83,83 @@ func main() {
 	server := gojobcoordinatortest.NewTaskRunnerServer(1)
 
 	// UE起動タスクのファクトリを登録
+	// APIトークンが指定されていればBasic認証の代わりに使用する
+	token, err := ueRunnerTask.LoadToken(opt.TokenFile, opt.TokenEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
 	uploader := ueRunnerTask.NewLogServerUploaderWithBasicAuth(opt.FileServerURL, opt.FileServerUserName, opt.FileServerPassword)
+	if token != "" {
+		uploader = ueRunnerTask.NewLogServerUploaderWithToken(opt.FileServerURL, token)
+	}
+	if opt.CACert != "" {
+		err = uploader.SetCACert(opt.CACert)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// APIトークンはアップロード専用のため署名付きURLを発行できない
+	if token != "" && opt.SignedURLLifetime > 0 {
+		log.Print("APIトークンを使用するため署名付きURLは発行しません")
+	} else {
+		uploader.SetSignedURLLifetime(opt.SignedURLLifetime)
+	}
+	uploader.SetLiveLogInterval(opt.LiveLogInterval)
 	timeOut := time.Second * time.Duration(opt.TimeOutSec)
 	factory, err := ueRunnerTask.NewTaskFactory(opt.UEExe, timeOut, &uploader)
 	if err != nil {
 		log.Fatal(err)
 	}
+	metrics := ueRunnerTask.NewMetrics()
+	factory.SetMetrics(metrics)
 	server.AddFactory(ueRunnerTask.TaskName, factory.NewTask)
 
-	router := server.NewHTTPHandler()
+	// タスクの実行状況を /metrics で公開する
+	router := http.NewServeMux()
+	router.Handle("/metrics", metrics.Handler())
+	router.Handle("/", server.NewHTTPHandler())
 	go func() {
 		server.Run()
 	}()
 
 	fmt.Printf("UE4実行サーバー起動します addr:%v\n", opt.Addr)
 
-	log.Fatal(http.ListenAndServe(opt.Addr, router))
+	httpServer := &http.Server{Addr: opt.Addr, Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("%v を受信しました。新しいタスクの受け付けを止めて終了します", sig)
+	}
+	// 再度シグナルを受信した場合は待たずに終了する
+	signal.Stop(signals)
+
+	// 猶予がある間は実行中のタスクの完了を待ち、過ぎたらキャンセルしてUEを強制終了させる
+	// キャンセルしたタスクもそれまでの実行結果をアップロードしてから完了する
+	if opt.DrainTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), opt.DrainTimeout)
+		err = factory.Drain(ctx)
+		cancel()
+		if err != nil {
+			log.Print("実行中のタスクが時間内に完了しなかったためキャンセルします")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opt.ShutdownTimeout)
+	defer cancel()
+	if err := factory.Shutdown(ctx); err != nil {
+		log.Print("実行結果のアップロードが時間内に完了しませんでした:", err)
+	}
+
+	// タスクの完了を待つ間も実行状況を取得できるよう、HTTPサーバーは最後に停止する
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+	}
+	log.Print("UE4実行サーバーを終了しました")
 }
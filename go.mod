@@ -5,7 +5,10 @@ go 1.15
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/jessevdk/go-flags v1.5.0
-	github.com/mitchellh/go-ps v1.0.0 // indirect
-	github.com/y-akahori-ramen/gojobcoordinatortest v1.0.1-0.20210515094747-d293a9878355 // indirect
-	github.com/y-akahori-ramen/ziptool v1.0.2 // indirect
+	github.com/mitchellh/go-ps v1.0.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/y-akahori-ramen/gojobcoordinatortest v1.0.1-0.20210515094747-d293a9878355
+	github.com/y-akahori-ramen/ziptool v1.0.2
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	gopkg.in/yaml.v2 v2.4.0
 )
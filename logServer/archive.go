@@ -0,0 +1,128 @@
+package logServer
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ArchiveEntry zipアーカイブ内のファイル情報
+type ArchiveEntry struct {
+	Path           string    `json:"path"`
+	Size           int64     `json:"size"`
+	CompressedSize int64     `json:"compressedSize"`
+	Modified       time.Time `json:"modified"`
+}
+
+// ArchiveEntryList /archives/{contentID}/entries のレスポンス
+type ArchiveEntryList struct {
+	ContentID string         `json:"contentID"`
+	Entries   []ArchiveEntry `json:"entries"`
+}
+
+// archive 展開せずに参照する保存済みzipアーカイブ
+type archive struct {
+	*zip.Reader
+	io.Closer
+}
+
+// openArchive 保存済みのzipアーカイブを開く
+func (ctrl *fileControl) openArchive(name string) (*archive, error) {
+	if err := validateContentID(name); err != nil {
+		return nil, err
+	}
+
+	f, size, err := openReaderAt(ctrl.storage, name)
+	if err != nil {
+		return nil, fmt.Errorf("%v は存在しません", name)
+	}
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v はzipアーカイブとして読み込めません: %v", name, err)
+	}
+	return &archive{Reader: zr, Closer: f}, nil
+}
+
+// normalizeEntryPath zip内のパス表記を/区切りに揃える
+func normalizeEntryPath(name string) string {
+	return strings.TrimPrefix(strings.ReplaceAll(name, `\`, "/"), "/")
+}
+
+// entries ディレクトリを除いたファイルの一覧
+func (a *archive) entries() []ArchiveEntry {
+	entries := []ArchiveEntry{}
+	for _, f := range a.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entries = append(entries, ArchiveEntry{
+			Path:           normalizeEntryPath(f.Name),
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Modified:       f.Modified,
+		})
+	}
+	return entries
+}
+
+// find 指定したパスのファイルを探す
+func (a *archive) find(entryPath string) (*zip.File, error) {
+	entryPath = normalizeEntryPath(entryPath)
+	for _, f := range a.File {
+		if !f.FileInfo().IsDir() && normalizeEntryPath(f.Name) == entryPath {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%v はアーカイブ内に存在しません", entryPath)
+}
+
+func (server *LogServer) archiveEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	contentID := mux.Vars(r)["contentID"]
+	a, err := server.fileCtrl.openArchive(contentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer a.Close()
+
+	writeJSON(w, ArchiveEntryList{ContentID: contentID, Entries: a.entries()})
+}
+
+func (server *LogServer) archiveRawHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	a, err := server.fileCtrl.openArchive(vars["contentID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer a.Close()
+
+	f, err := a.find(vars["entryPath"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	w.Header().Set("Content-Type", contentTypeByName(path.Base(f.Name)))
+	w.Header().Set("Content-Length", strconv.FormatUint(f.UncompressedSize64, 10))
+	if !f.Modified.IsZero() {
+		w.Header().Set("Last-Modified", f.Modified.UTC().Format(http.TimeFormat))
+	}
+	io.Copy(w, src)
+}
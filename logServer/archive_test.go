@@ -0,0 +1,78 @@
+package logServer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestZip 指定した内容のzipアーカイブを作成する
+func newTestZip(t *testing.T, files map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestArchiveBrowse(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	zipData := newTestZip(t, map[string]string{
+		"Saved/Logs/log.txt":             "LogInit: Display: hello",
+		"Saved/Profiling/capture.csv":    "a,b",
+		"Saved/Screenshots/shot0001.png": "png",
+	})
+	err = server.fileCtrl.save("run.zip", zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/archives/run.zip/entries", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var list ArchiveEntryList
+	json.NewDecoder(rec.Body).Decode(&list)
+	if len(list.Entries) != 3 {
+		t.Fatal("エントリ一覧が不正です:", list)
+	}
+
+	// アーカイブ内の1ファイルだけ取得できる
+	req = httptest.NewRequest(http.MethodGet, "/archives/run.zip/raw/Saved/Logs/log.txt", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "LogInit: Display: hello" {
+		t.Fatal("エントリの取得結果が不正です:", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal("Content-Typeが不正です:", rec.Header().Get("Content-Type"))
+	}
+
+	// 存在しないエントリ
+	req = httptest.NewRequest(http.MethodGet, "/archives/run.zip/raw/Saved/Logs/none.txt", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("存在しないエントリが取得できています")
+	}
+}
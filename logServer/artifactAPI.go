@@ -0,0 +1,147 @@
+package logServer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ArtifactList /api/artifacts のレスポンス
+type ArtifactList struct {
+	Total     int            `json:"total"`
+	Offset    int            `json:"offset"`
+	Limit     int            `json:"limit"`
+	Artifacts []ArtifactInfo `json:"artifacts"`
+}
+
+// artifactQuery 一覧取得時の絞り込みと並び替えの指定
+type artifactQuery struct {
+	prefix string
+	tags   []tagFilter
+	sortBy string
+	desc   bool
+	offset int
+	limit  int
+}
+
+// parseArtifactQuery クエリパラメータから一覧取得の指定を読み込む
+//
+// prefix コンテンツIDの前方一致で絞り込む
+// tag "key:value" で値が一致するタグ、"key" でタグを持つものに絞り込む。複数指定した場合はすべてに一致するもの
+// sort contentID, size, uploadTime のいずれかで並び替える。省略時はcontentID
+// order asc または desc
+// offset, limit ページング指定
+func parseArtifactQuery(r *http.Request) (artifactQuery, error) {
+	values := r.URL.Query()
+	query := artifactQuery{prefix: values.Get("prefix"), tags: parseTagFilters(values["tag"]), sortBy: values.Get("sort"), limit: defaultListLimit}
+
+	switch query.sortBy {
+	case "":
+		query.sortBy = "contentID"
+	case "contentID", "size", "uploadTime":
+	default:
+		return query, fmt.Errorf("sortの指定が不正です: %v", query.sortBy)
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.desc = true
+	default:
+		return query, fmt.Errorf("orderの指定が不正です: %v", values.Get("order"))
+	}
+
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return query, fmt.Errorf("offsetの指定が不正です: %v", v)
+		}
+		query.offset = offset
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return query, fmt.Errorf("limitは1から%vの範囲で指定してください: %v", maxListLimit, v)
+		}
+		query.limit = limit
+	}
+
+	return query, nil
+}
+
+// apply メタデータ一覧に絞り込み、並び替え、ページングを適用する
+func (query artifactQuery) apply(infos []ArtifactInfo) ArtifactList {
+	filtered := make([]ArtifactInfo, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.ContentID, query.prefix) && matchTags(info.Tags, query.tags) {
+			filtered = append(filtered, info)
+		}
+	}
+
+	less := func(a, b ArtifactInfo) bool {
+		switch query.sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "uploadTime":
+			if !a.UploadTime.Equal(b.UploadTime) {
+				return a.UploadTime.Before(b.UploadTime)
+			}
+		}
+		return a.ContentID < b.ContentID
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		if query.desc {
+			return less(filtered[j], filtered[i])
+		}
+		return less(filtered[i], filtered[j])
+	})
+
+	list := ArtifactList{Total: len(filtered), Offset: query.offset, Limit: query.limit, Artifacts: []ArtifactInfo{}}
+	if query.offset < len(filtered) {
+		end := query.offset + query.limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		list.Artifacts = filtered[query.offset:end]
+	}
+	return list
+}
+
+func (server *LogServer) artifactListHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseArtifactQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	infos, err := server.fileCtrl.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, query.apply(infos))
+}
+
+func (server *LogServer) artifactInfoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	info, err := server.fileCtrl.info(vars["contentID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, info)
+}
@@ -0,0 +1,60 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArtifactListAPI(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	for _, name := range []string{"soak-1.zip", "soak-2.zip", "smoke-1.zip"} {
+		req := httptest.NewRequest(http.MethodPost, "/upload/"+name, strings.NewReader(name))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatal("アップロードに失敗しました:", rec.Body.String())
+		}
+	}
+
+	// 前方一致で絞り込み、降順で1件ずつ取得する
+	req := httptest.NewRequest(http.MethodGet, "/api/artifacts?prefix=soak-&order=desc&limit=1&offset=1", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	var list ArtifactList
+	err = json.NewDecoder(rec.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 2 || len(list.Artifacts) != 1 || list.Artifacts[0].ContentID != "soak-1.zip" {
+		t.Fatal("一覧が不正です:", list)
+	}
+
+	// 不正な並び替え指定はエラー
+	req = httptest.NewRequest(http.MethodGet, "/api/artifacts?sort=unknown", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("不正な指定が受け付けられています")
+	}
+
+	// 内部管理用ディレクトリは/files/から参照できない
+	req = httptest.NewRequest(http.MethodGet, "/files/.logServer/meta/soak-1.zip.json", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("内部管理用ディレクトリが参照できています")
+	}
+}
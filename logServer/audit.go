@@ -0,0 +1,302 @@
+package logServer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 監査ログに記録する操作
+const (
+	AuditUpload       = "upload"
+	AuditDownload     = "download"
+	AuditDelete       = "delete"
+	AuditPurgeVersion = "purge-version"
+	AuditRestore      = "restore"
+	AuditPurgeTrash   = "purge-trash"
+)
+
+// 監査ログに記録する操作の結果
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry 監査ログの1行
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// User 認証されたユーザー名。認証に失敗した場合は送られてきたユーザー名
+	User       string `json:"user"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	Action     string `json:"action"`
+	ContentID  string `json:"contentID"`
+	// Version アップロード・削除した版。版が定まらない場合は0
+	Version int `json:"version,omitempty"`
+	// Bytes アップロードは受信、ダウンロードは送信、削除は削除したファイルのバイト数
+	Bytes  int64  `json:"bytes"`
+	Status int    `json:"status,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// auditLog 追記のみを行うJSON Lines形式の監査ログ
+type auditLog struct {
+	lines *jsonLinesFile
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	lines, err := openJSONLinesFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("監査ログを開けません: %v", err)
+	}
+	return &auditLog{lines: lines}, nil
+}
+
+func (audit *auditLog) close() error {
+	return audit.lines.close()
+}
+
+// record 監査ログに1行追記する
+func (audit *auditLog) record(entry AuditEntry) {
+	if err := audit.lines.append(entry); err != nil {
+		log.Print("監査ログの書き込みに失敗しました:", err)
+	}
+}
+
+// auditQuery /api/audit の絞り込み条件
+type auditQuery struct {
+	from      time.Time
+	to        time.Time
+	user      string
+	action    string
+	contentID string
+	limit     int
+}
+
+// parseAuditQuery クエリパラメータから監査ログの絞り込み条件を読み込む
+//
+// from, to 記録日時の範囲。fromは含み、toは含まない
+// user, action, contentID 一致するものに絞り込む
+// limit 新しいものから取得する件数
+func parseAuditQuery(r *http.Request) (auditQuery, error) {
+	values := r.URL.Query()
+	query := auditQuery{user: values.Get("user"), action: values.Get("action"), contentID: values.Get("contentID"), limit: defaultListLimit}
+
+	var err error
+	if v := values.Get("from"); v != "" {
+		if query.from, err = parseViewerTime(v); err != nil {
+			return query, err
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if query.to, err = parseViewerTime(v); err != nil {
+			return query, err
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return query, fmt.Errorf("limitは1から%vの範囲で指定してください: %v", maxListLimit, v)
+		}
+		query.limit = limit
+	}
+	return query, nil
+}
+
+func (query auditQuery) match(entry AuditEntry) bool {
+	if !query.from.IsZero() && entry.Time.Before(query.from) {
+		return false
+	}
+	if !query.to.IsZero() && !entry.Time.Before(query.to) {
+		return false
+	}
+	return (query.user == "" || entry.User == query.user) &&
+		(query.action == "" || entry.Action == query.action) &&
+		(query.contentID == "" || entry.ContentID == query.contentID)
+}
+
+// AuditList /api/audit のレスポンス
+type AuditList struct {
+	// Total 条件に一致した件数
+	Total int `json:"total"`
+	// Entries 条件に一致したもののうち新しいものからlimit件。新しい順
+	Entries []AuditEntry `json:"entries"`
+}
+
+// query 監査ログから条件に一致する記録を取得する
+func (audit *auditLog) query(query auditQuery) (AuditList, error) {
+	list := AuditList{Entries: []AuditEntry{}}
+	err := audit.lines.scan(func(line []byte) {
+		var entry AuditEntry
+		if json.Unmarshal(line, &entry) != nil || !query.match(entry) {
+			return
+		}
+		list.Total++
+		list.Entries = append(list.Entries, entry)
+		if len(list.Entries) > query.limit {
+			list.Entries = list.Entries[1:]
+		}
+	})
+	if err != nil {
+		return AuditList{}, err
+	}
+
+	for i, j := 0, len(list.Entries)-1; i < j; i, j = i+1, j-1 {
+		list.Entries[i], list.Entries[j] = list.Entries[j], list.Entries[i]
+	}
+	return list, nil
+}
+
+func (server *LogServer) auditHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := server.audit.query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+type auditKey struct{}
+
+// auditEntryFromRequest 記録中の監査ログ。監査対象外のリクエストではnil
+func auditEntryFromRequest(r *http.Request) *AuditEntry {
+	entry, _ := r.Context().Value(auditKey{}).(*AuditEntry)
+	return entry
+}
+
+// setAuditUser 監査ログに記録するユーザー名を設定する
+func setAuditUser(r *http.Request, user string) {
+	if entry := auditEntryFromRequest(r); entry != nil {
+		entry.User = user
+	}
+}
+
+// setAuditArtifact 監査ログに操作したファイルの版とサイズを記録する
+// 分割アップロードの確定や削除など、リクエストの大きさが操作したファイルの大きさと異なる場合にも正しく記録できる
+func setAuditArtifact(r *http.Request, info ArtifactInfo) {
+	if entry := auditEntryFromRequest(r); entry != nil {
+		entry.ContentID = info.ContentID
+		entry.Version = info.Version
+		entry.Bytes = info.Size
+	}
+}
+
+// recordingResponseWriter 監査ログやメトリクスに記録するステータスコードと送信バイト数を記録する
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush ストリーミング配信で書き込み済みの内容を送信する
+func (w *recordingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// countingReader 受信したバイト数を記録する
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// audited ハンドラーの実行結果を監査ログに記録する
+// 認証に失敗したリクエストも記録するためauthorizeの外側で使用する
+func (server *LogServer) audited(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		entry := &AuditEntry{User: user, RemoteAddr: r.RemoteAddr, Action: action, ContentID: auditContentID(r), Bytes: -1}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+		// ファイルの一覧など、対象のファイルが定まらないリクエストは記録しない
+		if entry.ContentID == "" {
+			return
+		}
+
+		entry.Time = time.Now()
+		entry.Status = recorder.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Result = AuditSuccess
+		if entry.Status >= http.StatusBadRequest {
+			entry.Result = AuditFailure
+		}
+		if entry.Bytes < 0 {
+			if action == AuditDownload {
+				entry.Bytes = recorder.bytes
+			} else {
+				entry.Bytes = body.bytes
+			}
+		}
+		server.audit.record(*entry)
+	})
+}
+
+// auditContentID 監査ログに記録するコンテンツID
+// /files/ はルートの変数を持たないためパスから取得する
+// ゴミ箱の操作のようにURLにコンテンツIDを含まない場合は、ハンドラーがsetAuditArtifactで設定する
+// ライブログはコンテンツIDと重ならないよう "live/タスクID" として記録する
+func auditContentID(r *http.Request) string {
+	if contentID := mux.Vars(r)["contentID"]; contentID != "" {
+		return contentID
+	}
+	if taskID := mux.Vars(r)["taskID"]; taskID != "" {
+		return "live/" + taskID
+	}
+	if strings.HasPrefix(r.URL.Path, "/files/") {
+		return strings.TrimPrefix(r.URL.Path, "/files/")
+	}
+	return ""
+}
+
+// recordAudit HTTPリクエストによらない操作を監査ログに記録する
+func (server *LogServer) recordAudit(user string, action string, info ArtifactInfo, err error) {
+	entry := AuditEntry{Time: time.Now(), User: user, Action: action, ContentID: info.ContentID, Version: info.Version, Bytes: info.Size, Result: AuditSuccess}
+	if err != nil {
+		entry.Result = AuditFailure
+		entry.Error = err.Error()
+	}
+	server.audit.record(entry)
+}
@@ -0,0 +1,108 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	userFilePath := filepath.Join(dir, "users.htpasswd")
+	writeUserFile(t, userFilePath, map[string]string{"ci": "uploader", "root": "admin"})
+	userFile, err := LoadUserFile(userFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuthenticator(userFile)
+	handler := server.NewHTTPHandler()
+
+	do := func(user string, method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(user, user)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	query := func(values url.Values) AuditList {
+		rec := do("root", http.MethodGet, "/api/audit?"+values.Encode(), "")
+		if rec.Code != http.StatusOK {
+			t.Fatal(rec.Body.String())
+		}
+		var list AuditList
+		json.NewDecoder(rec.Body).Decode(&list)
+		return list
+	}
+
+	start := time.Now()
+	do("ci", http.MethodPost, "/upload/run.log", "0123456789")
+	do("ci", http.MethodGet, "/files/run.log", "")
+	// ログビューアーでの閲覧もダウンロードとして記録される
+	do("ci", http.MethodGet, "/view/run.log", "")
+	if rec := do("ci", http.MethodPost, "/delete/run.log", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("uploaderが削除できています:", rec.Code)
+	}
+	do("root", http.MethodPost, "/delete/run.log", "")
+
+	// 監査ログは管理者のみ参照できる
+	if rec := do("ci", http.MethodGet, "/api/audit", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("uploaderが監査ログを参照できています:", rec.Code)
+	}
+
+	list := query(url.Values{})
+	if list.Total != 5 {
+		t.Fatal("監査ログの件数が不正です:", list)
+	}
+	// 新しい順に返す
+	deleted, denied, viewed, downloaded, uploaded := list.Entries[0], list.Entries[1], list.Entries[2], list.Entries[3], list.Entries[4]
+	if uploaded.Action != AuditUpload || uploaded.User != "ci" || uploaded.Bytes != 10 || uploaded.Version != 1 || uploaded.Result != AuditSuccess || uploaded.RemoteAddr == "" {
+		t.Fatal("アップロードの記録が不正です:", uploaded)
+	}
+	if downloaded.Action != AuditDownload || downloaded.ContentID != "run.log" || downloaded.Bytes != 10 {
+		t.Fatal("ダウンロードの記録が不正です:", downloaded)
+	}
+	if viewed.Action != AuditDownload || viewed.ContentID != "run.log" || viewed.User != "ci" || viewed.Result != AuditSuccess {
+		t.Fatal("ログビューアーでの閲覧の記録が不正です:", viewed)
+	}
+	if denied.Action != AuditDelete || denied.User != "ci" || denied.Status != http.StatusForbidden || denied.Result != AuditFailure {
+		t.Fatal("拒否された削除の記録が不正です:", denied)
+	}
+	if deleted.Action != AuditDelete || deleted.User != "root" || deleted.Bytes != 10 || deleted.Result != AuditSuccess {
+		t.Fatal("削除の記録が不正です:", deleted)
+	}
+
+	// 条件と期間で絞り込める
+	if list := query(url.Values{"action": {AuditDelete}, "user": {"root"}}); list.Total != 1 || list.Entries[0].User != "root" {
+		t.Fatal("操作とユーザーで絞り込めていません:", list)
+	}
+	if list := query(url.Values{"to": {start.Add(-time.Hour).Format(time.RFC3339)}}); list.Total != 0 {
+		t.Fatal("期間で絞り込めていません:", list)
+	}
+	if list := query(url.Values{"from": {start.Add(-time.Hour).Format(time.RFC3339)}, "limit": {"1"}}); list.Total != 5 || len(list.Entries) != 1 || list.Entries[0].Action != AuditDelete {
+		t.Fatal("件数を制限できていません:", list)
+	}
+	if rec := do("root", http.MethodGet, "/api/audit?from=yesterday", ""); rec.Code != http.StatusBadRequest {
+		t.Fatal("不正な日時が受け付けられています:", rec.Code)
+	}
+
+	// 保持ポリシーによる削除も記録される
+	do("ci", http.MethodPost, "/upload/old.log", "old")
+	server.SetRetentionPolicy(RetentionPolicy{MaxCountPerPrefix: map[string]int{"old": 0}})
+	if _, err := server.SweepRetention(false); err != nil {
+		t.Fatal(err)
+	}
+	if list := query(url.Values{"user": {"retention"}}); list.Total != 1 || list.Entries[0].ContentID != "old.log" || list.Entries[0].Bytes != 3 {
+		t.Fatal("保持ポリシーによる削除が記録されていません:", list)
+	}
+}
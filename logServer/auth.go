@@ -0,0 +1,315 @@
+package logServer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role ユーザーに許可する操作の範囲。値が大きいほど多くの操作ができる
+type Role int
+
+const (
+	// RoleReader ファイルの参照のみ
+	RoleReader Role = iota + 1
+	// RoleUploader 参照に加えてアップロードとタグ・ピン留めの変更
+	RoleUploader
+	// RoleAdmin すべての操作
+	RoleAdmin
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleReader:
+		return "reader"
+	case RoleUploader:
+		return "uploader"
+	case RoleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("Role(%d)", int(role))
+}
+
+// ParseRole 名前からRoleを取得する
+func ParseRole(name string) (Role, error) {
+	for role := RoleReader; role <= RoleAdmin; role++ {
+		if role.String() == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("不明なロールです: %v", name)
+}
+
+// Identity 認証されたリクエストの送信者
+type Identity struct {
+	User string
+	Role Role
+	// UploadOnly 新しいファイルのアップロードとライブログの送信以外の操作を許可しない
+	UploadOnly bool
+	// ContentIDPrefix 空でない場合はこの接頭辞で始まるコンテンツIDのみ操作できる
+	ContentIDPrefix string
+}
+
+// errUnauthorized 認証情報がない、または一致しない
+var errUnauthorized = errors.New("認証に失敗しました")
+
+// Authenticator リクエストの送信者を認証する
+type Authenticator interface {
+	// Authenticate 認証できない場合はerrUnauthorizedを返す
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext リクエストのcontextから認証された送信者を取得する
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// requestUser リクエストの送信者のユーザー名
+func requestUser(r *http.Request) string {
+	identity, _ := IdentityFromContext(r.Context())
+	return identity.User
+}
+
+// SetAuthenticator リクエストの認証方法を設定する。nilの場合は認証せずにすべての操作を許可する
+// NewHTTPHandlerの呼び出し前に設定すること
+func (server *LogServer) SetAuthenticator(auth Authenticator) {
+	server.auth = auth
+}
+
+// authenticate リクエストの送信者を認証する
+// APIトークンが送られた場合はAPIトークン、それ以外は設定された認証方法で認証する
+func (server *LogServer) authenticate(r *http.Request) (Identity, error) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		return server.tokens.authenticate(strings.TrimPrefix(header, bearerPrefix))
+	}
+
+	if server.auth == nil {
+		// 認証しない場合はBasic認証のユーザー名を記録のためだけに使用する
+		user, _, _ := r.BasicAuth()
+		return Identity{User: user, Role: RoleAdmin}, nil
+	}
+	return server.auth.Authenticate(r)
+}
+
+// authorize 指定したロール以上のユーザーにのみハンドラーの実行を許可する
+// アップロード専用のユーザーには許可しない
+func (server *LogServer) authorize(role Role, next http.Handler) http.Handler {
+	return server.authorizeWith(role, false, next)
+}
+
+// authorizeUpload アップローダー以上のユーザーにハンドラーの実行を許可する
+// 新しいファイルのアップロードとライブログの送信のみに使用し、アップロード専用のユーザーにも許可する
+func (server *LogServer) authorizeUpload(next http.Handler) http.Handler {
+	return server.authorizeWith(RoleUploader, true, next)
+}
+
+func (server *LogServer) authorizeWith(role Role, allowUploadOnly bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := server.authenticate(r)
+		if err != nil {
+			server.metrics.authFailed(authFailureUnauthorized)
+			w.Header().Add("WWW-Authenticate", `Basic`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		setAuditUser(r, identity.User)
+
+		if identity.Role < role {
+			server.metrics.authFailed(authFailureForbidden)
+			http.Error(w, fmt.Sprintf("%v にはこの操作の権限がありません。%v 以上のロールが必要です", identity.User, role), http.StatusForbidden)
+			return
+		}
+		if identity.UploadOnly && !allowUploadOnly {
+			server.metrics.authFailed(authFailureForbidden)
+			http.Error(w, fmt.Sprintf("%v はアップロード専用です", identity.User), http.StatusForbidden)
+			return
+		}
+		if contentID := requestContentID(r); identity.ContentIDPrefix != "" && !strings.HasPrefix(contentID, identity.ContentIDPrefix) {
+			server.metrics.authFailed(authFailureForbidden)
+			http.Error(w, fmt.Sprintf("%v は %v で始まるコンテンツIDのみ操作できます", identity.User, identity.ContentIDPrefix), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// requestContentID 権限の確認に使用するコンテンツID
+// ライブログのタスクIDは実行結果のアーカイブのコンテンツIDの先頭になるため、コンテンツIDとして扱う
+func requestContentID(r *http.Request) string {
+	vars := mux.Vars(r)
+	if contentID, ok := vars["contentID"]; ok {
+		return contentID
+	}
+	return vars["taskID"]
+}
+
+// singleUserAuthenticator 1つのユーザー名とパスワードで認証する
+type singleUserAuthenticator struct {
+	user     string
+	password string
+}
+
+// NewSingleUserAuthenticator 1つのユーザー名とパスワードで認証し、管理者として扱うAuthenticatorを作成する
+func NewSingleUserAuthenticator(user string, password string) Authenticator {
+	return &singleUserAuthenticator{user: user, password: password}
+}
+
+func (auth *singleUserAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(auth.user)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(auth.password)) != 1 {
+		return Identity{}, errUnauthorized
+	}
+	return Identity{User: user, Role: RoleAdmin}, nil
+}
+
+// userEntry ユーザーファイルの1行
+type userEntry struct {
+	hash []byte
+	role Role
+}
+
+// UserFile htpasswd形式(bcrypt)のユーザーファイルで認証するAuthenticator
+//
+// 1行に1ユーザーを "user:bcryptハッシュ:role" の形式で記述する。roleは reader, uploader, admin のいずれか
+// roleを省略した場合は reader として扱う。htpasswd -nbB で作成した行に :role を付け足して使用できる
+// ファイルの更新日時が変わった場合は次のリクエスト時に読み込み直す
+type UserFile struct {
+	path string
+
+	lock    sync.RWMutex
+	modTime time.Time
+	users   map[string]userEntry
+	// verified 照合済みのパスワードのSHA-256
+	// 分割アップロードのように続けて送られるリクエストのたびにbcryptで照合しないようにする
+	verified map[string][sha256.Size]byte
+}
+
+// LoadUserFile ユーザーファイルを読み込む
+func LoadUserFile(path string) (*UserFile, error) {
+	file := &UserFile{path: path}
+	if err := file.Reload(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Reload ユーザーファイルを読み込み直す。読み込みに失敗した場合は以前の内容を使用し続ける
+func (file *UserFile) Reload() error {
+	stat, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUserFile(file.path)
+	if err != nil {
+		return err
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+	file.users = users
+	file.modTime = stat.ModTime()
+	file.verified = map[string][sha256.Size]byte{}
+	return nil
+}
+
+func parseUserFile(path string) (map[string]userEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]userEntry{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%v:%v user:hash:role の形式で記述してください", path, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("%v:%v bcryptのハッシュではありません: %v", path, lineNumber, err)
+		}
+
+		entry := userEntry{hash: []byte(fields[1]), role: RoleReader}
+		if len(fields) == 3 {
+			if entry.role, err = ParseRole(fields[2]); err != nil {
+				return nil, fmt.Errorf("%v:%v %v", path, lineNumber, err)
+			}
+		}
+		users[fields[0]] = entry
+	}
+	return users, scanner.Err()
+}
+
+// reloadIfModified ファイルの更新日時が変わっていれば読み込み直す
+func (file *UserFile) reloadIfModified() {
+	stat, err := os.Stat(file.path)
+	if err != nil {
+		return
+	}
+
+	file.lock.RLock()
+	modified := !stat.ModTime().Equal(file.modTime)
+	file.lock.RUnlock()
+
+	if modified {
+		if err := file.Reload(); err != nil {
+			log.Print("ユーザーファイルの読み込みに失敗しました:", err)
+			return
+		}
+		log.Print("ユーザーファイルを読み込み直しました:", file.path)
+	}
+}
+
+func (file *UserFile) Authenticate(r *http.Request) (Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, errUnauthorized
+	}
+
+	file.reloadIfModified()
+
+	sum := sha256.Sum256([]byte(password))
+	file.lock.RLock()
+	entry, ok := file.users[user]
+	verified, cached := file.verified[user]
+	file.lock.RUnlock()
+	if !ok {
+		return Identity{}, errUnauthorized
+	}
+
+	if !cached || subtle.ConstantTimeCompare(verified[:], sum[:]) != 1 {
+		if bcrypt.CompareHashAndPassword(entry.hash, []byte(password)) != nil {
+			return Identity{}, errUnauthorized
+		}
+		// 照合中に読み込み直された場合は古いパスワードを記録しない
+		file.lock.Lock()
+		if current, ok := file.users[user]; ok && bytes.Equal(current.hash, entry.hash) {
+			file.verified[user] = sum
+		}
+		file.lock.Unlock()
+	}
+	return Identity{User: user, Role: entry.role}, nil
+}
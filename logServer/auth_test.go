@@ -0,0 +1,126 @@
+package logServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeUserFile テスト用のユーザーファイルを作成する。パスワードはユーザー名と同じにする
+func writeUserFile(t *testing.T, path string, roles map[string]string) {
+	var lines []string
+	for user, role := range roles {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s:%s", user, hash, role))
+	}
+	err := ioutil.WriteFile(path, []byte("# テスト用\n"+strings.Join(lines, "\n")), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserFileAuth(t *testing.T) {
+	dir := t.TempDir()
+	userFilePath := filepath.Join(dir, "users.htpasswd")
+	writeUserFile(t, userFilePath, map[string]string{"viewer": "reader", "ci": "uploader", "root": "admin"})
+
+	userFile, err := LoadUserFile(userFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuthenticator(userFile)
+	handler := server.NewHTTPHandler()
+
+	do := func(user string, method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, user)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// 認証情報がない場合とパスワードが違う場合は401
+	if rec := do("", http.MethodGet, "/api/artifacts", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("認証なしで参照できています:", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/artifacts", nil)
+	req.SetBasicAuth("root", "wrong")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("誤ったパスワードで参照できています:", rec.Code)
+	}
+
+	// readerはアップロードできない
+	if rec := do("viewer", http.MethodPost, "/upload/run.log", "log"); rec.Code != http.StatusForbidden {
+		t.Fatal("readerがアップロードできています:", rec.Code)
+	}
+
+	// uploaderはアップロードでき、ユーザー名が記録される
+	rec = do("ci", http.MethodPost, "/upload/run.log", "log")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var info ArtifactInfo
+	json.NewDecoder(rec.Body).Decode(&info)
+	if info.User != "ci" {
+		t.Fatal("アップロードしたユーザーが記録されていません:", info)
+	}
+
+	if rec := do("viewer", http.MethodGet, "/files/run.log", ""); rec.Code != http.StatusOK || rec.Body.String() != "log" {
+		t.Fatal("readerが参照できません:", rec.Code)
+	}
+
+	// 削除はadminのみ
+	if rec := do("ci", http.MethodPost, "/delete/run.log", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("uploaderが削除できています:", rec.Code)
+	}
+	if rec := do("root", http.MethodPost, "/delete/run.log", ""); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	// ファイルを更新すると再起動せずに反映される
+	writeUserFile(t, userFilePath, map[string]string{"viewer": "admin"})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(userFilePath, future, future)
+
+	if rec := do("ci", http.MethodGet, "/api/artifacts", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatal("削除したユーザーで参照できています:", rec.Code)
+	}
+	if rec := do("viewer", http.MethodPost, "/upload/run2.log", "log"); rec.Code != http.StatusOK {
+		t.Fatal("ロールの変更が反映されていません:", rec.Code)
+	}
+}
+
+func TestLoadUserFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.htpasswd")
+	for _, content := range []string{"user:plain:admin", "user:$2a$04$abcdefghijklmnopqrstuuGy0Rt4eaqKWBrfyJ8o9vy0XGlhXnKEa:owner"} {
+		err := ioutil.WriteFile(path, []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUserFile(path); err == nil {
+			t.Fatal("不正なユーザーファイルが読み込めています:", content)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package logServer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 一括削除の各ファイルの結果
+const (
+	BulkWouldDelete    = "would-delete"
+	BulkDeleted        = "deleted"
+	BulkFailed         = "failed"
+	BulkNotFound       = "not-found"
+	BulkSkipped        = "skipped"
+	BulkRolledBack     = "rolled-back"
+	BulkRollbackFailed = "rollback-failed"
+)
+
+// BulkQuery 一括削除の対象を選ぶ条件。指定したすべての条件に一致するファイルを対象にする
+type BulkQuery struct {
+	Prefix string `json:"prefix,omitempty"`
+	// Tags "key:value" で値が一致するタグ、"key" でタグを持つもの
+	Tags []string `json:"tags,omitempty"`
+	// OlderThan アップロードからこの期間が過ぎたもの。例: 72h
+	OlderThan string `json:"olderThan,omitempty"`
+	// SizeGreaterThan このバイト数より大きいもの
+	SizeGreaterThan int64 `json:"sizeGreaterThan,omitempty"`
+}
+
+func (query BulkQuery) empty() bool {
+	return query.Prefix == "" && len(query.Tags) == 0 && query.OlderThan == "" && query.SizeGreaterThan == 0
+}
+
+// BulkDeleteRequest /api/bulk/delete の指定
+// ContentIDsとQueryのどちらか一方を指定する
+type BulkDeleteRequest struct {
+	ContentIDs []string   `json:"contentIDs,omitempty"`
+	Query      *BulkQuery `json:"query,omitempty"`
+	// DryRun 削除せずに対象のみを返す
+	DryRun bool `json:"dryRun"`
+}
+
+// BulkDeleteItem 一括削除の各ファイルの結果
+type BulkDeleteItem struct {
+	ContentID string `json:"contentID"`
+	Size      int64  `json:"size"`
+	Status    string `json:"status"`
+	// TrashID 削除したファイルのゴミ箱のID
+	TrashID string `json:"trashID,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkDeleteReport /api/bulk/delete のレスポンス
+type BulkDeleteReport struct {
+	DryRun bool `json:"dryRun"`
+	// Committed すべての削除が完了したか。失敗した場合は削除済みのファイルを元に戻す
+	Committed  bool             `json:"committed"`
+	Count      int              `json:"count"`
+	TotalBytes int64            `json:"totalBytes"`
+	Items      []BulkDeleteItem `json:"items"`
+	Error      string           `json:"error,omitempty"`
+}
+
+var (
+	// errBulkAborted 一括削除を中断し、削除済みのファイルを元に戻した
+	errBulkAborted = errors.New("一括削除を中断しました")
+	// errBulkInvalidRequest 一括削除の指定が不正
+	errBulkInvalidRequest = errors.New("一括削除の指定が不正です")
+)
+
+// bulkTargets 一括削除の対象を選ぶ
+// ファイルを指定した場合は存在しないものがあればエラーとし、結果にnot-foundとして含める
+// 条件を指定した場合は保持ポリシーと同様に、ピン留めされた版を持つファイルを対象外とする
+func (server *LogServer) bulkTargets(req BulkDeleteRequest, now time.Time) ([]ArtifactInfo, []BulkDeleteItem, error) {
+	if (len(req.ContentIDs) == 0) == (req.Query == nil) {
+		return nil, nil, fmt.Errorf("%w: contentIDs と query のどちらか一方を指定してください", errBulkInvalidRequest)
+	}
+
+	if req.Query == nil {
+		targets := []ArtifactInfo{}
+		var missing []BulkDeleteItem
+		seen := map[string]bool{}
+		for _, name := range req.ContentIDs {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			info, err := server.fileCtrl.info(name)
+			if err != nil {
+				missing = append(missing, BulkDeleteItem{ContentID: name, Status: BulkNotFound, Error: err.Error()})
+				continue
+			}
+			targets = append(targets, info)
+		}
+		return targets, missing, nil
+	}
+
+	query := *req.Query
+	if query.empty() {
+		return nil, nil, fmt.Errorf("%w: すべてのファイルを対象にしないよう query には1つ以上の条件を指定してください", errBulkInvalidRequest)
+	}
+	var olderThan time.Duration
+	if query.OlderThan != "" {
+		d, err := time.ParseDuration(query.OlderThan)
+		if err != nil || d < 0 {
+			return nil, nil, fmt.Errorf("%w: olderThanの指定が不正です: %v", errBulkInvalidRequest, query.OlderThan)
+		}
+		olderThan = d
+	}
+	tags := parseTagFilters(query.Tags)
+
+	infos, err := server.fileCtrl.list()
+	if err != nil {
+		return nil, nil, err
+	}
+	archived, err := server.fileCtrl.allArchivedVersions()
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := []ArtifactInfo{}
+	for _, info := range infos {
+		if isPinned(info, archived[info.ContentID]) || !strings.HasPrefix(info.ContentID, query.Prefix) || !matchTags(info.Tags, tags) {
+			continue
+		}
+		if query.OlderThan != "" && now.Sub(info.UploadTime) < olderThan {
+			continue
+		}
+		if info.Size <= query.SizeGreaterThan {
+			continue
+		}
+		targets = append(targets, info)
+	}
+	return targets, nil, nil
+}
+
+// BulkDelete 指定したファイルまたは条件に一致するファイルをまとめてゴミ箱に移す
+// 途中で失敗した場合は削除済みのファイルを元に戻し、すべて削除するか何も削除しないかのどちらかにする
+func (server *LogServer) BulkDelete(req BulkDeleteRequest, user string) (BulkDeleteReport, error) {
+	report := BulkDeleteReport{DryRun: req.DryRun, Items: []BulkDeleteItem{}}
+
+	targets, missing, err := server.bulkTargets(req, time.Now())
+	if err != nil {
+		return report, err
+	}
+	for _, info := range targets {
+		status := BulkWouldDelete
+		if !req.DryRun {
+			status = BulkSkipped
+		}
+		report.Items = append(report.Items, BulkDeleteItem{ContentID: info.ContentID, Size: info.Size, Status: status})
+		report.Count++
+		report.TotalBytes += info.Size
+	}
+	if len(missing) > 0 {
+		report.Items = append(report.Items, missing...)
+		report.Error = fmt.Sprintf("%v 件のファイルが存在しません", len(missing))
+		return report, fmt.Errorf("%w: %v", errBulkAborted, report.Error)
+	}
+	if req.DryRun {
+		return report, nil
+	}
+
+	// 購読者に取り消したものが見えないよう、イベントはすべて削除できてから通知する
+	events := make([]Event, 0, len(targets))
+	for i, info := range targets {
+		item, err := server.deleteArtifact(info.ContentID, user)
+		server.recordAudit(user, AuditDelete, info, err)
+		if err != nil {
+			report.Items[i].Status = BulkFailed
+			report.Items[i].Error = err.Error()
+			report.Error = fmt.Sprintf("%v の削除に失敗しました: %v", info.ContentID, err)
+			server.rollbackBulkDelete(report.Items[:i], user)
+			return report, fmt.Errorf("%w: %v", errBulkAborted, report.Error)
+		}
+		report.Items[i].Status = BulkDeleted
+		report.Items[i].TrashID = item.TrashID
+		events = append(events, Event{Type: EventArtifactDeleted, User: user, Artifact: info, TrashID: item.TrashID})
+	}
+
+	report.Committed = true
+	for _, event := range events {
+		server.publish(event)
+	}
+	log.Printf("%v が %v 件のファイルをまとめてゴミ箱に移しました", user, report.Count)
+	return report, nil
+}
+
+// rollbackBulkDelete 一括削除で削除済みのファイルを後から削除したものから順に元に戻す
+// 削除を通知する前に戻すため、復元のイベントも通知しない
+func (server *LogServer) rollbackBulkDelete(items []BulkDeleteItem, user string) {
+	for i := len(items) - 1; i >= 0; i-- {
+		info, err := server.fileCtrl.restore(items[i].TrashID)
+		if err != nil {
+			items[i].Status = BulkRollbackFailed
+			items[i].Error = err.Error()
+			log.Printf("一括削除の取り消しに失敗しました %v ゴミ箱のID:%v: %v", items[i].ContentID, items[i].TrashID, err)
+			continue
+		}
+		server.artifactSaved(info)
+		server.recordAudit(user, AuditRestore, info, nil)
+		items[i].Status = BulkRolledBack
+	}
+}
+
+func (server *LogServer) bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("一括削除の指定をJSONとして読み込めません: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	report, err := server.BulkDelete(req, requestUser(r))
+	switch {
+	case errors.Is(err, errBulkAborted):
+		writeJSONWithStatus(w, http.StatusConflict, report)
+	case errors.Is(err, errBulkInvalidRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, report)
+	}
+}
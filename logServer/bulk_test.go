@@ -0,0 +1,145 @@
+package logServer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingMoveStorage 指定したキーの移動に失敗するStorage
+// failListに1を設定すると一覧の取得にも失敗する。索引の作成からも呼ばれるためatomicで読み書きする
+type failingMoveStorage struct {
+	*MemoryStorage
+	failKey  string
+	failList int32
+}
+
+func (storage *failingMoveStorage) List(prefix string) ([]StorageObject, error) {
+	if atomic.LoadInt32(&storage.failList) != 0 {
+		return nil, errors.New("list failed")
+	}
+	return storage.MemoryStorage.List(prefix)
+}
+
+func (storage *failingMoveStorage) Move(src string, dst string) error {
+	if src == storage.failKey {
+		return errors.New("move failed")
+	}
+	return storage.MemoryStorage.Move(src, dst)
+}
+
+func TestBulkDelete(t *testing.T) {
+	storage := &failingMoveStorage{MemoryStorage: NewMemoryStorage()}
+	server, err := NewLogServerWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	do := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("root", "")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	bulkDelete := func(body string, expectedStatus int) BulkDeleteReport {
+		rec := do(http.MethodPost, "/api/bulk/delete", body)
+		if rec.Code != expectedStatus {
+			t.Fatal(rec.Code, rec.Body.String())
+		}
+		var report BulkDeleteReport
+		json.NewDecoder(rec.Body).Decode(&report)
+		return report
+	}
+
+	do(http.MethodPost, "/upload/nightly-1.log?meta.branch=main", "0123456789")
+	do(http.MethodPost, "/upload/nightly-2.log?meta.branch=main", "01234")
+	do(http.MethodPost, "/upload/nightly-3.log?meta.branch=dev", "0123456789")
+	do(http.MethodPost, "/upload/release.log?meta.branch=main", "0123456789")
+	do(http.MethodPut, "/api/artifacts/nightly-3.log/versions/1/pin", "")
+	// 過去の版だけがピン留めされたファイル
+	do(http.MethodPost, "/upload/nightly-4.log", "0123456789")
+	do(http.MethodPut, "/upload/nightly-4.log", "9876543210")
+	do(http.MethodPut, "/api/artifacts/nightly-4.log/versions/1/pin", "")
+
+	// 条件の指定が不正な場合は何も削除しない
+	bulkDelete(`{"query":{}}`, http.StatusBadRequest)
+	bulkDelete(`{"contentIDs":["release.log"],"query":{"prefix":"nightly-"}}`, http.StatusBadRequest)
+
+	// 一覧の取得に失敗した場合はサーバーのエラーとする
+	atomic.StoreInt32(&storage.failList, 1)
+	bulkDelete(`{"query":{"prefix":"nightly-"},"dryRun":true}`, http.StatusInternalServerError)
+	atomic.StoreInt32(&storage.failList, 0)
+
+	// dryRunは削除対象のみを返す。ピン留めされた版を持つファイルは条件の対象外
+	report := bulkDelete(`{"query":{"prefix":"nightly-","sizeGreaterThan":5},"dryRun":true}`, http.StatusOK)
+	if !report.DryRun || report.Count != 1 || report.Items[0].ContentID != "nightly-1.log" || report.Items[0].Status != BulkWouldDelete {
+		t.Fatal("dryRunの結果が不正です:", report)
+	}
+	report = bulkDelete(`{"query":{"tags":["branch:main"],"olderThan":"1h"},"dryRun":true}`, http.StatusOK)
+	if report.Count != 0 {
+		t.Fatal("アップロード日時で絞り込めていません:", report)
+	}
+	if _, err := server.fileCtrl.info("nightly-1.log"); err != nil {
+		t.Fatal("dryRunで削除されています:", err)
+	}
+
+	// 存在しないファイルを含む場合は何も削除しない
+	report = bulkDelete(`{"contentIDs":["nightly-1.log","missing.log"]}`, http.StatusConflict)
+	if report.Committed || report.Items[1].Status != BulkNotFound {
+		t.Fatal("存在しないファイルの結果が不正です:", report)
+	}
+	if _, err := server.fileCtrl.info("nightly-1.log"); err != nil {
+		t.Fatal("中断した一括削除で削除されています:", err)
+	}
+
+	// 途中で失敗した場合は削除済みのファイルを元に戻し、イベントは通知しない
+	_, events := server.events.subscribe(0)
+	defer server.events.unsubscribe(events)
+	storage.failKey = "nightly-2.log"
+	report = bulkDelete(`{"query":{"tags":["branch:main"],"prefix":"nightly-"}}`, http.StatusConflict)
+	if report.Committed || report.Items[0].Status != BulkRolledBack || report.Items[1].Status != BulkFailed {
+		t.Fatal("失敗時の結果が不正です:", report)
+	}
+	if len(events) != 0 {
+		t.Fatal("取り消した一括削除のイベントが通知されています:", <-events)
+	}
+	if rec := do(http.MethodGet, "/files/nightly-1.log", ""); rec.Body.String() != "0123456789" {
+		t.Fatal("削除済みのファイルが元に戻っていません:", rec.Code)
+	}
+	if items, _ := server.listTrash(); len(items) != 0 {
+		t.Fatal("元に戻したファイルがゴミ箱に残っています:", items)
+	}
+
+	storage.failKey = ""
+	report = bulkDelete(`{"query":{"tags":["branch:main"],"prefix":"nightly-"}}`, http.StatusOK)
+	if !report.Committed || report.Count != 2 || report.TotalBytes != 15 || report.Items[0].TrashID == "" {
+		t.Fatal("一括削除の結果が不正です:", report)
+	}
+	if len(events) != 2 || (<-events).Type != EventArtifactDeleted {
+		t.Fatal("一括削除のイベントが通知されていません:", len(events))
+	}
+	list, err := server.fileCtrl.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatal("一括削除後のファイルが不正です:", list)
+	}
+
+	// 一括削除は失敗したものを含めて監査ログに1件ずつ記録される
+	audit, err := server.audit.query(auditQuery{action: AuditDelete, from: time.Now().Add(-time.Minute), limit: maxListLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit.Total != 4 || audit.Entries[1].Result != AuditSuccess || audit.Entries[2].Result != AuditFailure {
+		t.Fatal("一括削除が監査ログに記録されていません:", audit)
+	}
+}
@@ -0,0 +1,439 @@
+package logServer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 分割アップロードで使用するヘッダー
+const (
+	// UploadOffsetHeader 分割アップロードで送信するデータの開始位置
+	UploadOffsetHeader = "Upload-Offset"
+	// UploadLengthHeader 分割アップロードするファイルの合計サイズ
+	UploadLengthHeader = "Upload-Length"
+	// ContentSHA256Header アップロードするファイル全体のSHA-256(16進数文字列)
+	ContentSHA256Header = "X-Content-SHA256"
+)
+
+// uploadSessionTTL 最後の書き込みからこの時間が経過した分割アップロードは破棄する
+const uploadSessionTTL = 7 * 24 * time.Hour
+
+// sessionIDSize 分割アップロードのセッションIDのバイト数
+const sessionIDSize = 16
+
+// errChunkOutOfRange 予定サイズを超えるデータが送られた
+var errChunkOutOfRange = errors.New("予定サイズを超えるデータは受信できません")
+
+// UploadSessionStatus 分割アップロードの状態
+type UploadSessionStatus struct {
+	SessionID string `json:"sessionID"`
+	ContentID string `json:"contentID"`
+	// Offset サーバーが受信済みのバイト数。次に送信するデータの開始位置となる
+	Offset int64 `json:"offset"`
+	// Length 予定されている合計サイズ。不明な場合は0
+	Length int64 `json:"length"`
+}
+
+// uploadSession 分割アップロードのセッション情報
+type uploadSession struct {
+	ID          string            `json:"id"`
+	ContentID   string            `json:"contentID"`
+	Length      int64             `json:"length"`
+	User        string            `json:"user"`
+	ContentType string            `json:"contentType"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+// uploadSessions 分割アップロードのセッション管理
+// 受信途中のデータは保存先ディレクトリの内部管理用ディレクトリに置き、サーバー再起動後も再開できる
+type uploadSessions struct {
+	dir string
+
+	lock         sync.Mutex
+	sessionLocks map[string]*sync.Mutex
+}
+
+func newUploadSessions(dir string) (*uploadSessions, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("分割アップロード用ディレクトリの作成に失敗しました %v", err)
+	}
+	return &uploadSessions{dir: dir, sessionLocks: map[string]*sync.Mutex{}}, nil
+}
+
+func (sessions *uploadSessions) sessionPath(id string) string {
+	return path.Join(sessions.dir, id+".json")
+}
+
+func (sessions *uploadSessions) dataPath(id string) string {
+	return path.Join(sessions.dir, id+".part")
+}
+
+// lockSession セッション単位で排他し、セッション情報を読み込む。戻り値の関数でロックを解除する
+// 存在しないセッションはロックを作成せずにエラーを返す
+func (sessions *uploadSessions) lockSession(contentID string, id string) (uploadSession, func(), error) {
+	if _, err := sessions.load(contentID, id); err != nil {
+		return uploadSession{}, nil, err
+	}
+
+	sessions.lock.Lock()
+	l, ok := sessions.sessionLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		sessions.sessionLocks[id] = l
+	}
+	sessions.lock.Unlock()
+
+	// ロックを待つ間に破棄されている場合がある
+	l.Lock()
+	session, err := sessions.load(contentID, id)
+	if err != nil {
+		l.Unlock()
+		return uploadSession{}, nil, err
+	}
+	return session, l.Unlock, nil
+}
+
+func (sessions *uploadSessions) create(contentID string, length int64, upload uploadInfo) (uploadSession, error) {
+	b := make([]byte, sessionIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return uploadSession{}, err
+	}
+
+	session := uploadSession{
+		ID:          hex.EncodeToString(b),
+		ContentID:   contentID,
+		Length:      length,
+		User:        upload.user,
+		ContentType: upload.contentType,
+		Tags:        upload.tags,
+		Created:     time.Now(),
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	err = ioutil.WriteFile(sessions.sessionPath(session.ID), data, 0666)
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	f, err := os.Create(sessions.dataPath(session.ID))
+	if err != nil {
+		os.Remove(sessions.sessionPath(session.ID))
+		return uploadSession{}, err
+	}
+	f.Close()
+
+	return session, nil
+}
+
+// load セッション情報を読み込む。コンテンツIDが一致しない場合は存在しないものとして扱う
+func (sessions *uploadSessions) load(contentID string, id string) (uploadSession, error) {
+	var session uploadSession
+	if b, err := hex.DecodeString(id); err != nil || len(b) != sessionIDSize {
+		return session, fmt.Errorf("分割アップロード %v は存在しません", id)
+	}
+
+	b, err := ioutil.ReadFile(sessions.sessionPath(id))
+	if err != nil {
+		return session, fmt.Errorf("分割アップロード %v は存在しません", id)
+	}
+	err = json.Unmarshal(b, &session)
+	if err != nil {
+		return session, err
+	}
+	if session.ContentID != contentID {
+		return session, fmt.Errorf("分割アップロード %v は存在しません", id)
+	}
+	return session, nil
+}
+
+func (sessions *uploadSessions) status(session uploadSession) (UploadSessionStatus, error) {
+	stat, err := os.Stat(sessions.dataPath(session.ID))
+	if err != nil {
+		return UploadSessionStatus{}, err
+	}
+	return UploadSessionStatus{SessionID: session.ID, ContentID: session.ContentID, Offset: stat.Size(), Length: session.Length}, nil
+}
+
+// write 指定位置からデータを書き込む
+// 受信済みより前の位置が指定された場合はそれ以降のデータを破棄して書き直す
+// 予定サイズを超えるデータはerrChunkOutOfRangeとして予定サイズまでで打ち切る
+func (sessions *uploadSessions) write(session uploadSession, offset int64, src io.Reader) error {
+	f, err := os.OpenFile(sessions.dataPath(session.ID), os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if offset > stat.Size() {
+		return fmt.Errorf("受信済みのサイズ %v より後ろの位置 %v が指定されました", stat.Size(), offset)
+	}
+
+	err = f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if session.Length > 0 {
+		if offset > session.Length {
+			return errChunkOutOfRange
+		}
+		src = io.LimitReader(src, session.Length-offset+1)
+	}
+
+	// 途中で切断された場合も受信できた分は残し、再開できるようにする
+	n, err := io.Copy(f, src)
+	if session.Length > 0 && offset+n > session.Length {
+		if err := f.Truncate(session.Length); err != nil {
+			return err
+		}
+		return errChunkOutOfRange
+	}
+	return err
+}
+
+// sum 受信済みデータのSHA-256を計算する
+func (sessions *uploadSessions) sum(session uploadSession) (string, error) {
+	f, err := os.Open(sessions.dataPath(session.ID))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (sessions *uploadSessions) remove(id string) {
+	os.Remove(sessions.dataPath(id))
+	os.Remove(sessions.sessionPath(id))
+
+	sessions.lock.Lock()
+	delete(sessions.sessionLocks, id)
+	sessions.lock.Unlock()
+}
+
+// purgeExpired 一定期間更新のない分割アップロードを破棄する
+func (sessions *uploadSessions) purgeExpired(ttl time.Duration) {
+	entries, err := ioutil.ReadDir(sessions.dir)
+	if err != nil {
+		log.Print("分割アップロード一覧の取得に失敗しました:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".part") || time.Since(entry.ModTime()) < ttl {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".part")
+		log.Printf("期限切れの分割アップロードを破棄します %v", id)
+		sessions.remove(id)
+	}
+}
+
+// parseSHA256 16進数のSHA-256表記として正しいか確認し小文字に揃える
+func parseSHA256(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("SHA-256の指定が不正です: %v", value)
+	}
+	return value, nil
+}
+
+func (server *LogServer) uploadSessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	contentID := mux.Vars(r)["contentID"]
+	if err := validateContentID(contentID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server.fileCtrl.exists(contentID) {
+		http.Error(w, fmt.Sprintf("%v はすでに存在するため新規に保存できません", contentID), http.StatusConflict)
+		return
+	}
+
+	var length int64
+	if v := r.Header.Get(UploadLengthHeader); v != "" {
+		var err error
+		length, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, fmt.Sprintf("%vの指定が不正です: %v", UploadLengthHeader, v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tags, err := parseUploadTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := requestUser(r)
+	session, err := server.uploads.create(contentID, length, uploadInfo{user: user, contentType: r.Header.Get("Content-Type"), tags: tags})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/uploads/%s/%s", contentID, session.ID))
+	writeJSONWithStatus(w, http.StatusCreated, UploadSessionStatus{SessionID: session.ID, ContentID: contentID, Length: length})
+}
+
+func (server *LogServer) uploadSessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	session, err := server.uploads.load(vars["contentID"], vars["sessionID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	status, err := server.uploads.status(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (server *LogServer) uploadSessionWriteHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	vars := mux.Vars(r)
+	session, unlock, err := server.uploads.lockSession(vars["contentID"], vars["sessionID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, fmt.Sprintf("%vの指定が不正です", UploadOffsetHeader), http.StatusBadRequest)
+		return
+	}
+
+	status, err := server.uploads.status(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset > status.Offset {
+		writeJSONWithStatus(w, http.StatusConflict, status)
+		return
+	}
+	if session.Length > 0 && r.ContentLength > 0 && offset+r.ContentLength > session.Length {
+		http.Error(w, errChunkOutOfRange.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	err = server.uploads.write(session, offset, r.Body)
+	if errors.Is(err, errChunkOutOfRange) {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status, err = server.uploads.status(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (server *LogServer) uploadSessionFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	session, unlock, err := server.uploads.lockSession(vars["contentID"], vars["sessionID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+
+	expected, err := parseSHA256(r.Header.Get(ContentSHA256Header))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, err := server.uploads.status(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if session.Length > 0 && status.Offset != session.Length {
+		http.Error(w, fmt.Sprintf("受信済みサイズ %v が予定サイズ %v と一致しません", status.Offset, session.Length), http.StatusConflict)
+		return
+	}
+
+	// 内容が壊れている場合は再開しても直らないため破棄する
+	sum, err := server.uploads.sum(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sum != expected {
+		server.uploads.remove(session.ID)
+		http.Error(w, fmt.Sprintf("SHA-256が一致しません 受信:%v 指定:%v", sum, expected), http.StatusUnprocessableEntity)
+		return
+	}
+
+	upload := uploadInfo{user: session.User, contentType: session.ContentType, tags: session.Tags}
+	info, err := server.fileCtrl.saveFile(session.ContentID, server.uploads.dataPath(session.ID), sum, upload)
+	if err != nil {
+		http.Error(w, err.Error(), saveErrorStatus(err))
+		return
+	}
+	server.uploads.remove(session.ID)
+	server.artifactSaved(info)
+	setAuditArtifact(r, info)
+	server.publish(Event{Type: EventArtifactUploaded, User: session.User, Artifact: info})
+
+	w.Header().Set(ContentSHA256Header, info.SHA256)
+	writeJSON(w, info)
+}
+
+func (server *LogServer) uploadSessionAbortHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	session, unlock, err := server.uploads.lockSession(vars["contentID"], vars["sessionID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+	server.uploads.remove(session.ID)
+}
@@ -0,0 +1,170 @@
+package logServer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChunkedUpload(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	do := func(method, url string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	content := "0123456789abcdef"
+	hash := sha256.Sum256([]byte(content))
+	sum := hex.EncodeToString(hash[:])
+
+	// セッション作成
+	rec := do(http.MethodPost, "/uploads/run.zip", "", map[string]string{UploadLengthHeader: "16"})
+	if rec.Code != http.StatusCreated {
+		t.Fatal(rec.Body.String())
+	}
+	var status UploadSessionStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	sessionURL := "/uploads/run.zip/" + status.SessionID
+
+	// 途中まで送信し、受信済みの位置より後ろは受け付けない
+	rec = do(http.MethodPut, sessionURL, "01234567", map[string]string{UploadOffsetHeader: "0"})
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	rec = do(http.MethodPut, sessionURL, "cdef", map[string]string{UploadOffsetHeader: "12"})
+	if rec.Code != http.StatusConflict {
+		t.Fatal("受信済みより後ろの位置への書き込みが受け付けられています")
+	}
+
+	// 受信済みの位置を問い合わせて再開する
+	rec = do(http.MethodGet, sessionURL, "", nil)
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Offset != 8 {
+		t.Fatal("受信済みの位置が不正です:", status)
+	}
+
+	// 予定サイズに達していない状態では確定できない
+	rec = do(http.MethodPost, sessionURL+"/finalize", "", map[string]string{ContentSHA256Header: sum})
+	if rec.Code != http.StatusConflict {
+		t.Fatal("予定サイズに達していない状態で確定できています")
+	}
+
+	// 予定サイズを超えるデータは受け付けない
+	rec = do(http.MethodPut, sessionURL, "89abcdefXYZ", map[string]string{UploadOffsetHeader: "8"})
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatal("予定サイズを超えるデータが受け付けられています:", rec.Code)
+	}
+
+	// 一部を書き直しても正しく結合される
+	rec = do(http.MethodPut, sessionURL, "456789abcdef", map[string]string{UploadOffsetHeader: "4"})
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	rec = do(http.MethodPost, sessionURL+"/finalize", "", map[string]string{ContentSHA256Header: sum})
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	info, err := server.fileCtrl.info("run.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SHA256 != sum || info.Size != 16 {
+		t.Fatal("保存されたファイルが不正です:", info)
+	}
+
+	// 確定したセッションは存在しない
+	rec = do(http.MethodGet, sessionURL, "", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("確定したセッションが残っています")
+	}
+}
+
+func TestChunkedUploadChecksumMismatch(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	session, err := server.uploads.create("run.zip", 0, uploadInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.uploads.write(session, 0, strings.NewReader("broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SHA-256が一致しない場合は破棄される
+	req := httptest.NewRequest(http.MethodPost, "/uploads/run.zip/"+session.ID+"/finalize", nil)
+	req.Header.Set(ContentSHA256Header, strings.Repeat("0", 64))
+	rec := httptest.NewRecorder()
+	server.NewHTTPHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if server.fileCtrl.exists("run.zip") {
+		t.Fatal("SHA-256が一致しないファイルが保存されています")
+	}
+	if _, err := server.uploads.load("run.zip", session.ID); err == nil {
+		t.Fatal("SHA-256が一致しないセッションが残っています")
+	}
+}
+
+func TestChunkedUploadOutOfRange(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// サイズが不明なまま送られた場合も予定サイズまでで打ち切る
+	session, err := server.uploads.create("run.zip", 4, uploadInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.uploads.write(session, 0, strings.NewReader("012345"))
+	if !errors.Is(err, errChunkOutOfRange) {
+		t.Fatal(err)
+	}
+	status, err := server.uploads.status(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != 4 {
+		t.Fatal("予定サイズを超えて保存されています:", status)
+	}
+
+	// 存在しないセッションへのリクエストではロックを作成しない
+	handler := server.NewHTTPHandler()
+	for _, id := range []string{"unknown", strings.Repeat("0", 32)} {
+		req := httptest.NewRequest(http.MethodPut, "/uploads/run.zip/"+id, strings.NewReader("data"))
+		req.Header.Set(UploadOffsetHeader, "0")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Fatal(id, rec.Code)
+		}
+	}
+	if len(server.uploads.sessionLocks) != 0 {
+		t.Fatal("存在しないセッションのロックが作成されています:", server.uploads.sessionLocks)
+	}
+}
@@ -0,0 +1,200 @@
+package logServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventHistorySize Last-Event-IDによる再開のために保持する直近のイベント数
+	eventHistorySize = 1000
+	// eventSubscriberBuffer 購読者ごとに溜めておけるイベント数。溢れた購読者は切断し、再接続時に再開させる
+	eventSubscriberBuffer = 64
+	// eventKeepAliveInterval 接続を維持するためにコメント行を送る間隔
+	eventKeepAliveInterval = 15 * time.Second
+)
+
+// eventBroker 発生したイベントを購読者に配信する
+type eventBroker struct {
+	lock        sync.Mutex
+	history     []Event
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[chan Event]struct{}{}}
+}
+
+// publish イベントを履歴に追加し、すべての購読者に配信する
+func (broker *eventBroker) publish(event Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.closed {
+		return
+	}
+
+	broker.history = append(broker.history, event)
+	if len(broker.history) > eventHistorySize {
+		broker.history = append([]Event(nil), broker.history[len(broker.history)-eventHistorySize:]...)
+	}
+
+	for ch := range broker.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// 受信が追いつかない購読者は切断する
+			delete(broker.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe 購読を開始する
+// lastEventIDが0より大きい場合は、それより後に発生した保持中のイベントもあわせて返す
+// 停止済みの場合はチャンネルにnilを返す
+func (broker *eventBroker) subscribe(lastEventID int64) ([]Event, chan Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.closed {
+		return nil, nil
+	}
+
+	var missed []Event
+	if lastEventID > 0 {
+		for _, event := range broker.history {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, eventSubscriberBuffer)
+	broker.subscribers[ch] = struct{}{}
+	return missed, ch
+}
+
+func (broker *eventBroker) unsubscribe(ch chan Event) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if _, ok := broker.subscribers[ch]; ok {
+		delete(broker.subscribers, ch)
+		close(ch)
+	}
+}
+
+// close すべての購読を終了する
+func (broker *eventBroker) close() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	broker.closed = true
+	for ch := range broker.subscribers {
+		delete(broker.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventFilter /api/events で配信するイベントの絞り込み条件
+type eventFilter struct {
+	prefix string
+	tags   []tagFilter
+	types  map[string]bool
+}
+
+func (filter eventFilter) match(event Event) bool {
+	if len(filter.types) > 0 && !filter.types[event.Type] {
+		return false
+	}
+	return strings.HasPrefix(event.Artifact.ContentID, filter.prefix) && matchTags(event.Artifact.Tags, filter.tags)
+}
+
+// writeServerSentEvent Server-Sent Eventsの形式でイベントを1つ書き込む
+func writeServerSentEvent(w http.ResponseWriter, event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, b)
+	return err
+}
+
+// eventStreamHandler ファイルの保存や削除などのイベントをServer-Sent Eventsで配信する
+// prefix、tag、typeで絞り込み、Last-Event-IDヘッダーまたはlastEventIDで指定したイベントの後から再開する
+func (server *LogServer) eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "ストリーミングに対応していません", http.StatusInternalServerError)
+		return
+	}
+
+	values := r.URL.Query()
+	filter := eventFilter{prefix: values.Get("prefix"), tags: parseTagFilters(values["tag"]), types: map[string]bool{}}
+	for _, t := range values["type"] {
+		filter.types[t] = true
+	}
+
+	var lastEventID int64
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = values.Get("lastEventID")
+	}
+	if v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, fmt.Sprintf("Last-Event-IDの指定が不正です: %v", v), http.StatusBadRequest)
+			return
+		}
+		lastEventID = id
+	}
+
+	missed, ch := server.events.subscribe(lastEventID)
+	if ch == nil {
+		http.Error(w, "サーバーを停止中です", http.StatusServiceUnavailable)
+		return
+	}
+	defer server.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+
+	for _, event := range missed {
+		if filter.match(event) {
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !filter.match(event) {
+				continue
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
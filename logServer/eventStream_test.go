@@ -0,0 +1,192 @@
+package logServer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readServerSentEvent Server-Sent Eventsのイベントを1つ読み込む。コメント行とretryは読み飛ばす
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) Event {
+	var event Event
+	var id, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			if id == "" {
+				t.Fatal("idがありません")
+			}
+			return event
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ts := httptest.NewServer(server.NewHTTPHandler())
+	defer ts.Close()
+
+	do := func(method string, target string, body string) {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(body))
+		req.SetBasicAuth("root", "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	subscribe := func(query string, lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/events"+query, nil)
+		req.SetBasicAuth("root", "")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatal(resp.Status, resp.Header)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	// 前方一致とタグで絞り込む
+	reader, stop := subscribe("?prefix=nightly-&tag=branch:main", "")
+	do(http.MethodPost, "/upload/release.log?meta.branch=main", "release")
+	do(http.MethodPost, "/upload/nightly-1.log?meta.branch=dev", "dev")
+	do(http.MethodPost, "/upload/nightly-2.log?meta.branch=main", "main")
+	do(http.MethodPut, "/api/artifacts/nightly-2.log/tags", `{"branch":"main","result":"ok"}`)
+	do(http.MethodPost, "/delete/nightly-2.log", "")
+
+	uploaded := readServerSentEvent(t, reader)
+	if uploaded.Type != EventArtifactUploaded || uploaded.Artifact.ContentID != "nightly-2.log" {
+		t.Fatal(uploaded)
+	}
+	updated := readServerSentEvent(t, reader)
+	if updated.Type != EventArtifactUpdated || updated.Artifact.Tags["result"] != "ok" || updated.ID <= uploaded.ID {
+		t.Fatal(updated)
+	}
+	deleted := readServerSentEvent(t, reader)
+	if deleted.Type != EventArtifactDeleted || deleted.TrashID == "" {
+		t.Fatal(deleted)
+	}
+	stop()
+
+	// Last-Event-IDより後のイベントから再開する
+	reader, stop = subscribe("?type=artifact.updated&type=artifact.deleted", strconv.FormatInt(uploaded.ID, 10))
+	defer stop()
+	if event := readServerSentEvent(t, reader); event.ID != updated.ID {
+		t.Fatal(event)
+	}
+	if event := readServerSentEvent(t, reader); event.ID != deleted.ID {
+		t.Fatal(event)
+	}
+
+	// 停止すると購読も終了する
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	server.events.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("購読が終了しません")
+	}
+}
+
+func TestEventBrokerSlowSubscriber(t *testing.T) {
+	broker := newEventBroker()
+	_, ch := broker.subscribe(0)
+
+	// 受信が追いつかない購読者は切断される
+	for i := 1; i <= eventSubscriberBuffer+1; i++ {
+		broker.publish(Event{ID: int64(i)})
+	}
+	count := 0
+	for range ch {
+		count++
+	}
+	if count != eventSubscriberBuffer {
+		t.Fatal(count)
+	}
+
+	// 切断されても履歴から再開できる
+	missed, _ := broker.subscribe(int64(eventSubscriberBuffer))
+	if len(missed) != 1 || missed[0].ID != eventSubscriberBuffer+1 {
+		t.Fatal(missed)
+	}
+	broker.close()
+}
+
+func TestCloseStreams(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ts := httptest.NewUnstartedServer(server.NewHTTPHandler())
+	ts.Config.RegisterOnShutdown(server.CloseStreams)
+	ts.Start()
+	defer ts.Close()
+
+	post, err := http.Post(ts.URL+"/live/task-1?offset=0", "text/plain", strings.NewReader("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Body.Close()
+
+	// イベントとライブログを購読したまま停止する
+	var bodies []*http.Response
+	for _, target := range []string{"/api/events", "/live/task-1"} {
+		resp, err := http.Get(ts.URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(target, resp.Status)
+		}
+		defer resp.Body.Close()
+		bodies = append(bodies, resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.Config.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, resp := range bodies {
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package logServer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 通知するイベントの種類
+const (
+	EventArtifactUploaded = "artifact.uploaded"
+	EventArtifactDeleted  = "artifact.deleted"
+	EventArtifactRestored = "artifact.restored"
+	// EventArtifactUpdated タグやピン留めなどのメタデータを変更した
+	EventArtifactUpdated = "artifact.updated"
+	// EventRetentionDeleted 保持ポリシーによりファイルまたは過去の版を削除した
+	EventRetentionDeleted = "retention.deleted"
+	// EventPing Webhookの疎通確認
+	EventPing = "ping"
+)
+
+// Event ファイルの保存や削除などのサーバーで起きた出来事
+type Event struct {
+	// ID 発生順に増加する番号
+	ID       int64        `json:"id"`
+	Type     string       `json:"type"`
+	Time     time.Time    `json:"time"`
+	User     string       `json:"user,omitempty"`
+	Artifact ArtifactInfo `json:"artifact"`
+	// TrashID 削除したファイルのゴミ箱のID
+	TrashID string `json:"trashID,omitempty"`
+	// Reason 保持ポリシーによる削除の理由
+	Reason string `json:"reason,omitempty"`
+}
+
+// eventSequence イベントのIDの採番に使用する
+// 再起動後もIDが増加し続けるよう起動時刻から始める
+var eventSequence = time.Now().UnixNano() / int64(time.Millisecond)
+
+func nextEventID() int64 {
+	return atomic.AddInt64(&eventSequence, 1)
+}
+
+// publish イベントを /api/events の購読者とWebhookに通知する
+func (server *LogServer) publish(event Event) {
+	event.ID = nextEventID()
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	server.events.publish(event)
+	server.webhooks.dispatch(event)
+}
@@ -1,60 +1,472 @@
 package logServer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"mime"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
-type fileControl string
+// reservedDirName ログファイルサーバーが内部管理に使用するディレクトリ名
+// 保存先の直下に作成され、/files/ からは参照できない
+const reservedDirName = ".logServer"
 
-func newFileControl(dir string) (fileControl, error) {
-	// 保存先ディレクトリが存在するか
-	fileStat, err := os.Stat(dir)
-	if os.IsNotExist(err) || !fileStat.IsDir() {
-		return fileControl(""), fmt.Errorf("ファイル制御対象ディレクトリが存在しません %v", dir)
+// metaKeyPrefix メタデータを保存するキーの接頭辞
+const metaKeyPrefix = reservedDirName + "/meta/"
+
+// ArtifactInfo アップロードされたファイルのメタデータ
+type ArtifactInfo struct {
+	ContentID   string    `json:"contentID"`
+	Size        int64     `json:"size"`
+	UploadTime  time.Time `json:"uploadTime"`
+	SHA256      string    `json:"sha256"`
+	User        string    `json:"user"`
+	ContentType string    `json:"contentType"`
+	// Tags アップロード時に指定されたビルド・マップ・ブランチなどの付加情報
+	Tags map[string]string `json:"tags,omitempty"`
+	// Version 同じコンテンツIDで何番目に保存された版か
+	Version int `json:"version,omitempty"`
+	// Pinned 版の削除や保持ポリシーによる削除の対象外とする
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// uploadInfo アップロード時にリクエストから得られる付加情報
+type uploadInfo struct {
+	user        string
+	contentType string
+	// sha256 指定された場合は受信した内容のSHA-256と一致するか検証する
+	sha256 string
+	tags   map[string]string
+}
+
+var (
+	// errArtifactExists 保存しようとした名前のファイルがすでに存在する
+	errArtifactExists = errors.New("すでに存在するため新規に保存できません")
+	// errDigestMismatch 受信した内容のSHA-256が指定された値と一致しない
+	errDigestMismatch = errors.New("SHA-256が一致しません")
+)
+
+type fileControl struct {
+	storage Storage
+	// workDir 一時ファイルや索引など、サーバーのローカルで管理する内容の保存先
+	workDir string
+
+	// ファイルの存在確認から保存中の名前の予約までを排他する
+	commitLock sync.Mutex
+	// committing 保存先へ書き込み中またはゴミ箱へ移動中の名前と、復元中または完全に削除中のゴミ箱の trashPrefix
+	committing map[string]bool
+}
+
+// newFileControl 指定したディレクトリを保存先として使用する
+// 内部管理用の内容は保存先ディレクトリ内の予約ディレクトリに保存する
+func newFileControl(dir string) (*fileControl, error) {
+	storage, err := NewLocalStorage(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ファイル制御対象ディレクトリが存在しません %v", dir)
+	}
+	return newFileControlWithStorage(storage, path.Join(dir, reservedDirName))
+}
+
+// newFileControlWithStorage 指定したStorageを保存先として使用する
+func newFileControlWithStorage(storage Storage, workDir string) (*fileControl, error) {
+	ctrl := &fileControl{storage: storage, workDir: workDir, committing: map[string]bool{}}
+	err := os.MkdirAll(workDir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("作業ディレクトリの作成に失敗しました %v", err)
+	}
+
+	// 前回の実行中に書き込み途中だったファイルは不要なので作り直す
+	err = os.RemoveAll(ctrl.tempDir())
+	if err == nil {
+		err = os.MkdirAll(ctrl.tempDir(), 0777)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("一時ディレクトリの作成に失敗しました %v", err)
 	}
-	return fileControl(dir), nil
+
+	ctrl.migrateLegacyInfos()
+	return ctrl, nil
 }
 
-func (ctrl fileControl) makePath(name string) string {
-	return path.Join(string(ctrl), name)
+// reservedPath 作業ディレクトリ内のパスを作成する
+func (ctrl *fileControl) reservedPath(elem ...string) string {
+	return path.Join(append([]string{ctrl.workDir}, elem...)...)
+}
+
+func (ctrl *fileControl) tempDir() string {
+	return ctrl.reservedPath("tmp")
+}
+
+// makeMetaKey メタデータを保存するキー
+// 保存先に置くことで、保存先を共有する別のサーバーからも参照できるようにする
+func (ctrl *fileControl) makeMetaKey(name string) string {
+	return metaKeyPrefix + name + ".json"
+}
+
+// validateContentID ファイル名として使用できるコンテンツIDか確認する
+// ドットで始まる名前はサーバーの内部管理用に予約している
+func validateContentID(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%v はコンテンツIDとして使用できません", name)
+	}
+	return nil
 }
 
 // 指定した名前でファイルを保存する。すでにファイルが存在している場合はエラー扱いとなる
-func (ctrl fileControl) save(name string, src io.Reader) error {
-	filePath := ctrl.makePath(name)
+func (ctrl *fileControl) save(name string, src io.Reader) error {
+	_, err := ctrl.saveWithInfo(name, src, uploadInfo{})
+	return err
+}
+
+// 指定した名前でファイルを保存し、メタデータを記録する。すでにファイルが存在している場合はエラー扱いとなる
+func (ctrl *fileControl) saveWithInfo(name string, src io.Reader, upload uploadInfo) (ArtifactInfo, error) {
+	if err := validateContentID(name); err != nil {
+		return ArtifactInfo{}, err
+	}
 
-	_, err := os.Stat(filePath)
-	if !os.IsNotExist(err) {
-		return fmt.Errorf("%v はすでに存在するため新規に保存できません", filePath)
+	if ctrl.exists(name) {
+		return ArtifactInfo{}, fmt.Errorf("%v %w", name, errArtifactExists)
 	}
 
-	f, err := os.Create(filePath)
+	tempPath, sum, err := ctrl.receive(name, src, upload)
 	if err != nil {
-		return err
+		return ArtifactInfo{}, err
 	}
-	defer f.Close()
+	defer os.Remove(tempPath)
 
-	io.Copy(f, src)
+	return ctrl.commit(name, tempPath, sum, upload, false)
+}
 
-	return nil
+// receive 一時ファイルへ書き込みながらSHA-256を計算する
+// すべて受信でき、指定されたSHA-256と一致した場合のみ一時ファイルのパスを返す
+func (ctrl *fileControl) receive(name string, src io.Reader, upload uploadInfo) (string, string, error) {
+	f, err := ioutil.TempFile(ctrl.tempDir(), "upload-*")
+	if err != nil {
+		return "", "", err
+	}
+	tempPath := f.Name()
+
+	// 書き込みと同時にハッシュを計算する
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), src)
+	closeErr := f.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return "", "", fmt.Errorf("%v の受信に失敗しました: %v", name, err)
+	}
+	if closeErr != nil {
+		os.Remove(tempPath)
+		return "", "", closeErr
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if upload.sha256 != "" && upload.sha256 != sum {
+		os.Remove(tempPath)
+		return "", "", fmt.Errorf("%v %w 受信:%v 指定:%v", name, errDigestMismatch, sum, upload.sha256)
+	}
+	return tempPath, sum, nil
+}
+
+// 指定した名前のファイルが存在するか
+func (ctrl *fileControl) exists(name string) bool {
+	_, err := ctrl.storage.Stat(name)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// 受信済みのファイルを指定した名前で保存する。srcPathのファイルは移動される
+// すでにファイルが存在している場合はエラー扱いとなる
+func (ctrl *fileControl) saveFile(name string, srcPath string, sha string, upload uploadInfo) (ArtifactInfo, error) {
+	if err := validateContentID(name); err != nil {
+		return ArtifactInfo{}, err
+	}
+	return ctrl.commit(name, srcPath, sha, upload, false)
+}
+
+// commit 受信済みのファイルを保存先に書き込んでメタデータを記録する
+// overwriteの場合、すでに存在するファイルは過去の版として残してから置き換える
+// 保存先への書き込みは時間がかかる場合があるため、名前を予約してから排他の外で行う
+func (ctrl *fileControl) commit(name string, srcPath string, sha string, upload uploadInfo, overwrite bool) (ArtifactInfo, error) {
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+
+	info := ArtifactInfo{
+		ContentID:   name,
+		Size:        stat.Size(),
+		UploadTime:  time.Now(),
+		SHA256:      sha,
+		User:        upload.user,
+		ContentType: upload.contentType,
+		Tags:        upload.tags,
+		Version:     1,
+	}
+	if info.ContentType == "" {
+		info.ContentType = contentTypeByName(name)
+	}
+
+	ctrl.commitLock.Lock()
+	exists := ctrl.exists(name)
+	if ctrl.committing[name] || (exists && !overwrite) {
+		ctrl.commitLock.Unlock()
+		return ArtifactInfo{}, fmt.Errorf("%v %w", name, errArtifactExists)
+	}
+	ctrl.committing[name] = true
+	ctrl.commitLock.Unlock()
+
+	defer func() {
+		ctrl.commitLock.Lock()
+		delete(ctrl.committing, name)
+		ctrl.commitLock.Unlock()
+	}()
+
+	var previous *ArtifactInfo
+	if exists {
+		current, err := ctrl.archiveLatest(name)
+		if err != nil {
+			return ArtifactInfo{}, err
+		}
+		previous = &current
+		info.Version = current.Version + 1
+	} else if archived, err := ctrl.archivedVersions(name); err == nil && len(archived) > 0 {
+		info.Version = archived[len(archived)-1].Version + 1
+	}
+
+	// メタデータを先に書いておき、ファイルが見えた時点で必ずメタデータも参照できるようにする
+	err = ctrl.writeInfo(info)
+	if err == nil {
+		err = putFile(ctrl.storage, name, srcPath)
+	}
+	if err != nil {
+		ctrl.storage.Delete(ctrl.makeMetaKey(name))
+		if previous != nil {
+			ctrl.restoreLatest(*previous)
+		}
+		return ArtifactInfo{}, err
+	}
+
+	return info, nil
+}
+
+// 指定した名前のファイルを読み込み用に開く
+func (ctrl *fileControl) open(name string) (io.ReadCloser, error) {
+	if err := validateContentID(name); err != nil {
+		return nil, err
+	}
+
+	src, err := ctrl.storage.Get(name, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("%v は存在しません", name)
+	}
+	return src, nil
 }
 
 // 指定した名前のファイルを削除する。ファイルが存在しない場合はエラー扱いとなる
-func (ctrl fileControl) delete(name string) error {
-	filePath := ctrl.makePath(name)
+func (ctrl *fileControl) delete(name string) error {
+	if err := validateContentID(name); err != nil {
+		return err
+	}
 
-	fileStat, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+	err := ctrl.storage.Delete(name)
+	if errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("%v は存在しないため削除できません", name)
 	}
-	if fileStat.IsDir() {
-		return fmt.Errorf("%v はディレクトリのため削除できません", name)
+	if err != nil {
+		return err
 	}
 
-	err = os.Remove(filePath)
+	// メタデータは存在しない場合もあるのでエラーにしない
+	ctrl.storage.Delete(ctrl.makeMetaKey(name))
 
-	return err
+	return ctrl.deleteArchivedVersions(name)
+}
+
+// 指定した名前のファイルのメタデータを取得する
+// メタデータが記録されていないファイルはファイル情報から作成する。内容のハッシュは起動時のmigrateLegacyInfosで記録する
+func (ctrl *fileControl) info(name string) (ArtifactInfo, error) {
+	if err := validateContentID(name); err != nil {
+		return ArtifactInfo{}, err
+	}
+
+	stat, err := ctrl.storage.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return ArtifactInfo{}, fmt.Errorf("%v は存在しません: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+
+	b, err := readAll(ctrl.storage, ctrl.makeMetaKey(name))
+	if err == nil {
+		var info ArtifactInfo
+		if err := json.Unmarshal(b, &info); err == nil {
+			// 版の管理を行う前に保存されたファイルは最初の版として扱う
+			if info.Version == 0 {
+				info.Version = 1
+			}
+			return info, nil
+		}
+	}
+
+	// メタデータ記録前に保存されたファイル
+	return legacyInfo(name, stat), nil
+}
+
+// legacyInfo メタデータ記録前に保存されたファイルのメタデータをファイル情報から作成する
+func legacyInfo(name string, stat StorageObject) ArtifactInfo {
+	return ArtifactInfo{
+		ContentID:   name,
+		Size:        stat.Size,
+		UploadTime:  stat.ModTime,
+		ContentType: contentTypeByName(name),
+		Version:     1,
+	}
+}
+
+// migrateLegacyInfos メタデータ記録前に保存されたファイルの内容のハッシュを計算してメタデータを記録する
+// 一覧の取得などの読み込みで保存先に書き込まないよう、起動時にまとめて行う
+// 記録済みのファイルは対象にならないため、実際に処理するのは初回の起動時だけになる
+func (ctrl *fileControl) migrateLegacyInfos() {
+	names, err := ctrl.names()
+	if err != nil {
+		log.Print("メタデータ記録前に保存されたファイルの確認に失敗しました:", err)
+		return
+	}
+	metas, err := ctrl.storage.List(metaKeyPrefix)
+	if err != nil {
+		log.Print("メタデータ記録前に保存されたファイルの確認に失敗しました:", err)
+		return
+	}
+	recorded := make(map[string]bool, len(metas))
+	for _, obj := range metas {
+		recorded[obj.Key] = true
+	}
+
+	for _, name := range names {
+		if recorded[ctrl.makeMetaKey(name)] {
+			continue
+		}
+		if err := ctrl.migrateLegacyInfo(name); err != nil {
+			log.Printf("%v のメタデータの記録に失敗しました: %v", name, err)
+		}
+	}
+}
+
+func (ctrl *fileControl) migrateLegacyInfo(name string) error {
+	stat, err := ctrl.storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	src, err := ctrl.storage.Get(name, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return err
+	}
+
+	info := legacyInfo(name, stat)
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return ctrl.writeInfo(info)
+}
+
+// 指定した名前のファイルのタグを置き換える
+func (ctrl *fileControl) updateTags(name string, tags map[string]string) (ArtifactInfo, error) {
+	ctrl.commitLock.Lock()
+	defer ctrl.commitLock.Unlock()
+
+	info, err := ctrl.info(name)
+	if err != nil {
+		return info, err
+	}
+
+	if len(tags) == 0 {
+		tags = nil
+	}
+	info.Tags = tags
+	return info, ctrl.writeInfo(info)
+}
+
+// 保存されているファイルの名前の一覧を取得する
+func (ctrl *fileControl) names() ([]string, error) {
+	objects, err := ctrl.storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		if validateContentID(obj.Key) != nil {
+			continue
+		}
+		names = append(names, obj.Key)
+	}
+	return names, nil
+}
+
+// 保存されているファイルすべてのメタデータを取得する
+func (ctrl *fileControl) list() ([]ArtifactInfo, error) {
+	names, err := ctrl.names()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ArtifactInfo, 0, len(names))
+	for _, name := range names {
+		// 一覧の取得中に削除されたファイルは含めず、読み込めないファイルがあっても一覧は返す
+		info, err := ctrl.info(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("%v のメタデータの取得に失敗しました: %v", name, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (ctrl *fileControl) writeInfo(info ArtifactInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ctrl.storage.Put(ctrl.makeMetaKey(info.ContentID), bytes.NewReader(b))
+}
+
+// UEの出力物でOSの設定に依存せず判定したい拡張子
+var knownContentTypes = map[string]string{
+	".zip": "application/zip",
+	".log": "text/plain; charset=utf-8",
+	".txt": "text/plain; charset=utf-8",
+	".csv": "text/csv; charset=utf-8",
+}
+
+// contentTypeByName ファイル名の拡張子からContent-Typeを推測する
+func contentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := knownContentTypes[ext]; ok {
+		return contentType
+	}
+
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
 }
@@ -1,7 +1,12 @@
 package logServer
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -92,3 +97,178 @@ func TestFileControlNew(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFileControlInfo(t *testing.T) {
+	dir := t.TempDir()
+
+	fileCtrl, err := newFileControl(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := fileCtrl.saveWithInfo("sample.log", strings.NewReader("hello"), uploadInfo{user: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("hello")
+	if saved.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatal("ハッシュが不正です:", saved.SHA256)
+	}
+
+	info, err := fileCtrl.info("sample.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || info.User != "tester" || info.ContentType != "text/plain; charset=utf-8" {
+		t.Fatal("メタデータが不正です:", info)
+	}
+
+	// メタデータのないファイルもファイル情報から取得できる
+	err = ioutil.WriteFile(filepath.Join(dir, "legacy.zip"), []byte("zip"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := fileCtrl.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("一覧の件数が不正です:", infos)
+	}
+
+	// 削除するとメタデータも取得できなくなる
+	err = fileCtrl.delete("sample.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fileCtrl.info("sample.log")
+	if err == nil {
+		t.Fatal("削除したファイルのメタデータが取得できています")
+	}
+}
+
+func TestFileControlLegacyInfo(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "legacy.zip"), []byte("zip"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 起動時にメタデータ記録前のファイルのハッシュが記録される
+	fileCtrl, err := newFileControl(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fileCtrl.info("legacy.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("zip")
+	if info.SHA256 != "4a70fe9aa6436e02c2dea340fbd1e352e4ef2d8ce6ca52ad25d4b95471fc8bf2" || info.Size != 3 {
+		t.Fatal("メタデータが不正です:", info)
+	}
+
+	// 起動後に置かれたファイルは一覧の取得でメタデータを書き込まない
+	err = ioutil.WriteFile(filepath.Join(dir, "later.zip"), []byte("zip"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := fileCtrl.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatal("一覧の件数が不正です:", infos)
+	}
+	if fileCtrl.exists(fileCtrl.makeMetaKey("later.zip")) {
+		t.Fatal("一覧の取得でメタデータが書き込まれています")
+	}
+}
+
+// failingStatStorage 指定したキーの情報の取得に失敗するStorage
+type failingStatStorage struct {
+	*MemoryStorage
+	failKeys map[string]error
+}
+
+func (storage *failingStatStorage) Stat(key string) (StorageObject, error) {
+	if err, ok := storage.failKeys[key]; ok {
+		return StorageObject{}, err
+	}
+	return storage.MemoryStorage.Stat(key)
+}
+
+func TestFileControlListSkipsUnreadable(t *testing.T) {
+	storage := &failingStatStorage{MemoryStorage: NewMemoryStorage(), failKeys: map[string]error{}}
+	fileCtrl, err := newFileControlWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.zip", "deleted.zip", "broken.zip"} {
+		if err := fileCtrl.save(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 一覧の取得中に削除されたファイルや読み込めないファイルがあっても一覧は取得できる
+	storage.failKeys["deleted.zip"] = notExistError("deleted.zip")
+	storage.failKeys["broken.zip"] = errors.New("stat failed")
+	infos, err := fileCtrl.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ContentID != "a.zip" {
+		t.Fatal("一覧が不正です:", infos)
+	}
+}
+
+// errReader 読み込み途中でエラーを返す
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestFileControlSaveIntegrity(t *testing.T) {
+	dir := t.TempDir()
+
+	fileCtrl, err := newFileControl(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 受信途中でエラーになった場合は保存されない
+	_, err = fileCtrl.saveWithInfo("broken.zip", io.MultiReader(strings.NewReader("part"), errReader{}), uploadInfo{})
+	if err == nil {
+		t.Fatal("受信途中でエラーになったファイルの保存に成功しています")
+	}
+	if fileCtrl.exists("broken.zip") {
+		t.Fatal("受信途中のファイルが残っています")
+	}
+
+	// SHA-256が一致しない場合は保存されない
+	_, err = fileCtrl.saveWithInfo("sample.log", strings.NewReader("hello"), uploadInfo{sha256: strings.Repeat("0", 64)})
+	if !errors.Is(err, errDigestMismatch) {
+		t.Fatal("SHA-256が一致しないファイルの保存に成功しています:", err)
+	}
+	if fileCtrl.exists("sample.log") {
+		t.Fatal("SHA-256が一致しないファイルが残っています")
+	}
+
+	// SHA-256が一致すれば保存される
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	_, err = fileCtrl.saveWithInfo("sample.log", strings.NewReader("hello"), uploadInfo{sha256: sum})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 一時ファイルは残らない
+	entries, err := ioutil.ReadDir(fileCtrl.tempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal("一時ファイルが残っています:", entries)
+	}
+}
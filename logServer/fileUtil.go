@@ -0,0 +1,144 @@
+package logServer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// writeFileAtomic 一時ファイルに書き込んでから置き換え、書き込み途中の内容が読まれないようにする
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// jsonLinesFile 1行に1つのJSONを追記していくファイル
+type jsonLinesFile struct {
+	path string
+	// maxBytes 0より大きい場合、サイズがこれを超えたところで内容を1世代前のファイルへ移して書き込み直す
+	maxBytes int64
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openJSONLinesFile(path string) (*jsonLinesFile, error) {
+	return openRotatingJSONLinesFile(path, 0)
+}
+
+// openRotatingJSONLinesFile サイズがmaxBytesを超えるたびに古い内容を path.1 へ移すファイルを開く
+// 保持する内容はおよそmaxBytesの2倍までとなる
+func openRotatingJSONLinesFile(path string, maxBytes int64) (*jsonLinesFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("%v を開けません: %v", path, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v を開けません: %v", path, err)
+	}
+	return &jsonLinesFile{path: path, maxBytes: maxBytes, file: f, size: stat.Size()}, nil
+}
+
+// rotatedPath 1世代前の内容を保存するパス
+func (lines *jsonLinesFile) rotatedPath() string {
+	return lines.path + ".1"
+}
+
+func (lines *jsonLinesFile) close() error {
+	lines.lock.Lock()
+	defer lines.lock.Unlock()
+	return lines.file.Close()
+}
+
+// append 値をJSONとして1行追記する
+func (lines *jsonLinesFile) append(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	lines.lock.Lock()
+	defer lines.lock.Unlock()
+	n, err := lines.file.Write(append(b, '\n'))
+	lines.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if lines.maxBytes > 0 && lines.size >= lines.maxBytes {
+		return lines.rotate()
+	}
+	return nil
+}
+
+// rotate 現在の内容を1世代前のファイルへ移して空のファイルに書き込み直す。呼び出し側でロックしておくこと
+func (lines *jsonLinesFile) rotate() error {
+	if err := lines.file.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(lines.path, lines.rotatedPath())
+
+	// 移せなかった場合も書き込みを続けられるよう開き直す
+	f, err := os.OpenFile(lines.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("%v を開けません: %v", lines.path, err)
+	}
+	lines.file = f
+	if renameErr != nil {
+		return renameErr
+	}
+	lines.size = 0
+	return nil
+}
+
+// scan 古いものから1行ずつ読み込む。書き込み途中の最後の行は読み飛ばす
+func (lines *jsonLinesFile) scan(fn func(line []byte)) error {
+	if lines.maxBytes > 0 {
+		err := scanFile(lines.rotatedPath(), fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return scanFile(lines.path, fn)
+}
+
+func scanFile(path string, fn func(line []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(line)
+	}
+}
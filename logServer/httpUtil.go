@@ -0,0 +1,24 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON 値をJSONとしてレスポンスに書き込む
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONWithStatus(w, http.StatusOK, v)
+}
+
+// writeJSONWithStatus ステータスコードを指定して値をJSONとしてレスポンスに書き込む
+func writeJSONWithStatus(w http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(append(b, '\n'))
+}
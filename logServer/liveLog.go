@@ -0,0 +1,441 @@
+package logServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxLiveLogBytes 1つのライブログに書き込める最大サイズ
+	maxLiveLogBytes = 256 * 1024 * 1024
+	// liveLogFinishedTTL 終了したライブログを残しておく期間。以降はアーカイブから参照する
+	liveLogFinishedTTL = 24 * time.Hour
+	// liveLogAbandonedTTL 終了しないまま更新がなくなったライブログを残しておく期間
+	liveLogAbandonedTTL = 7 * 24 * time.Hour
+	// liveLogReadSize 配信時に1回で読み込むサイズ
+	liveLogReadSize = 64 * 1024
+)
+
+// liveLogIDPattern ライブログのIDとして使用できるタスクID
+var liveLogIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// LiveLogStatus 実行中のタスクから受信しているログの状態
+type LiveLogStatus struct {
+	TaskID    string    `json:"taskID"`
+	User      string    `json:"user"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Size 受信済みのバイト数。次に送信するデータの開始位置となる
+	Size     int64 `json:"size"`
+	Finished bool  `json:"finished"`
+	// ContentID タスク終了後にアップロードされたアーカイブのコンテンツID
+	ContentID string `json:"contentID,omitempty"`
+}
+
+// liveLogFinishRequest /live/{taskID}/finish の指定
+type liveLogFinishRequest struct {
+	ContentID string `json:"contentID"`
+}
+
+// liveLogs 実行中のタスクから送られるログの管理
+// 受信したログは内部管理用ディレクトリに追記し、閲覧者はそこから続きを読み込む
+type liveLogs struct {
+	dir string
+
+	lock sync.Mutex
+	// changed ライブログごとの更新通知。追記や終了のたびにcloseして作り直す
+	changed map[string]chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newLiveLogs(dir string) (*liveLogs, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("ライブログ用ディレクトリの作成に失敗しました %v", err)
+	}
+	return &liveLogs{dir: dir, changed: map[string]chan struct{}{}, stop: make(chan struct{})}, nil
+}
+
+// close 配信中の閲覧者との接続を終了させる
+func (logs *liveLogs) close() {
+	logs.stopOnce.Do(func() { close(logs.stop) })
+}
+
+// closed close後にcloseされるチャンネル
+func (logs *liveLogs) closed() <-chan struct{} {
+	return logs.stop
+}
+
+func (logs *liveLogs) statusPath(id string) string {
+	return path.Join(logs.dir, id+".json")
+}
+
+func (logs *liveLogs) dataPath(id string) string {
+	return path.Join(logs.dir, id+".log")
+}
+
+// status 呼び出し側でロックしておくこと
+func (logs *liveLogs) status(id string) (LiveLogStatus, error) {
+	var status LiveLogStatus
+	if !liveLogIDPattern.MatchString(id) {
+		return status, fmt.Errorf("ライブログ %v は存在しません", id)
+	}
+	b, err := ioutil.ReadFile(logs.statusPath(id))
+	if err != nil {
+		return status, fmt.Errorf("ライブログ %v は存在しません", id)
+	}
+	if err := json.Unmarshal(b, &status); err != nil {
+		return status, err
+	}
+	stat, err := os.Stat(logs.dataPath(id))
+	if err != nil {
+		return status, err
+	}
+	status.Size = stat.Size()
+	return status, nil
+}
+
+// saveStatus 呼び出し側でロックしておくこと
+func (logs *liveLogs) saveStatus(status LiveLogStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(logs.statusPath(status.TaskID), b)
+}
+
+// notify 更新を待っている閲覧者に知らせる。呼び出し側でロックしておくこと
+func (logs *liveLogs) notify(id string) {
+	if ch, ok := logs.changed[id]; ok {
+		close(ch)
+		delete(logs.changed, id)
+	}
+}
+
+// watch 現在の状態と、次に更新されたときにcloseされるチャンネルを返す
+func (logs *liveLogs) watch(id string) (LiveLogStatus, <-chan struct{}, error) {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+
+	status, err := logs.status(id)
+	if err != nil {
+		return status, nil, err
+	}
+	ch, ok := logs.changed[id]
+	if !ok {
+		ch = make(chan struct{})
+		logs.changed[id] = ch
+	}
+	return status, ch, nil
+}
+
+// append offsetの位置からログを追記する。存在しない場合は作成する
+// 受信済みの範囲と重なる部分は再送とみなして読み飛ばすため、同じ内容を繰り返し送信できる
+func (logs *liveLogs) append(id string, user string, offset int64, src io.Reader) (LiveLogStatus, error) {
+	if !liveLogIDPattern.MatchString(id) {
+		return LiveLogStatus{}, fmt.Errorf("タスクIDにはASCIIの英数字と._-のみ使用できます: %v", id)
+	}
+
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+
+	status, err := logs.status(id)
+	if err != nil {
+		now := time.Now()
+		status = LiveLogStatus{TaskID: id, User: user, StartedAt: now, UpdatedAt: now}
+		if err := logs.saveStatus(status); err != nil {
+			return status, err
+		}
+	}
+	if status.Finished {
+		return status, fmt.Errorf("ライブログ %v は終了しています", id)
+	}
+	if offset > status.Size {
+		return status, fmt.Errorf("受信済みのサイズ %v より後ろの位置 %v が指定されました", status.Size, offset)
+	}
+	if _, err := io.CopyN(ioutil.Discard, src, status.Size-offset); err != nil && err != io.EOF {
+		return status, err
+	}
+
+	f, err := os.OpenFile(logs.dataPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return status, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(src, maxLiveLogBytes-status.Size+1))
+	status.Size += n
+	if status.Size > maxLiveLogBytes {
+		f.Truncate(maxLiveLogBytes)
+		status.Size = maxLiveLogBytes
+		err = fmt.Errorf("ライブログの最大サイズ %v バイトを超えました", maxLiveLogBytes)
+	}
+	if n > 0 {
+		status.UpdatedAt = time.Now()
+		logs.saveStatus(status)
+		logs.notify(id)
+	}
+	return status, err
+}
+
+// finish ライブログを終了し、アップロードされたアーカイブと関連付ける
+func (logs *liveLogs) finish(id string, contentID string) (LiveLogStatus, error) {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+
+	status, err := logs.status(id)
+	if err != nil {
+		return status, err
+	}
+	status.Finished = true
+	status.ContentID = contentID
+	status.UpdatedAt = time.Now()
+	if err := logs.saveStatus(status); err != nil {
+		return status, err
+	}
+	logs.notify(id)
+	return status, nil
+}
+
+// list ライブログを開始日時の新しい順に取得する
+func (logs *liveLogs) list() ([]LiveLogStatus, error) {
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+
+	entries, err := ioutil.ReadDir(logs.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []LiveLogStatus{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		status, err := logs.status(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list, nil
+}
+
+// purgeExpired 終了後一定期間が過ぎたライブログと、更新がなくなったライブログを削除する
+func (logs *liveLogs) purgeExpired(now time.Time) {
+	list, err := logs.list()
+	if err != nil {
+		log.Print("ライブログ一覧の取得に失敗しました:", err)
+		return
+	}
+
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	for _, status := range list {
+		ttl := liveLogAbandonedTTL
+		if status.Finished {
+			ttl = liveLogFinishedTTL
+		}
+		if now.Sub(status.UpdatedAt) < ttl {
+			continue
+		}
+		log.Printf("期限切れのライブログを削除します %v", status.TaskID)
+		os.Remove(logs.statusPath(status.TaskID))
+		os.Remove(logs.dataPath(status.TaskID))
+		logs.notify(status.TaskID)
+	}
+}
+
+// liveLogAppendHandler 実行中のタスクのログを追記する。offsetには送信するデータの開始位置を指定する
+func (server *LogServer) liveLogAppendHandler(w http.ResponseWriter, r *http.Request) {
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("offsetの指定が不正です: %v", v), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	defer r.Body.Close()
+
+	status, err := server.live.append(mux.Vars(r)["taskID"], requestUser(r), offset, r.Body)
+	switch {
+	case err != nil && status.TaskID == "":
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil && (status.Finished || offset > status.Size):
+		writeJSONWithStatus(w, http.StatusConflict, status)
+	case err != nil && status.Size >= maxLiveLogBytes:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, status)
+	}
+}
+
+// liveLogFinishHandler ライブログを終了し、アップロードしたアーカイブのコンテンツIDを関連付ける
+func (server *LogServer) liveLogFinishHandler(w http.ResponseWriter, r *http.Request) {
+	var req liveLogFinishRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("終了の指定をJSONとして読み込めません: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	status, err := server.live.finish(mux.Vars(r)["taskID"], req.ContentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func (server *LogServer) liveLogListHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := server.live.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// liveLogArchiveLinks 終了したライブログに関連付けたアーカイブのURL
+func liveLogArchiveLinks(status LiveLogStatus) map[string]string {
+	links := map[string]string{"contentID": status.ContentID}
+	if status.ContentID != "" {
+		escaped := (&url.URL{Path: status.ContentID}).EscapedPath()
+		links["download"] = "/files/" + escaped
+		links["view"] = "/view/" + escaped
+	}
+	return links
+}
+
+// liveLogTailHandler 実行中のタスクのログを追記されるたびに配信する
+// Acceptにtext/event-streamを指定した場合はServer-Sent Events、それ以外はchunkedのテキストで返す
+// offsetを指定した場合はその位置から配信し、ライブログが終了すると接続を閉じる
+func (server *LogServer) liveLogTailHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "ストリーミングに対応していません", http.StatusInternalServerError)
+		return
+	}
+
+	id := mux.Vars(r)["taskID"]
+	status, changed, err := server.live.watch(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var offset int64
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		v = r.Header.Get("Last-Event-ID")
+	}
+	if v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > status.Size {
+			http.Error(w, fmt.Sprintf("offsetの指定が不正です: %v", v), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	f, err := os.Open(server.live.dataPath(id))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	buf := make([]byte, liveLogReadSize)
+	for {
+		// 前回の通知以降に追記された分を送る
+		for offset < status.Size {
+			n, err := f.ReadAt(buf[:minInt64(int64(len(buf)), status.Size-offset)], offset)
+			if n == 0 && err != nil {
+				return
+			}
+			offset += int64(n)
+			if sse {
+				// 改行はdataの区切りとして送り、閲覧者側で連結すると元の内容に戻るようにする
+				// SSEでは\rも行の区切りとなるため取り除く
+				fmt.Fprintf(w, "id: %d\nevent: log\n", offset)
+				for _, line := range strings.Split(string(buf[:n]), "\n") {
+					fmt.Fprintf(w, "data: %s\n", strings.TrimSuffix(line, "\r"))
+				}
+				_, err = fmt.Fprint(w, "\n")
+			} else {
+				_, err = w.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+		if status.Finished {
+			if sse {
+				b, _ := json.Marshal(liveLogArchiveLinks(status))
+				fmt.Fprintf(w, "id: %d\nevent: finished\ndata: %s\n\n", offset, b)
+			}
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+			status, changed, err = server.live.watch(id)
+			if err != nil {
+				// 削除された
+				return
+			}
+		case <-keepAlive.C:
+			if sse {
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-server.live.closed():
+			return
+		}
+	}
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
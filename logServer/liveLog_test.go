@@ -0,0 +1,142 @@
+package logServer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveLog(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ts := httptest.NewServer(server.NewHTTPHandler())
+	defer ts.Close()
+
+	do := func(method string, target string, body string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(body))
+		req.SetBasicAuth("root", "")
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	appendLog := func(offset string, body string, expectedStatus int) LiveLogStatus {
+		resp := do(http.MethodPost, "/live/task-1?offset="+offset, body, nil)
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			b, _ := ioutil.ReadAll(resp.Body)
+			t.Fatal(resp.Status, string(b))
+		}
+		var status LiveLogStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status
+	}
+
+	if resp := do(http.MethodGet, "/live/task-1", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+	if resp := do(http.MethodPost, "/live/task%201", "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(resp.Status)
+	}
+
+	status := appendLog("0", "line1\r\n", http.StatusOK)
+	if status.Size != 7 || status.User != "root" {
+		t.Fatal(status)
+	}
+	// 再送された部分は読み飛ばし、受信済みより後ろの位置は拒否する
+	if status := appendLog("0", "line1\r\nline2\r\n", http.StatusOK); status.Size != 14 {
+		t.Fatal(status)
+	}
+	if status := appendLog("20", "line3\r\n", http.StatusConflict); status.Size != 14 {
+		t.Fatal(status)
+	}
+
+	// 閲覧を開始した後の追記も配信される
+	plain := do(http.MethodGet, "/live/task-1", "", nil)
+	defer plain.Body.Close()
+	sse := do(http.MethodGet, "/live/task-1?offset=7", "", map[string]string{"Accept": "text/event-stream"})
+	defer sse.Body.Close()
+	if sse.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal(sse.Header)
+	}
+	appendLog("14", "line3\r\n", http.StatusOK)
+
+	list := []LiveLogStatus{}
+	json.NewDecoder(do(http.MethodGet, "/api/live", "", nil).Body).Decode(&list)
+	if len(list) != 1 || list[0].Finished || list[0].Size != 21 {
+		t.Fatal(list)
+	}
+
+	resp := do(http.MethodPost, "/live/task-1/finish", `{"contentID":"task-1.zip"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	appendLog("21", "line4\r\n", http.StatusConflict)
+
+	// 終了すると接続が閉じられる
+	b, err := ioutil.ReadAll(plain.Body)
+	if err != nil || string(b) != "line1\r\nline2\r\nline3\r\n" {
+		t.Fatal(string(b), err)
+	}
+
+	var data []string
+	var finished string
+	event := ""
+	reader := bufio.NewReader(sse.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "log":
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		case strings.HasPrefix(line, "data: ") && event == "finished":
+			finished = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if strings.Join(data, "\n") != "line2\n\nline3\n" {
+		t.Fatal(data)
+	}
+	links := map[string]string{}
+	json.Unmarshal([]byte(finished), &links)
+	if links["contentID"] != "task-1.zip" || links["view"] != "/view/task-1.zip" {
+		t.Fatal(finished)
+	}
+
+	// 閲覧は監査ログにダウンロードとして記録される
+	audit, err := server.audit.query(auditQuery{action: AuditDownload, from: time.Now().Add(-time.Minute), limit: maxListLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tailed := false
+	for _, entry := range audit.Entries {
+		if entry.ContentID == "live/task-1" && entry.Result == AuditSuccess && entry.Bytes == 21 {
+			tailed = true
+		}
+	}
+	if !tailed {
+		t.Fatal("ライブログの閲覧が監査ログに記録されていません:", audit)
+	}
+
+	// 終了後一定期間が過ぎたものは削除される
+	server.live.purgeExpired(time.Now().Add(liveLogFinishedTTL + time.Minute))
+	if resp := do(http.MethodGet, "/live/task-1", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatal(resp.Status)
+	}
+}
@@ -0,0 +1,228 @@
+package logServer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStorage ローカルのディレクトリを保存先とするStorage
+// キーの/区切りはサブディレクトリとして扱う
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage 指定したディレクトリを保存先とするStorageを作成する
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	fileStat, err := os.Stat(dir)
+	if err != nil || !fileStat.IsDir() {
+		return nil, fmt.Errorf("保存先ディレクトリが存在しません %v", dir)
+	}
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (storage *LocalStorage) makePath(key string) (string, error) {
+	if err := validateStorageKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(storage.dir, filepath.FromSlash(key)), nil
+}
+
+// Put 一時ファイルに書き込んでから移動し、書き込み途中の内容が見えないようにする
+func (storage *LocalStorage) Put(key string, src io.Reader) error {
+	filePath, err := storage.makePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filePath), ".put-*")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+
+	_, err = io.Copy(f, src)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// PutFile ローカルのファイルを移動して保存する
+func (storage *LocalStorage) PutFile(key string, path string) error {
+	filePath, err := storage.makePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		return err
+	}
+
+	// 別のドライブなどで移動できない場合はコピーする
+	if err := os.Rename(path, filePath); err == nil {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return storage.Put(key, f)
+}
+
+// Move ファイルを移動する
+func (storage *LocalStorage) Move(src string, dst string) error {
+	srcPath, err := storage.makePath(src)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.Stat(src); err != nil {
+		return err
+	}
+	return storage.PutFile(dst, srcPath)
+}
+
+func (storage *LocalStorage) openFile(key string) (*os.File, os.FileInfo, error) {
+	filePath, err := storage.makePath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, nil, notExistError(key)
+	}
+	return f, stat, nil
+}
+
+func (storage *LocalStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	f, _, err := storage.openFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// OpenReaderAt ファイルをそのままio.ReaderAtとして開く
+func (storage *LocalStorage) OpenReaderAt(key string) (readerAtCloser, int64, error) {
+	f, stat, err := storage.openFile(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+func (storage *LocalStorage) Stat(key string) (StorageObject, error) {
+	filePath, err := storage.makePath(key)
+	if err != nil {
+		return StorageObject{}, err
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if stat.IsDir() {
+		return StorageObject{}, notExistError(key)
+	}
+	return StorageObject{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// List prefixに含まれないドットで始まるディレクトリと書き込み途中の一時ファイルは対象外とする
+func (storage *LocalStorage) List(prefix string) ([]StorageObject, error) {
+	// prefixの最後の/までをディレクトリとして探索する
+	base := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		base = prefix[:i]
+	}
+	root := storage.dir
+	if base != "" {
+		if err := validateStorageKey(base); err != nil {
+			return nil, err
+		}
+		root = filepath.Join(storage.dir, filepath.FromSlash(base))
+	}
+
+	objects := []StorageObject{}
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(storage.dir, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if info.IsDir() {
+			if filePath != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".put-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		objects = append(objects, StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (storage *LocalStorage) Delete(key string) error {
+	filePath, err := storage.makePath(key)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.Stat(key); err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
@@ -1,36 +1,175 @@
 package logServer
 
 import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // LogServer UEのログを保存するログファイルサーバー
 type LogServer struct {
-	fileCtrl fileControl
-	dirName  string
+	fileCtrl *fileControl
+	uploads  *uploadSessions
+	index    *searchIndex
+	auth     Authenticator
+	tokens   *tokenStore
+	audit    *auditLog
+	webhooks *webhookDispatcher
+	events   *eventBroker
+	live     *liveLogs
+	metrics  *serverMetrics
+
+	signingKey []byte
+
+	signingLock          sync.Mutex
+	maxSignedURLLifetime time.Duration
+
+	retentionLock   sync.Mutex
+	retention       RetentionPolicy
+	trashPurgeDelay time.Duration
 }
 
 // NewLogServer 指定したディレクトリを保存先として使用するログファイルサーバーの作成
 func NewLogServer(dir string) (*LogServer, error) {
-	server := &LogServer{dirName: dir}
+	fileCtrl, err := newFileControl(dir)
+	if err != nil {
+		return nil, err
+	}
+	return newLogServer(fileCtrl)
+}
+
+// NewLogServerWithStorage 指定したStorageを保存先として使用するログファイルサーバーの作成
+// workDirには受信途中のファイルや検索用の索引など、サーバーのローカルで管理する内容を保存する
+func NewLogServerWithStorage(storage Storage, workDir string) (*LogServer, error) {
+	fileCtrl, err := newFileControlWithStorage(storage, workDir)
+	if err != nil {
+		return nil, err
+	}
+	return newLogServer(fileCtrl)
+}
+
+func newLogServer(fileCtrl *fileControl) (*LogServer, error) {
+	server := &LogServer{fileCtrl: fileCtrl, events: newEventBroker(), maxSignedURLLifetime: defaultMaxSignedURLLifetime, trashPurgeDelay: defaultTrashPurgeDelay}
 
 	var err error
-	server.fileCtrl, err = newFileControl(dir)
+	server.uploads, err = newUploadSessions(server.fileCtrl.reservedPath("uploads"))
+	if err != nil {
+		return nil, err
+	}
+
+	server.metrics = newServerMetrics(server)
+
+	server.live, err = newLiveLogs(server.fileCtrl.reservedPath("live"))
+	if err != nil {
+		return nil, err
+	}
+
+	server.tokens, err = newTokenStore(server.fileCtrl.reservedPath("tokens.json"))
 	if err != nil {
 		return nil, err
 	}
 
+	server.audit, err = newAuditLog(server.fileCtrl.reservedPath("audit.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	server.webhooks, err = newWebhookDispatcher(server.fileCtrl.reservedPath("webhooks.json"), server.fileCtrl.reservedPath("webhook-deliveries.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	server.signingKey, err = loadSigningKey(server.fileCtrl.reservedPath("signing.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	server.index, err = newSearchIndex(server.fileCtrl.reservedPath("index"))
+	if err != nil {
+		return nil, err
+	}
+	server.index.start(server.fileCtrl)
+	go server.indexMissing()
+
 	return server, nil
 }
 
+// Close バックグラウンドで行っている処理を停止する
+func (server *LogServer) Close() {
+	server.index.close()
+	server.events.close()
+	server.live.close()
+	server.webhooks.close()
+	server.audit.close()
+}
+
+// CloseStreams イベントとライブログの配信中の接続を終了させる
+// 配信中の接続はクライアントが切断するまで続くため、http.ServerのShutdownの開始時に呼び出すこと
+func (server *LogServer) CloseStreams() {
+	server.events.close()
+	server.live.close()
+}
+
 // NewHTTPHandler ログファイルサーバーのHTTPHandlerを作成する
 func (server *LogServer) NewHTTPHandler() http.Handler {
 	r := mux.NewRouter()
-	r.PathPrefix("/files/").Handler(http.StripPrefix("/files/", http.FileServer(http.Dir(server.dirName))))
-	r.HandleFunc("/upload/{contentID}", server.uploaderHandler).Methods("POST")
-	r.HandleFunc("/delete/{contentID}", server.deleteHandler).Methods("POST")
+	reader := func(h http.HandlerFunc) http.Handler { return server.authorize(RoleReader, h) }
+	uploader := func(h http.HandlerFunc) http.Handler { return server.authorize(RoleUploader, h) }
+	admin := func(h http.HandlerFunc) http.Handler { return server.authorize(RoleAdmin, h) }
+	// APIトークンのようなアップロード専用のユーザーも使用できる操作
+	upload := func(h http.HandlerFunc) http.Handler { return server.authorizeUpload(h) }
+	audited := server.audited
+	r.Use(server.metrics.middleware)
+
+	r.PathPrefix("/files/").Handler(audited(AuditDownload, server.authorize(RoleReader, http.StripPrefix("/files/", server.fileServerHandler()))))
+	r.Handle("/signed/{contentID}", audited(AuditDownload, http.HandlerFunc(server.signedFileHandler))).Methods("GET", "HEAD")
+	r.Handle("/upload/{contentID}", audited(AuditUpload, upload(server.uploaderHandler))).Methods("POST")
+	r.Handle("/upload/{contentID}", audited(AuditUpload, uploader(server.uploaderHandler))).Methods("PUT")
+	r.Handle("/delete/{contentID}", audited(AuditDelete, admin(server.deleteHandler))).Methods("POST")
+	r.Handle("/uploads/{contentID}", upload(server.uploadSessionCreateHandler)).Methods("POST")
+	r.Handle("/uploads/{contentID}/{sessionID}", upload(server.uploadSessionStatusHandler)).Methods("GET")
+	r.Handle("/uploads/{contentID}/{sessionID}", upload(server.uploadSessionWriteHandler)).Methods("PUT")
+	r.Handle("/uploads/{contentID}/{sessionID}", upload(server.uploadSessionAbortHandler)).Methods("DELETE")
+	r.Handle("/uploads/{contentID}/{sessionID}/finalize", audited(AuditUpload, upload(server.uploadSessionFinalizeHandler))).Methods("POST")
+	r.Handle("/archives/{contentID}/entries", reader(server.archiveEntriesHandler)).Methods("GET")
+	r.Handle("/archives/{contentID}/raw/{entryPath:.+}", audited(AuditDownload, reader(server.archiveRawHandler))).Methods("GET")
+	r.Handle("/view/{contentID}", audited(AuditDownload, reader(server.viewerHandler))).Methods("GET")
+	r.Handle("/view/{contentID}/{entryPath:.+}", audited(AuditDownload, reader(server.viewerHandler))).Methods("GET")
+	r.Handle("/api/artifacts", reader(server.artifactListHandler)).Methods("GET")
+	r.Handle("/api/artifacts/{contentID}", reader(server.artifactInfoHandler)).Methods("GET")
+	r.Handle("/api/artifacts/{contentID}/tags", uploader(server.artifactTagsHandler)).Methods("PUT")
+	r.Handle("/api/artifacts/{contentID}/versions", reader(server.artifactVersionsHandler)).Methods("GET")
+	r.Handle("/api/artifacts/{contentID}/versions/{version}", audited(AuditPurgeVersion, admin(server.artifactPurgeVersionHandler))).Methods("DELETE")
+	r.Handle("/api/artifacts/{contentID}/versions/{version}/pin", uploader(server.artifactPinHandler)).Methods("PUT", "DELETE")
+	r.Handle("/api/sign/{contentID}", uploader(server.signHandler)).Methods("POST")
+	r.Handle("/api/search", reader(server.searchHandler)).Methods("GET")
+	r.Handle("/api/retention/report", reader(server.retentionReportHandler)).Methods("GET")
+	r.Handle("/api/tokens", admin(server.tokenCreateHandler)).Methods("POST")
+	r.Handle("/api/tokens", admin(server.tokenListHandler)).Methods("GET")
+	r.Handle("/api/tokens/{tokenID}", admin(server.tokenRevokeHandler)).Methods("DELETE")
+	r.Handle("/api/audit", admin(server.auditHandler)).Methods("GET")
+	r.Handle("/api/bulk/delete", admin(server.bulkDeleteHandler)).Methods("POST")
+	r.Handle("/api/trash", reader(server.trashListHandler)).Methods("GET")
+	r.Handle("/api/trash/{trashID}/restore", audited(AuditRestore, uploader(server.trashRestoreHandler))).Methods("POST")
+	r.Handle("/api/trash/{trashID}", audited(AuditPurgeTrash, admin(server.trashPurgeHandler))).Methods("DELETE")
+	r.Handle("/api/events", reader(server.eventStreamHandler)).Methods("GET")
+	r.Handle("/metrics", server.authorize(RoleReader, server.metrics.handler())).Methods("GET")
+	r.Handle("/api/live", reader(server.liveLogListHandler)).Methods("GET")
+	r.Handle("/live/{taskID}", audited(AuditDownload, reader(server.liveLogTailHandler))).Methods("GET")
+	r.Handle("/live/{taskID}", upload(server.liveLogAppendHandler)).Methods("POST")
+	r.Handle("/live/{taskID}/finish", upload(server.liveLogFinishHandler)).Methods("POST")
+	r.Handle("/api/webhooks", admin(server.webhookCreateHandler)).Methods("POST")
+	r.Handle("/api/webhooks", admin(server.webhookListHandler)).Methods("GET")
+	r.Handle("/api/webhooks/{webhookID}", admin(server.webhookDeleteHandler)).Methods("DELETE")
+	r.Handle("/api/webhooks/{webhookID}/deliveries", admin(server.webhookDeliveriesHandler)).Methods("GET")
+	r.Handle("/api/webhooks/{webhookID}/test", admin(server.webhookPingHandler)).Methods("POST")
 	return r
 }
 
@@ -44,18 +183,160 @@ func (server *LogServer) uploaderHandler(w http.ResponseWriter, r *http.Request)
 	defer r.Body.Close()
 
 	vars := mux.Vars(r)
-	err := server.fileCtrl.save(vars["contentID"], r.Body)
+	user := requestUser(r)
+	tags, err := parseUploadTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := uploadInfo{user: user, contentType: r.Header.Get("Content-Type"), tags: tags}
+
+	// SHA-256が指定されていれば受信内容を検証する
+	if v := r.Header.Get(ContentSHA256Header); v != "" {
+		sum, err := parseSHA256(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upload.sha256 = sum
+	}
+
+	// PUTの場合はすでに存在するファイルを過去の版として残して置き換える
+	var info ArtifactInfo
+	if r.Method == http.MethodPut {
+		info, err = server.fileCtrl.saveVersion(vars["contentID"], r.Body, upload)
+	} else {
+		info, err = server.fileCtrl.saveWithInfo(vars["contentID"], r.Body, upload)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), saveErrorStatus(err))
+		return
+	}
+	server.artifactSaved(info)
+	setAuditArtifact(r, info)
+	server.publish(Event{Type: EventArtifactUploaded, User: user, Artifact: info})
+
+	w.Header().Set(ContentSHA256Header, info.SHA256)
+	writeJSON(w, info)
+}
+
+// fileServerHandler 保存ファイルを配信するハンドラー
+// 範囲指定のダウンロードに対応し、ファイルのSHA-256をヘッダーに付与してダウンロードした側で検証できるようにする
+// コンテンツIDに版番号を付けた場合(run.zip@v2)は指定した版を配信する
+func (server *LogServer) fileServerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if name == "" {
+			server.fileListHandler(w, r)
+			return
+		}
+
+		server.serveArtifact(w, r, name)
+	})
+}
+
+// serveArtifact 保存ファイルを配信する
+func (server *LogServer) serveArtifact(w http.ResponseWriter, r *http.Request, name string) {
+	key := name
+	info, err := server.fileCtrl.info(name)
+	if err != nil {
+		contentID, version, ok := parseVersionedID(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		info, key, err = server.fileCtrl.findVersion(contentID, version)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	stat, err := server.fileCtrl.storage.Stat(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set(ContentSHA256Header, info.SHA256)
+	w.Header().Set("Content-Type", contentTypeByName(info.ContentID))
+
+	content := &storageReadSeeker{storage: server.fileCtrl.storage, key: key, size: stat.Size}
+	defer content.Close()
+	http.ServeContent(w, r, info.ContentID, stat.ModTime, content)
+}
+
+// fileListHandler 保存ファイルの一覧をリンクとして表示する
+func (server *LogServer) fileListHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := server.fileCtrl.names()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, name := range names {
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", url.PathEscape(name), html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre>")
 }
 
+// saveErrorStatus ファイル保存時のエラーに対応するステータスコード
+func saveErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errArtifactExists):
+		return http.StatusConflict
+	case errors.Is(err, errDigestMismatch):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// deleteHandler ファイルをゴミ箱に移す。ゴミ箱から戻すためのIDを含む情報を返す
 func (server *LogServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	err := server.fileCtrl.delete(vars["contentID"])
+	item, err := server.deleteArtifact(vars["contentID"], requestUser(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	setAuditArtifact(r, item.ArtifactInfo)
+	server.publish(Event{Type: EventArtifactDeleted, User: requestUser(r), Artifact: item.ArtifactInfo, TrashID: item.TrashID})
+	log.Printf("%v が %v をゴミ箱に移しました ID:%v", requestUser(r), vars["contentID"], item.TrashID)
+	writeJSON(w, item)
+}
+
+// artifactSaved ファイルが保存された際の後処理
+func (server *LogServer) artifactSaved(info ArtifactInfo) {
+	server.index.enqueue(info.ContentID)
+}
+
+// deleteArtifact ファイルをゴミ箱に移し、関連する情報も取り除く
+func (server *LogServer) deleteArtifact(name string, user string) (TrashedArtifact, error) {
+	item, err := server.fileCtrl.trash(name, user)
+	if err != nil {
+		return item, err
+	}
+	server.index.remove(name)
+	return item, nil
+}
+
+// indexMissing 索引が作成されていないファイルの索引作成を予約する
+func (server *LogServer) indexMissing() {
+	names, err := server.fileCtrl.names()
+	if err != nil {
+		log.Print("索引作成対象の取得に失敗しました:", err)
+		return
+	}
+
+	// 件数が多くてもアップロード時の索引作成の予約を待たせないよう、backlogに予約する
+	var missing []string
+	for _, name := range names {
+		if !server.index.indexed(name) {
+			missing = append(missing, name)
+		}
+	}
+	server.index.enqueueBacklog(missing...)
 }
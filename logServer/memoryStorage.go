@@ -0,0 +1,118 @@
+package logServer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage メモリ上に保存するStorage
+// テストや一時的な動作確認に使用する。サーバーを終了すると内容は失われる
+type MemoryStorage struct {
+	lock    sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage メモリ上に保存するStorageを作成する
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: map[string]memoryObject{}}
+}
+
+func (storage *MemoryStorage) Put(key string, src io.Reader) error {
+	if err := validateStorageKey(key); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (storage *MemoryStorage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	storage.lock.RLock()
+	obj, ok := storage.objects[key]
+	storage.lock.RUnlock()
+	if !ok {
+		return nil, notExistError(key)
+	}
+
+	// 保存済みの内容は書き換えないのでコピーせずに返す
+	data := obj.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (storage *MemoryStorage) Stat(key string) (StorageObject, error) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	obj, ok := storage.objects[key]
+	if !ok {
+		return StorageObject{}, notExistError(key)
+	}
+	return StorageObject{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (storage *MemoryStorage) List(prefix string) ([]StorageObject, error) {
+	storage.lock.RLock()
+	defer storage.lock.RUnlock()
+
+	objects := []StorageObject{}
+	for key, obj := range storage.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StorageObject{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (storage *MemoryStorage) Delete(key string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if _, ok := storage.objects[key]; !ok {
+		return notExistError(key)
+	}
+	delete(storage.objects, key)
+	return nil
+}
+
+// Move 内容を複製せずにキーを変更する
+func (storage *MemoryStorage) Move(src string, dst string) error {
+	if err := validateStorageKey(dst); err != nil {
+		return err
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	obj, ok := storage.objects[src]
+	if !ok {
+		return notExistError(src)
+	}
+	storage.objects[dst] = obj
+	delete(storage.objects, src)
+	return nil
+}
@@ -0,0 +1,244 @@
+package logServer
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// メトリクスで集計する操作の種類
+const (
+	MetricUpload   = "upload"
+	MetricDownload = "download"
+	MetricDelete   = "delete"
+	MetricOther    = "other"
+)
+
+// 認証に失敗した理由
+const (
+	authFailureUnauthorized     = "unauthorized"
+	authFailureForbidden        = "forbidden"
+	authFailureInvalidSignature = "invalid_signature"
+)
+
+// storageStatsTTL 保存ファイルの集計結果を使い回す期間
+// 保存先がS3互換ストレージの場合に取得のたびに一覧を取得しないようにする
+const storageStatsTTL = 30 * time.Second
+
+// metricOperations ルートごとの操作の種類。ここにないルートはMetricOtherとして集計する
+var metricOperations = map[string]string{
+	"/files/":             MetricDownload,
+	"/signed/{contentID}": MetricDownload,
+	"/archives/{contentID}/raw/{entryPath:.+}":  MetricDownload,
+	"/upload/{contentID}":                       MetricUpload,
+	"/uploads/{contentID}/{sessionID}/finalize": MetricUpload,
+	"/delete/{contentID}":                       MetricDelete,
+	"/api/bulk/delete":                          MetricDelete,
+}
+
+// serverMetrics /metrics で公開するメトリクス
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	transferred   *prometheus.CounterVec
+	inFlight      prometheus.Gauge
+	authFailures  *prometheus.CounterVec
+	storageErrors prometheus.Counter
+}
+
+func newServerMetrics(server *LogServer) *serverMetrics {
+	metrics := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logserver_requests_total",
+			Help: "操作の種類とステータスコードごとのリクエスト数",
+		}, []string{"operation", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "logserver_request_duration_seconds",
+			Help:    "操作の種類とステータスコードごとのリクエストの処理時間",
+			Buckets: []float64{0.005, 0.025, 0.1, 0.5, 1, 5, 30, 120, 600},
+		}, []string{"operation", "code"}),
+		transferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logserver_transferred_bytes_total",
+			Help: "操作の種類ごとの受信または送信したバイト数",
+		}, []string{"operation"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "logserver_requests_in_flight",
+			Help: "処理中のリクエスト数",
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "logserver_auth_failures_total",
+			Help: "理由ごとの認証または認可に失敗したリクエスト数",
+		}, []string{"reason"}),
+		storageErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "logserver_storage_stats_errors_total",
+			Help: "保存ファイルの集計に失敗した回数",
+		}),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.duration,
+		metrics.transferred,
+		metrics.inFlight,
+		metrics.authFailures,
+		metrics.storageErrors,
+		&storageCollector{server: server, errors: metrics.storageErrors},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return metrics
+}
+
+// authFailed 認証または認可に失敗したリクエストを記録する
+func (metrics *serverMetrics) authFailed(reason string) {
+	metrics.authFailures.WithLabelValues(reason).Inc()
+}
+
+// metricOperation リクエストのルートに対応する操作の種類
+func metricOperation(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return MetricOther
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return MetricOther
+	}
+	if operation, ok := metricOperations[template]; ok {
+		return operation
+	}
+	return MetricOther
+}
+
+// middleware リクエストごとの処理時間と転送量を記録する
+func (metrics *serverMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.inFlight.Inc()
+		defer metrics.inFlight.Dec()
+
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		operation := metricOperation(r)
+		code := strconv.Itoa(status)
+		metrics.requests.WithLabelValues(operation, code).Inc()
+		metrics.duration.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+
+		// エラーの応答は転送量に含めない
+		if status >= http.StatusBadRequest {
+			return
+		}
+		switch operation {
+		case MetricDownload:
+			metrics.transferred.WithLabelValues(operation).Add(float64(recorder.bytes))
+		case MetricUpload:
+			metrics.transferred.WithLabelValues(operation).Add(float64(body.bytes))
+		}
+	})
+}
+
+// handler /metrics のハンドラー
+func (metrics *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// storageStats 保存ファイルの集計結果
+type storageStats struct {
+	time  time.Time
+	count map[string]int
+	bytes map[string]int64
+}
+
+// storageCollector 保存しているファイルの数と合計サイズを取得時に集計する
+// 現在の版、過去の版、ゴミ箱のファイルを分けて集計する
+type storageCollector struct {
+	server *LogServer
+	errors prometheus.Counter
+
+	lock  sync.Mutex
+	stats storageStats
+}
+
+var (
+	storedArtifactsDesc = prometheus.NewDesc("logserver_stored_artifacts", "保存しているファイル数", []string{"kind"}, nil)
+	storedBytesDesc     = prometheus.NewDesc("logserver_stored_bytes", "保存しているファイルの合計サイズ", []string{"kind"}, nil)
+)
+
+func (collector *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storedArtifactsDesc
+	ch <- storedBytesDesc
+}
+
+func (collector *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	if time.Since(collector.stats.time) > storageStatsTTL {
+		stats, err := collector.collect()
+		if err != nil {
+			collector.errors.Inc()
+			log.Print("メトリクス用の保存ファイルの集計に失敗しました:", err)
+		} else {
+			collector.stats = stats
+		}
+	}
+	if collector.stats.time.IsZero() {
+		return
+	}
+
+	for _, kind := range []string{"current", "archived", "trash"} {
+		ch <- prometheus.MustNewConstMetric(storedArtifactsDesc, prometheus.GaugeValue, float64(collector.stats.count[kind]), kind)
+		ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(collector.stats.bytes[kind]), kind)
+	}
+}
+
+func (collector *storageCollector) collect() (storageStats, error) {
+	stats := storageStats{time: time.Now(), count: map[string]int{}, bytes: map[string]int64{}}
+	add := func(kind string, info ArtifactInfo) {
+		stats.count[kind]++
+		stats.bytes[kind] += info.Size
+	}
+
+	infos, err := collector.server.fileCtrl.list()
+	if err != nil {
+		return stats, err
+	}
+	for _, info := range infos {
+		add("current", info)
+	}
+
+	archived, err := collector.server.fileCtrl.allArchivedVersions()
+	if err != nil {
+		return stats, err
+	}
+	for _, versions := range archived {
+		for _, info := range versions {
+			add("archived", info)
+		}
+	}
+
+	trashed, err := collector.server.fileCtrl.listTrash()
+	if err != nil {
+		return stats, err
+	}
+	for _, item := range trashed {
+		add("trash", item.ArtifactInfo)
+	}
+	return stats, nil
+}
@@ -0,0 +1,66 @@
+package logServer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuthenticator(NewSingleUserAuthenticator("root", "password"))
+	handler := server.NewHTTPHandler()
+
+	do := func(method string, target string, body string, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("root", password)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do(http.MethodPost, "/upload/run1.log", "0123456789", "password")
+	do(http.MethodPost, "/upload/run2.log", "01234", "password")
+	do(http.MethodPost, "/upload/run2.log", "01234", "password")
+	do(http.MethodGet, "/files/run1.log", "", "password")
+	do(http.MethodPost, "/delete/run2.log", "", "password")
+	do(http.MethodGet, "/files/run1.log", "", "wrong")
+	do(http.MethodGet, "/signed/run1.log?expires=1&sig=00", "", "")
+
+	rec := do(http.MethodGet, "/metrics", "", "password")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`logserver_requests_total{code="200",operation="upload"} 2`,
+		`logserver_requests_total{code="409",operation="upload"} 1`,
+		`logserver_requests_total{code="200",operation="download"} 1`,
+		`logserver_requests_total{code="401",operation="download"} 1`,
+		`logserver_requests_total{code="200",operation="delete"} 1`,
+		`logserver_request_duration_seconds_count{code="200",operation="upload"} 2`,
+		`logserver_transferred_bytes_total{operation="upload"} 15`,
+		`logserver_transferred_bytes_total{operation="download"} 10`,
+		`logserver_auth_failures_total{reason="unauthorized"} 1`,
+		`logserver_auth_failures_total{reason="invalid_signature"} 1`,
+		`logserver_requests_in_flight 1`,
+		`logserver_stored_artifacts{kind="current"} 1`,
+		`logserver_stored_bytes{kind="current"} 10`,
+		`logserver_stored_artifacts{kind="trash"} 1`,
+		`logserver_stored_bytes{kind="trash"} 5`,
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Fatal(expected, "\n", body)
+		}
+	}
+
+	// メトリクスの取得にも認証が必要
+	if rec := do(http.MethodGet, "/metrics", "", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatal(rec.Code)
+	}
+}
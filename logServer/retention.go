@@ -0,0 +1,319 @@
+package logServer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy 保存ファイルの保持ポリシー
+// ゼロ値の項目は制限なしとして扱う
+type RetentionPolicy struct {
+	// MaxAge アップロードからこの時間が経過したファイルを削除する
+	MaxAge time.Duration
+	// MaxTotalBytes 合計サイズがこの値を超える場合は古いファイルから削除する
+	// 合計にはピン留めされていないファイルの最新版のみを数え、過去の版とゴミ箱のファイルは含めない
+	// 削除したファイルはゴミ箱に移るため、ゴミ箱を含めると削除しても合計が減らないためである
+	// ゴミ箱のファイルは SetTrashPurgeDelay の期間が過ぎたところで完全に削除される
+	MaxTotalBytes int64
+	// MaxCountPerPrefix コンテンツIDの前方一致ごとに保持する最大数。超えた分は古いファイルから削除する
+	MaxCountPerPrefix map[string]int
+	// MaxVersions ファイルごとに保持する過去の版の最大数。超えた分は古い版から削除する
+	MaxVersions int
+}
+
+// ParseMaxCountPerPrefix "prefix:count" 形式の指定を RetentionPolicy.MaxCountPerPrefix 用に変換する
+func ParseMaxCountPerPrefix(specs []string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("prefix:count の形式で指定してください: %v", spec)
+		}
+		count, err := strconv.Atoi(spec[i+1:])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("保持数の指定が不正です: %v", spec)
+		}
+		counts[spec[:i]] = count
+	}
+	return counts, nil
+}
+
+// RetentionCandidate 保持ポリシーにより削除されるファイル
+type RetentionCandidate struct {
+	ArtifactInfo
+	Reason string `json:"reason"`
+	// Archived 過去の版のみを削除する
+	Archived bool `json:"archived,omitempty"`
+}
+
+// RetentionReport 保持ポリシーの適用結果
+type RetentionReport struct {
+	DryRun     bool      `json:"dryRun"`
+	Time       time.Time `json:"time"`
+	TotalCount int       `json:"totalCount"`
+	TotalBytes int64     `json:"totalBytes"`
+	FreedBytes int64     `json:"freedBytes"`
+	// TrashBytes 適用前のゴミ箱のファイルの合計サイズ。MaxTotalBytesの判定には含めない
+	TrashBytes int64                `json:"trashBytes"`
+	Candidates []RetentionCandidate `json:"candidates"`
+	// PurgedTrash ゴミ箱から完全に削除したファイル
+	PurgedTrash []TrashedArtifact `json:"purgedTrash"`
+}
+
+// plan 保持ポリシーに従い削除対象のファイルを選ぶ
+// ピン留めされたファイルは判定の対象外とする
+func (policy RetentionPolicy) plan(infos []ArtifactInfo, now time.Time) []RetentionCandidate {
+	// 新しい順に並べて判定する
+	sorted := make([]ArtifactInfo, 0, len(infos))
+	for _, info := range infos {
+		if !info.Pinned {
+			sorted = append(sorted, info)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].UploadTime.After(sorted[j].UploadTime)
+	})
+
+	reasons := map[string]string{}
+
+	if policy.MaxAge > 0 {
+		for _, info := range sorted {
+			if now.Sub(info.UploadTime) > policy.MaxAge {
+				reasons[info.ContentID] = fmt.Sprintf("保持期間 %v を超過", policy.MaxAge)
+			}
+		}
+	}
+
+	for prefix, maxCount := range policy.MaxCountPerPrefix {
+		count := 0
+		for _, info := range sorted {
+			if !strings.HasPrefix(info.ContentID, prefix) {
+				continue
+			}
+			count++
+			if count > maxCount {
+				if _, ok := reasons[info.ContentID]; !ok {
+					reasons[info.ContentID] = fmt.Sprintf("%v の保持数 %v を超過", prefix, maxCount)
+				}
+			}
+		}
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		var total int64
+		for _, info := range sorted {
+			if _, ok := reasons[info.ContentID]; ok {
+				continue
+			}
+			total += info.Size
+			if total > policy.MaxTotalBytes {
+				reasons[info.ContentID] = fmt.Sprintf("合計サイズ %v バイトを超過", policy.MaxTotalBytes)
+			}
+		}
+	}
+
+	// 古い順に削除する
+	candidates := []RetentionCandidate{}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if reason, ok := reasons[sorted[i].ContentID]; ok {
+			candidates = append(candidates, RetentionCandidate{ArtifactInfo: sorted[i], Reason: reason})
+		}
+	}
+	return candidates
+}
+
+// planVersions 保持ポリシーに従い削除対象の過去の版を選ぶ。ピン留めされた版は対象外とする
+func (policy RetentionPolicy) planVersions(archived map[string][]ArtifactInfo) []RetentionCandidate {
+	candidates := []RetentionCandidate{}
+	if policy.MaxVersions <= 0 {
+		return candidates
+	}
+
+	names := make([]string, 0, len(archived))
+	for name := range archived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		versions := archived[name]
+		count := 0
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].Pinned {
+				continue
+			}
+			count++
+			if count > policy.MaxVersions {
+				reason := fmt.Sprintf("過去の版の保持数 %v を超過", policy.MaxVersions)
+				candidates = append(candidates, RetentionCandidate{ArtifactInfo: versions[i], Reason: reason, Archived: true})
+			}
+		}
+	}
+	return candidates
+}
+
+// SetRetentionPolicy 保持ポリシーを設定する
+func (server *LogServer) SetRetentionPolicy(policy RetentionPolicy) {
+	server.retentionLock.Lock()
+	defer server.retentionLock.Unlock()
+	server.retention = policy
+}
+
+func (server *LogServer) retentionPolicy() RetentionPolicy {
+	server.retentionLock.Lock()
+	defer server.retentionLock.Unlock()
+	return server.retention
+}
+
+// SweepRetention 保持ポリシーを適用する。dryRunの場合は削除せずに削除対象の一覧のみ返す
+func (server *LogServer) SweepRetention(dryRun bool) (RetentionReport, error) {
+	infos, err := server.fileCtrl.list()
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	report := RetentionReport{DryRun: dryRun, Time: time.Now(), TotalCount: len(infos)}
+	for _, info := range infos {
+		report.TotalBytes += info.Size
+	}
+	trashed, err := server.fileCtrl.listTrash()
+	if err != nil {
+		return RetentionReport{}, err
+	}
+	for _, item := range trashed {
+		report.TrashBytes += item.Size
+	}
+
+	archived, err := server.fileCtrl.allArchivedVersions()
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	// ピン留めされた版を持つファイルは削除しない
+	targets := make([]ArtifactInfo, 0, len(infos))
+	for _, info := range infos {
+		if !isPinned(info, archived[info.ContentID]) {
+			targets = append(targets, info)
+		}
+	}
+
+	policy := server.retentionPolicy()
+	candidates := policy.plan(targets, report.Time)
+
+	// ファイルごと削除する場合は過去の版もあわせて削除される
+	deleted := map[string]bool{}
+	for _, candidate := range candidates {
+		deleted[candidate.ContentID] = true
+	}
+	for _, candidate := range policy.planVersions(archived) {
+		if !deleted[candidate.ContentID] {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	report.Candidates = []RetentionCandidate{}
+	for _, candidate := range candidates {
+		if !dryRun {
+			var err error
+			var item TrashedArtifact
+			if candidate.Archived {
+				_, err = server.fileCtrl.purgeVersion(candidate.ContentID, candidate.Version)
+			} else {
+				item, err = server.deleteArtifact(candidate.ContentID, "retention")
+			}
+			action := AuditDelete
+			if candidate.Archived {
+				action = AuditPurgeVersion
+			}
+			server.recordAudit("retention", action, candidate.ArtifactInfo, err)
+			if err != nil {
+				log.Printf("保持ポリシーによる削除に失敗しました %v: %v", candidate.VersionedID(), err)
+				continue
+			}
+			log.Printf("保持ポリシーにより削除しました %v: %v", candidate.VersionedID(), candidate.Reason)
+			server.publish(Event{Type: EventRetentionDeleted, User: "retention", Artifact: candidate.ArtifactInfo, TrashID: item.TrashID, Reason: candidate.Reason})
+		}
+		report.FreedBytes += candidate.Size
+		report.Candidates = append(report.Candidates, candidate)
+	}
+
+	// ゴミ箱に移してから一定期間が過ぎたファイルを完全に削除する
+	expired, err := server.expiredTrash(report.Time)
+	if err != nil {
+		return report, err
+	}
+	report.PurgedTrash = []TrashedArtifact{}
+	for _, item := range expired {
+		if !dryRun {
+			_, err := server.fileCtrl.purgeTrash(item.TrashID)
+			server.recordAudit("retention", AuditPurgeTrash, item.ArtifactInfo, err)
+			if err != nil {
+				log.Printf("ゴミ箱からの削除に失敗しました %v: %v", item.TrashID, err)
+				continue
+			}
+			log.Printf("ゴミ箱から完全に削除しました %v: %v", item.TrashID, item.VersionedID())
+		}
+		report.PurgedTrash = append(report.PurgedTrash, item)
+	}
+
+	return report, nil
+}
+
+// isPinned 最新版または過去の版のいずれかがピン留めされているか
+// 保持ポリシーと一括削除の条件指定では、このファイルをファイルごと削除する対象にしない
+func isPinned(info ArtifactInfo, archived []ArtifactInfo) bool {
+	return info.Pinned || hasPinnedVersion(archived)
+}
+
+func hasPinnedVersion(versions []ArtifactInfo) bool {
+	for _, info := range versions {
+		if info.Pinned {
+			return true
+		}
+	}
+	return false
+}
+
+// RunRetentionSweeper 起動直後と指定した間隔ごとに保持ポリシーを適用する。ctxが完了するまで戻らない
+// 期限切れの分割アップロードとライブログの破棄もあわせて行う
+// intervalが0以下の場合は定期的な適用を行わずにすぐ戻る
+func (server *LogServer) RunRetentionSweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Print("保持ポリシーの適用間隔が0以下のため定期的な適用を行いません:", interval)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := server.SweepRetention(false)
+		if err != nil {
+			log.Print("保持ポリシーの適用に失敗しました:", err)
+		}
+		server.uploads.purgeExpired(uploadSessionTTL)
+		server.live.purgeExpired(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (server *LogServer) retentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := server.SweepRetention(true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,76 @@
+package logServer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetentionPlan(t *testing.T) {
+	now := time.Now()
+	infos := []ArtifactInfo{
+		{ContentID: "soak-1.zip", Size: 100, UploadTime: now.Add(-72 * time.Hour)},
+		{ContentID: "soak-2.zip", Size: 100, UploadTime: now.Add(-3 * time.Hour)},
+		{ContentID: "soak-3.zip", Size: 100, UploadTime: now.Add(-2 * time.Hour)},
+		{ContentID: "soak-4.zip", Size: 100, UploadTime: now.Add(-1 * time.Hour)},
+		{ContentID: "smoke-1.zip", Size: 300, UploadTime: now.Add(-4 * time.Hour)},
+	}
+
+	policy := RetentionPolicy{
+		MaxAge:            48 * time.Hour,
+		MaxTotalBytes:     400,
+		MaxCountPerPrefix: map[string]int{"soak-": 2},
+	}
+
+	candidates := policy.plan(infos, now)
+
+	// soak-1は期限切れ、soak-2は保持数超過、smoke-1は合計サイズ超過で削除される
+	expected := []string{"soak-1.zip", "smoke-1.zip", "soak-2.zip"}
+	if len(candidates) != len(expected) {
+		t.Fatal("削除対象が不正です:", candidates)
+	}
+	for i, name := range expected {
+		if candidates[i].ContentID != name {
+			t.Fatal("削除対象が不正です:", candidates)
+		}
+	}
+}
+
+func TestParseMaxCountPerPrefix(t *testing.T) {
+	counts, err := ParseMaxCountPerPrefix([]string{"soak-:10", "nightly:main:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["soak-"] != 10 || counts["nightly:main"] != 3 {
+		t.Fatal("変換結果が不正です:", counts)
+	}
+
+	_, err = ParseMaxCountPerPrefix([]string{"soak-"})
+	if err == nil {
+		t.Fatal("不正な指定が受け付けられています")
+	}
+}
+
+func TestRunRetentionSweeperInvalidInterval(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// 0以下の間隔ではパニックせず、ctxの完了を待たずに戻る
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		done := make(chan struct{})
+		go func() {
+			server.RunRetentionSweeper(ctx, interval)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("0以下の間隔で戻りません:", interval)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package logServer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultS3PartSize この大きさを超える内容はマルチパートアップロードで保存する
+	defaultS3PartSize = 64 * 1024 * 1024
+	// maxS3CopySize 1回のリクエストで複製できる最大の大きさ
+	maxS3CopySize = 5 * 1024 * 1024 * 1024
+	// s3UnsignedPayload 本文のハッシュを署名に含めない場合の指定
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config S3互換ストレージへの接続設定
+type S3Config struct {
+	// Endpoint 接続先。例: https://s3.ap-northeast-1.amazonaws.com, http://localhost:9000
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix バケット内で使用するキーの接頭辞。空の場合はバケット直下に保存する
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PartSize マルチパートアップロードの1パートの大きさ。0の場合は64MiB
+	PartSize int64
+}
+
+// S3Storage S3互換ストレージを保存先とするStorage
+// MinIOなどのローカルで動作する互換サーバーでも使用できるようにパス形式でバケットを指定する
+type S3Storage struct {
+	endpoint *url.URL
+	config   S3Config
+	client   *http.Client
+}
+
+// NewS3Storage S3互換ストレージを保存先とするStorageを作成する
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3のエンドポイントが不正です: %v", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("S3のバケットが指定されていません")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = defaultS3PartSize
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	if config.Prefix != "" {
+		config.Prefix += "/"
+	}
+
+	return &S3Storage{endpoint: endpoint, config: config, client: &http.Client{}}, nil
+}
+
+// objectURL keyのオブジェクトのURL
+func (storage *S3Storage) objectURL(key string, query url.Values) string {
+	u := *storage.endpoint
+	u.Path = "/" + storage.config.Bucket
+	if key != "" {
+		u.Path += "/" + storage.config.Prefix + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+// do 署名したリクエストを送信する。bodyがnilでない場合はsizeバイト送信する
+func (storage *S3Storage) do(method string, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, storage.objectURL(key, query), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := s3UnsignedPayload
+	if body == nil {
+		payloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+	} else {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	signS3Request(req, payloadHash, storage.config.AccessKey, storage.config.SecretKey, storage.config.Region, time.Now())
+
+	return storage.client.Do(req)
+}
+
+// s3Error 失敗したレスポンスをエラーに変換する
+func s3Error(resp *http.Response, method string, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return notExistError(key)
+	}
+
+	var body struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(b, &body)
+	return fmt.Errorf("S3への%vリクエストが失敗しました %v: %v %v %v", method, key, resp.Status, body.Code, body.Message)
+}
+
+// Put 大きさが分からない内容は一時ファイルに書き込んでから送信する
+func (storage *S3Storage) Put(key string, src io.Reader) error {
+	if err := validateStorageKey(key); err != nil {
+		return err
+	}
+
+	f, ok := src.(*os.File)
+	if !ok {
+		temp, err := ioutil.TempFile("", "logServer-s3-*")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			temp.Close()
+			os.Remove(temp.Name())
+		}()
+		if _, err := io.Copy(temp, src); err != nil {
+			return err
+		}
+		if _, err := temp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f = temp
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size() - offset
+
+	if size > storage.config.PartSize {
+		return storage.putMultipart(key, f, offset, size)
+	}
+
+	resp, err := storage.do(http.MethodPut, key, nil, nil, io.NewSectionReader(f, offset, size), size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, http.MethodPut, key)
+	}
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart 内容をパートに分けて送信する
+func (storage *S3Storage) putMultipart(key string, f io.ReaderAt, offset int64, size int64) error {
+	resp, err := storage.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadId string
+	}
+	if resp.StatusCode == http.StatusOK {
+		err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	} else {
+		err = s3Error(resp, http.MethodPost, key)
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	err = storage.uploadParts(key, initiate.UploadId, f, offset, size)
+	if err != nil {
+		// 途中までのパートが残らないように中断する
+		resp, abortErr := storage.do(http.MethodDelete, key, url.Values{"uploadId": {initiate.UploadId}}, nil, nil, 0)
+		if abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (storage *S3Storage) uploadParts(key string, uploadID string, f io.ReaderAt, offset int64, size int64) error {
+	var complete struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+
+	for partOffset := int64(0); partOffset < size; partOffset += storage.config.PartSize {
+		partSize := storage.config.PartSize
+		if partOffset+partSize > size {
+			partSize = size - partOffset
+		}
+		partNumber := len(complete.Parts) + 1
+
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := storage.do(http.MethodPut, key, query, nil, io.NewSectionReader(f, offset+partOffset, partSize), partSize)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s3Error(resp, http.MethodPut, key)
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+	}
+
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := storage.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, http.Header{"Content-Type": {"application/xml"}}, bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 完了処理はステータスコードが200でも本文でエラーを返す場合がある
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return s3Error(resp, http.MethodPost, key)
+	}
+	return nil
+}
+
+func (storage *S3Storage) Get(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := validateStorageKey(key); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		if _, err := storage.Stat(key); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	header := http.Header{}
+	switch {
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := storage.do(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 末尾以降を指定した場合は空の内容として扱う
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error(resp, http.MethodGet, key)
+	}
+}
+
+func (storage *S3Storage) Stat(key string) (StorageObject, error) {
+	if err := validateStorageKey(key); err != nil {
+		return StorageObject{}, err
+	}
+
+	resp, err := storage.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return StorageObject{}, s3Error(resp, http.MethodHead, key)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (storage *S3Storage) List(prefix string) ([]StorageObject, error) {
+	objects := []StorageObject{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {storage.config.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := storage.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		} else {
+			err = s3Error(resp, http.MethodGet, prefix)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			key := strings.TrimPrefix(content.Key, storage.config.Prefix)
+			objects = append(objects, StorageObject{Key: key, Size: content.Size, ModTime: content.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete S3は存在しないキーの削除も成功扱いとするため、先に存在を確認する
+func (storage *S3Storage) Delete(key string) error {
+	if _, err := storage.Stat(key); err != nil {
+		return err
+	}
+
+	resp, err := storage.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, http.MethodDelete, key)
+	}
+	return nil
+}
+
+// Move ストレージ内で複製してから削除する。複製できない大きさの場合は読み込んで送信し直す
+func (storage *S3Storage) Move(src string, dst string) error {
+	if err := validateStorageKey(dst); err != nil {
+		return err
+	}
+	stat, err := storage.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if stat.Size > maxS3CopySize {
+		r, err := storage.Get(src, 0, -1)
+		if err != nil {
+			return err
+		}
+		err = storage.Put(dst, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		return storage.Delete(src)
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {s3EscapePath("/" + storage.config.Bucket + "/" + storage.config.Prefix + src)}}
+	resp, err := storage.do(http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 複製はステータスコードが200でも本文でエラーを返す場合がある
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return s3Error(resp, http.MethodPut, dst)
+	}
+	return storage.Delete(src)
+}
+
+// s3Escape RFC 3986の非予約文字以外をエスケープする。escapeSlashがfalseの場合は/をそのまま残す
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, false)
+}
+
+// s3CanonicalQuery 署名に使用する形式でクエリ文字列を作成する
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request AWS署名バージョン4でリクエストに署名する
+// 署名対象のヘッダーはhost、range、content-md5、x-amz-で始まるもの
+func signS3Request(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
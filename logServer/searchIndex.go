@@ -0,0 +1,554 @@
+package logServer
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+
+	// 索引対象とする単語の長さ
+	minTokenLength = 2
+	maxTokenLength = 64
+
+	// 検索結果に含める行の最大文字数
+	maxSnippetLength = 300
+)
+
+// SearchHit 検索に一致した行
+type SearchHit struct {
+	ContentID string `json:"contentID"`
+	// Entry zipアーカイブ内のパス。アーカイブでないファイルの場合は空文字
+	Entry   string `json:"entry"`
+	Line    int    `json:"line"`
+	Snippet string `json:"snippet"`
+	// ViewURL 一致した行をログビューアーで表示するURL
+	ViewURL string `json:"viewURL"`
+}
+
+// SearchResult /api/search のレスポンス
+type SearchResult struct {
+	Query     string      `json:"query"`
+	Hits      []SearchHit `json:"hits"`
+	Truncated bool        `json:"truncated"`
+}
+
+// posting 単語が出現した位置
+type posting struct {
+	Entry int32
+	Line  int32
+}
+
+// indexSegment 1ファイル分の索引。ファイルごとに保存し、削除時はファイル単位で取り除く
+type indexSegment struct {
+	ContentID string
+	Entries   []string
+	Postings  map[string][]posting
+}
+
+// searchIndex アップロードされたログの転置索引
+// 単語からファイルへの対応をメモリに持ち、ファイル内の出現位置は保存先ディレクトリの索引ファイルから読み込む
+type searchIndex struct {
+	dir   string
+	queue chan string
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// backlog 起動時に見つかった索引のないファイルと、queueに入りきらなかったファイル
+	// アップロードの処理を待たせないよう上限を設けず、queueが空になってから順に処理する
+	backlogLock sync.Mutex
+	backlog     []string
+	// backlogAdded backlogに追加されたことを索引作成の処理に知らせる
+	backlogAdded chan struct{}
+
+	lock  sync.RWMutex
+	terms map[string]map[string]struct{}
+	docs  map[string][]string
+}
+
+// tokenize 英数字とアンダースコアの並びを小文字の単語として取り出す
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+	})
+
+	tokens := fields[:0]
+	for _, field := range fields {
+		if l := utf8.RuneCountInString(field); l >= minTokenLength && l <= maxTokenLength {
+			tokens = append(tokens, strings.ToLower(field))
+		}
+	}
+	return tokens
+}
+
+func newSearchIndex(dir string) (*searchIndex, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("索引保存先ディレクトリの作成に失敗しました %v", err)
+	}
+
+	index := &searchIndex{
+		dir:          dir,
+		queue:        make(chan string, 1024),
+		done:         make(chan struct{}),
+		backlogAdded: make(chan struct{}, 1),
+		terms:        map[string]map[string]struct{}{},
+		docs:         map[string][]string{},
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".idx") {
+			continue
+		}
+		segment, err := index.loadSegment(strings.TrimSuffix(entry.Name(), ".idx"))
+		if err != nil {
+			log.Printf("索引 %v の読み込みに失敗しました: %v", entry.Name(), err)
+			continue
+		}
+		index.lock.Lock()
+		index.register(segment)
+		index.lock.Unlock()
+	}
+
+	return index, nil
+}
+
+func (index *searchIndex) segmentPath(contentID string) string {
+	return path.Join(index.dir, contentID+".idx")
+}
+
+func (index *searchIndex) loadSegment(contentID string) (indexSegment, error) {
+	var segment indexSegment
+
+	f, err := os.Open(index.segmentPath(contentID))
+	if err != nil {
+		return segment, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&segment)
+	return segment, err
+}
+
+// register 索引ファイルの単語をメモリ上の索引に登録する。呼び出し側でロックを取得しておくこと
+func (index *searchIndex) register(segment indexSegment) {
+	index.unregister(segment.ContentID)
+
+	tokens := make([]string, 0, len(segment.Postings))
+	for token := range segment.Postings {
+		ids, ok := index.terms[token]
+		if !ok {
+			ids = map[string]struct{}{}
+			index.terms[token] = ids
+		}
+		ids[segment.ContentID] = struct{}{}
+		tokens = append(tokens, token)
+	}
+	index.docs[segment.ContentID] = tokens
+}
+
+// unregister メモリ上の索引から取り除く。呼び出し側でロックを取得しておくこと
+func (index *searchIndex) unregister(contentID string) {
+	for _, token := range index.docs[contentID] {
+		ids := index.terms[token]
+		delete(ids, contentID)
+		if len(ids) == 0 {
+			delete(index.terms, token)
+		}
+	}
+	delete(index.docs, contentID)
+}
+
+func (index *searchIndex) indexed(contentID string) bool {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+	_, ok := index.docs[contentID]
+	return ok
+}
+
+// enqueue 索引作成を予約する。索引作成はstartで開始した処理で順に行われる
+// アップロードの処理から呼ばれるため待たせない。queueがいっぱいの場合はbacklogに回す
+func (index *searchIndex) enqueue(contentID string) {
+	select {
+	case index.queue <- contentID:
+	default:
+		index.enqueueBacklog(contentID)
+	}
+}
+
+// enqueueBacklog queueに予約したものより後に索引を作成するよう予約する
+func (index *searchIndex) enqueueBacklog(contentIDs ...string) {
+	if len(contentIDs) == 0 {
+		return
+	}
+	index.backlogLock.Lock()
+	index.backlog = append(index.backlog, contentIDs...)
+	index.backlogLock.Unlock()
+
+	select {
+	case index.backlogAdded <- struct{}{}:
+	default:
+	}
+}
+
+// nextBacklog backlogの先頭を取り出す
+func (index *searchIndex) nextBacklog() (string, bool) {
+	index.backlogLock.Lock()
+	defer index.backlogLock.Unlock()
+	if len(index.backlog) == 0 {
+		return "", false
+	}
+	contentID := index.backlog[0]
+	index.backlog = index.backlog[1:]
+	return contentID, true
+}
+
+// start 予約されたファイルの索引作成を開始する
+// queueを優先し、queueが空の間にbacklogを処理する
+func (index *searchIndex) start(ctrl *fileControl) {
+	add := func(contentID string) {
+		err := index.add(ctrl, contentID)
+		if err != nil {
+			log.Printf("%v の索引作成に失敗しました: %v", contentID, err)
+		}
+	}
+
+	index.wg.Add(1)
+	go func() {
+		defer index.wg.Done()
+		for {
+			select {
+			case contentID := <-index.queue:
+				add(contentID)
+				continue
+			case <-index.done:
+				return
+			default:
+			}
+
+			if contentID, ok := index.nextBacklog(); ok {
+				add(contentID)
+				continue
+			}
+
+			select {
+			case contentID := <-index.queue:
+				add(contentID)
+			case <-index.backlogAdded:
+			case <-index.done:
+				return
+			}
+		}
+	}()
+}
+
+// close 索引作成を停止する。作成途中の索引があれば完了を待つ
+func (index *searchIndex) close() {
+	close(index.done)
+	index.wg.Wait()
+}
+
+// add 指定したファイルの索引を作成する
+// zipアーカイブの場合はアーカイブ内のログを対象とする
+func (index *searchIndex) add(ctrl *fileControl, contentID string) error {
+	segment := indexSegment{ContentID: contentID, Postings: map[string][]posting{}}
+
+	addEntry := func(entry string, r io.Reader) error {
+		entryIndex := int32(len(segment.Entries))
+		segment.Entries = append(segment.Entries, entry)
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		lineNumber := int32(0)
+		for scanner.Scan() {
+			lineNumber++
+			seen := map[string]bool{}
+			for _, token := range tokenize(scanner.Text()) {
+				if seen[token] {
+					continue
+				}
+				seen[token] = true
+				segment.Postings[token] = append(segment.Postings[token], posting{Entry: entryIndex, Line: lineNumber})
+			}
+		}
+		return scanner.Err()
+	}
+
+	switch {
+	case strings.ToLower(path.Ext(contentID)) == ".zip":
+		a, err := ctrl.openArchive(contentID)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+
+		for _, f := range a.File {
+			if f.FileInfo().IsDir() || !isViewableEntry(f.Name) {
+				continue
+			}
+			src, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = addEntry(normalizeEntryPath(f.Name), src)
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+	case isViewableEntry(contentID):
+		src, err := ctrl.open(contentID)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		if err := addEntry("", src); err != nil {
+			return err
+		}
+	}
+
+	f, err := ioutil.TempFile(index.dir, "segment-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(segment)
+	if err == nil {
+		err = w.Flush()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	// 索引作成中に削除された場合は登録しない
+	if !ctrl.exists(contentID) {
+		return nil
+	}
+
+	err = os.Rename(f.Name(), index.segmentPath(contentID))
+	if err != nil {
+		return err
+	}
+	index.register(segment)
+	return nil
+}
+
+// remove 指定したファイルの索引を取り除く
+func (index *searchIndex) remove(contentID string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.unregister(contentID)
+	os.Remove(index.segmentPath(contentID))
+}
+
+// candidates すべての単語を含むファイルのコンテンツIDを返す
+func (index *searchIndex) candidates(tokens []string) []string {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	var ids []string
+	for id := range index.terms[tokens[0]] {
+		found := true
+		for _, token := range tokens[1:] {
+			if _, ok := index.terms[token][id]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// search すべての単語を含む行を探す
+func (index *searchIndex) search(ctrl *fileControl, query string, limit int) (SearchResult, error) {
+	result := SearchResult{Query: query, Hits: []SearchHit{}}
+
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return result, fmt.Errorf("検索語が指定されていません")
+	}
+
+	for _, contentID := range index.candidates(tokens) {
+		segment, err := index.loadSegment(contentID)
+		if err != nil {
+			// 検索中に削除された
+			continue
+		}
+
+		// 単語ごとの出現位置の積集合を取る
+		matched := map[posting]bool{}
+		for _, p := range segment.Postings[tokens[0]] {
+			matched[p] = true
+		}
+		for _, token := range tokens[1:] {
+			next := map[posting]bool{}
+			for _, p := range segment.Postings[token] {
+				if matched[p] {
+					next[p] = true
+				}
+			}
+			matched = next
+		}
+
+		positions := make([]posting, 0, len(matched))
+		for p := range matched {
+			positions = append(positions, p)
+		}
+		sort.Slice(positions, func(i, j int) bool {
+			if positions[i].Entry != positions[j].Entry {
+				return positions[i].Entry < positions[j].Entry
+			}
+			return positions[i].Line < positions[j].Line
+		})
+
+		if len(result.Hits)+len(positions) > limit {
+			positions = positions[:limit-len(result.Hits)]
+			result.Truncated = true
+		}
+
+		hits, err := readSnippets(ctrl, segment, positions)
+		if err != nil {
+			log.Printf("%v の検索結果の読み込みに失敗しました: %v", contentID, err)
+			continue
+		}
+		result.Hits = append(result.Hits, hits...)
+
+		if result.Truncated {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// readSnippets 検索に一致した行の内容を読み込む
+func readSnippets(ctrl *fileControl, segment indexSegment, positions []posting) ([]SearchHit, error) {
+	hits := make([]SearchHit, 0, len(positions))
+	if len(positions) == 0 {
+		return hits, nil
+	}
+
+	readEntry := func(entry int32, r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		lineNumber := int32(0)
+		for scanner.Scan() && len(positions) > 0 && positions[0].Entry == entry {
+			lineNumber++
+			if positions[0].Line != lineNumber {
+				continue
+			}
+			snippet := scanner.Text()
+			if utf8.RuneCountInString(snippet) > maxSnippetLength {
+				snippet = string([]rune(snippet)[:maxSnippetLength])
+			}
+			hit := SearchHit{ContentID: segment.ContentID, Entry: segment.Entries[entry], Line: int(lineNumber), Snippet: snippet}
+			hit.ViewURL = searchHitViewURL(hit)
+			hits = append(hits, hit)
+			positions = positions[1:]
+		}
+		return scanner.Err()
+	}
+
+	if segment.Entries[0] == "" {
+		src, err := ctrl.open(segment.ContentID)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		return hits, readEntry(0, src)
+	}
+
+	a, err := ctrl.openArchive(segment.ContentID)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	for len(positions) > 0 {
+		entry := positions[0].Entry
+		f, err := a.find(segment.Entries[entry])
+		if err != nil {
+			return nil, err
+		}
+		src, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = readEntry(entry, src)
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// 読み切れなかった位置は読み飛ばす
+		for len(positions) > 0 && positions[0].Entry == entry {
+			positions = positions[1:]
+		}
+	}
+	return hits, nil
+}
+
+func (server *LogServer) searchHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	limit := defaultSearchLimit
+	if v := values.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			http.Error(w, fmt.Sprintf("limitは1から%vの範囲で指定してください: %v", maxSearchLimit, v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := server.index.search(server.fileCtrl, values.Get("q"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// searchHitViewURL 検索に一致した行をビューアーで表示するURL
+func searchHitViewURL(hit SearchHit) string {
+	if hit.Entry == "" {
+		return fmt.Sprintf("/view/%s#L%d", url.PathEscape(hit.ContentID), hit.Line)
+	}
+	return fmt.Sprintf("/view/%s/%s#L%d", url.PathEscape(hit.ContentID), hit.Entry, hit.Line)
+}
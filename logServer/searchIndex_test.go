@@ -0,0 +1,137 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchIndex(t *testing.T) {
+	dir := t.TempDir()
+	server, err := NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	err = server.fileCtrl.save("run1.zip", newTestZip(t, map[string]string{
+		"Saved/Logs/log.txt":          "LogInit: Display: start\nLogTemp: Error: Assertion failed: Foo != nullptr\n",
+		"Saved/Profiling/capture.csv": "Assertion,failed",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.fileCtrl.save("run2.log", strings.NewReader("LogNet: Warning: Assertion skipped\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"run1.zip", "run2.log"} {
+		if err := server.index.add(server.fileCtrl, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// すべての単語を含む行だけが一致する
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=assertion+FAILED", nil)
+	rec := httptest.NewRecorder()
+	server.NewHTTPHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var result SearchResult
+	json.NewDecoder(rec.Body).Decode(&result)
+	if len(result.Hits) != 1 {
+		t.Fatal("検索結果が不正です:", result)
+	}
+	hit := result.Hits[0]
+	if hit.ContentID != "run1.zip" || hit.Entry != "Saved/Logs/log.txt" || hit.Line != 2 || !strings.Contains(hit.Snippet, "Foo != nullptr") {
+		t.Fatal("検索結果が不正です:", hit)
+	}
+	if hit.ViewURL != "/view/run1.zip/Saved/Logs/log.txt#L2" {
+		t.Fatal("ビューアーのURLが不正です:", hit.ViewURL)
+	}
+
+	result, err = server.index.search(server.fileCtrl, "assertion", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hits) != 2 {
+		t.Fatal("検索結果が不正です:", result)
+	}
+
+	// 索引は保存先から読み直せる
+	reloaded, err := newSearchIndex(server.fileCtrl.reservedPath("index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = reloaded.search(server.fileCtrl, "assertion", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hits) != 2 {
+		t.Fatal("読み直した索引の検索結果が不正です:", result)
+	}
+
+	// 削除したファイルは検索対象から外れる
+	_, err = server.deleteArtifact("run1.zip", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = server.index.search(server.fileCtrl, "assertion", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hits) != 1 || result.Hits[0].ContentID != "run2.log" {
+		t.Fatal("削除したファイルが検索結果に含まれています:", result)
+	}
+
+	_, err = server.index.search(server.fileCtrl, "!", 10)
+	if err == nil {
+		t.Fatal("検索語のない検索が成功しています")
+	}
+}
+
+func TestSearchIndexEnqueueDoesNotBlock(t *testing.T) {
+	fileCtrl, err := newFileControlWithStorage(NewMemoryStorage(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		if err := fileCtrl.save(name, strings.NewReader("LogInit: "+name+"\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := newSearchIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 索引作成が追いつかずqueueがいっぱいでもアップロードの処理を待たせない
+	enqueued := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(index.queue); i++ {
+			index.enqueue("a.log")
+		}
+		index.enqueue("b.log")
+		index.enqueueBacklog("c.log")
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("索引作成の予約が待たされています")
+	}
+
+	// queueに入りきらなかったものもbacklogから索引が作成される
+	index.start(fileCtrl)
+	defer index.close()
+	for i := 0; !index.indexed("b.log") || !index.indexed("c.log"); i++ {
+		if i >= 500 {
+			t.Fatal("backlogの索引が作成されていません")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,203 @@
+package logServer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// selfSignedCAFile 自己署名CA証明書のファイル名。アップローダー側にはこのファイルを配布する
+	selfSignedCAFile    = "ca.pem"
+	selfSignedCAKeyFile = "ca-key.pem"
+	// selfSignedCertFile 自己署名CAで署名したサーバー証明書のファイル名
+	selfSignedCertFile    = "server.pem"
+	selfSignedCertKeyFile = "server-key.pem"
+
+	selfSignedCALifetime   = 10 * 365 * 24 * time.Hour
+	selfSignedCertLifetime = 2 * 365 * 24 * time.Hour
+	// selfSignedCertRenewBefore 有効期限までこの期間を切ったサーバー証明書は作り直す
+	selfSignedCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// SelfSignedCert 自己署名CAで署名したサーバー証明書
+type SelfSignedCert struct {
+	Certificate tls.Certificate
+	// CAPath アップローダー側で信頼するCA証明書のパス
+	CAPath string
+}
+
+// SelfSignedTLSCert サーバーの作業ディレクトリに保存した自己署名証明書を読み込む
+// 初回起動時などで存在しない場合は作成して保存する
+func (server *LogServer) SelfSignedTLSCert(hosts []string) (SelfSignedCert, error) {
+	return LoadOrCreateSelfSignedCert(server.fileCtrl.reservedPath("tls"), hosts)
+}
+
+// LoadOrCreateSelfSignedCert 指定したディレクトリの自己署名CAとサーバー証明書を読み込む
+// CAが存在しない場合は作成する。サーバー証明書が存在しない、hostsを含まない、または有効期限が近い場合はCAで署名して作り直す
+// CAは作り直さないため、配布済みのCA証明書はサーバー証明書を作り直した後も使用できる
+// hosts サーバー証明書に含めるホスト名またはIPアドレス
+func LoadOrCreateSelfSignedCert(dir string, hosts []string) (SelfSignedCert, error) {
+	if len(hosts) == 0 {
+		return SelfSignedCert{}, errors.New("サーバー証明書に含めるホストを指定してください")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return SelfSignedCert{}, fmt.Errorf("証明書の保存先の作成に失敗しました: %v", err)
+	}
+
+	caPath := filepath.Join(dir, selfSignedCAFile)
+	ca, caKey, err := loadOrCreateCA(caPath, filepath.Join(dir, selfSignedCAKeyFile))
+	if err != nil {
+		return SelfSignedCert{}, err
+	}
+
+	certPath := filepath.Join(dir, selfSignedCertFile)
+	keyPath := filepath.Join(dir, selfSignedCertKeyFile)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && certCovers(cert, ca, hosts, time.Now()) {
+		return SelfSignedCert{Certificate: cert, CAPath: caPath}, nil
+	}
+
+	err = createServerCert(certPath, keyPath, ca, caKey, hosts)
+	if err != nil {
+		return SelfSignedCert{}, err
+	}
+	cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return SelfSignedCert{}, err
+	}
+	return SelfSignedCert{Certificate: cert, CAPath: caPath}, nil
+}
+
+// loadOrCreateCA CA証明書と秘密鍵を読み込む。存在しない場合は作成する
+func loadOrCreateCA(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("CAの秘密鍵の形式が不正です: %v", keyPath)
+		}
+		return ca, key, nil
+	}
+	if _, statErr := os.Stat(certPath); !os.IsNotExist(statErr) {
+		return nil, nil, fmt.Errorf("CA証明書の読み込みに失敗しました: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ue4Runner"}, CommonName: "ue4Runner logServer CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeCertAndKey(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// createServerCert CAで署名したサーバー証明書を作成する
+func createServerCert(certPath string, keyPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"ue4Runner"}, CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certPath, keyPath, der, key)
+}
+
+// certCovers サーバー証明書がCAで署名され、すべてのホストを含み、有効期限まで余裕があるか
+func certCovers(cert tls.Certificate, ca *x509.Certificate, hosts []string, now time.Time) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if leaf.CheckSignatureFrom(ca) != nil || now.Add(selfSignedCertRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writeCertAndKey 証明書と秘密鍵をPEM形式で保存する。秘密鍵は所有者のみ読めるようにする
+func writeCertAndKey(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return fmt.Errorf("秘密鍵の保存に失敗しました: %v", err)
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return fmt.Errorf("証明書の保存に失敗しました: %v", err)
+	}
+	return nil
+}
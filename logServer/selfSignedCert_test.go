@@ -0,0 +1,59 @@
+package logServer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLoadOrCreateSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := LoadOrCreateSelfSignedCert(dir, []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM, err := ioutil.ReadFile(cert.CAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		t.Fatal("CA証明書が読み込めません")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Fatal("サーバー証明書がCAで検証できません:", host, err)
+		}
+	}
+
+	// 2回目以降は保存した証明書を使用する
+	reloaded, err := LoadOrCreateSelfSignedCert(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reloaded.Certificate.Certificate[0], cert.Certificate.Certificate[0]) {
+		t.Fatal("保存したサーバー証明書が使用されていません")
+	}
+
+	// ホストが追加された場合はサーバー証明書のみ作り直し、配布済みのCAは引き続き使用できる
+	renewed, err := LoadOrCreateSelfSignedCert(dir, []string{"localhost", "logserver.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(renewed.Certificate.Certificate[0], cert.Certificate.Certificate[0]) {
+		t.Fatal("サーバー証明書が作り直されていません")
+	}
+	leaf, err = x509.ParseCertificate(renewed.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "logserver.example", Roots: pool}); err != nil {
+		t.Fatal("作り直したサーバー証明書が以前のCAで検証できません:", err)
+	}
+}
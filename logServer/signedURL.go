@@ -0,0 +1,147 @@
+package logServer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultMaxSignedURLLifetime 署名付きURLの有効期間の上限の既定値
+	defaultMaxSignedURLLifetime = 30 * 24 * time.Hour
+	// signingKeySize 署名付きURLの署名に使用する鍵のバイト数
+	signingKeySize = 32
+)
+
+// SignedURL /api/sign で発行した署名付きURL
+// 認証なしで1つのファイルを有効期限までダウンロードできる
+type SignedURL struct {
+	// Path サーバーのURLに続けるパス。例: /signed/run.zip@v1?expires=...&sig=...
+	Path      string    `json:"path"`
+	ContentID string    `json:"contentID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// loadSigningKey 署名に使用する鍵を読み込む。存在しない場合は作成して保存する
+// 再起動後も発行済みの署名付きURLを使用できるよう鍵はファイルに保存しておく
+func loadSigningKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) < signingKeySize {
+			return nil, fmt.Errorf("署名用の鍵が不正です: %v", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := randomHex(signingKeySize)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, []byte(key), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("署名用の鍵の保存に失敗しました: %v", err)
+	}
+	return hex.DecodeString(key)
+}
+
+// SetMaxSignedURLLifetime 発行する署名付きURLの有効期間の上限を設定する
+func (server *LogServer) SetMaxSignedURLLifetime(lifetime time.Duration) {
+	server.signingLock.Lock()
+	defer server.signingLock.Unlock()
+	server.maxSignedURLLifetime = lifetime
+}
+
+func (server *LogServer) maxSignedURLLifetimeLimit() time.Duration {
+	server.signingLock.Lock()
+	defer server.signingLock.Unlock()
+	return server.maxSignedURLLifetime
+}
+
+// urlSignature コンテンツIDと有効期限に対する署名
+func (server *LogServer) urlSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, server.signingKey)
+	fmt.Fprintf(mac, "%s\n%d", name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL ファイルの署名付きURLを作成する
+func (server *LogServer) signURL(name string, expiresAt time.Time) SignedURL {
+	expires := expiresAt.Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", server.urlSignature(name, expires))
+	return SignedURL{
+		Path:      "/signed/" + url.PathEscape(name) + "?" + query.Encode(),
+		ContentID: name,
+		ExpiresAt: time.Unix(expires, 0),
+	}
+}
+
+// verifySignedURL 署名付きURLの署名と有効期限を検証する
+func (server *LogServer) verifySignedURL(name string, query url.Values, now time.Time) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("有効期限の指定が不正です")
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(server.urlSignature(name, expires))) {
+		return fmt.Errorf("署名が一致しません")
+	}
+	if now.Unix() > expires {
+		return fmt.Errorf("有効期限が切れています")
+	}
+	return nil
+}
+
+// signHandler ファイルの署名付きURLを発行する
+// 発行時点の版に対して署名し、後から上書きされても同じ内容をダウンロードできるようにする
+// expiresIn に有効期間を指定する。省略した場合は上限の有効期間とする
+func (server *LogServer) signHandler(w http.ResponseWriter, r *http.Request) {
+	maxLifetime := server.maxSignedURLLifetimeLimit()
+	lifetime := maxLifetime
+	if v := r.URL.Query().Get("expiresIn"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("expiresInの指定が不正です: %v", v), http.StatusBadRequest)
+			return
+		}
+		if d > maxLifetime {
+			http.Error(w, fmt.Sprintf("expiresInは %v 以下にしてください", maxLifetime), http.StatusBadRequest)
+			return
+		}
+		lifetime = d
+	}
+
+	info, err := server.fileCtrl.info(mux.Vars(r)["contentID"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, server.signURL(info.VersionedID(), time.Now().Add(lifetime)))
+}
+
+// signedFileHandler 署名付きURLのファイルを認証なしで配信する
+func (server *LogServer) signedFileHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["contentID"]
+	setAuditUser(r, "signed-url")
+	if err := server.verifySignedURL(name, r.URL.Query(), time.Now()); err != nil {
+		server.metrics.authFailed(authFailureInvalidSignature)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	server.serveArtifact(w, r, name)
+}
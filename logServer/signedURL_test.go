@@ -0,0 +1,125 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	dir := t.TempDir()
+	server, err := NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuthenticator(NewSingleUserAuthenticator("root", "password"))
+	handler := server.NewHTTPHandler()
+
+	do := func(auth bool, method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth {
+			req.SetBasicAuth("root", "password")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do(true, http.MethodPost, "/upload/run.log", "first")
+	rec := do(true, http.MethodPost, "/api/sign/run.log?expiresIn=1h", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var signed SignedURL
+	json.NewDecoder(rec.Body).Decode(&signed)
+	if signed.ContentID != "run.log@v1" || signed.ExpiresAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatal("署名付きURLが不正です:", signed)
+	}
+
+	// 署名付きURLは認証なしでダウンロードでき、上書きされても発行時点の版を返す
+	do(true, http.MethodPut, "/upload/run.log", "second")
+	if rec := do(false, http.MethodGet, signed.Path, ""); rec.Code != http.StatusOK || rec.Body.String() != "first" {
+		t.Fatal("署名付きURLでダウンロードできません:", rec.Code, rec.Body.String())
+	}
+
+	// 署名や対象を改ざんしたURLは使用できない
+	u, err := url.Parse(signed.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if rec := do(false, http.MethodGet, "/signed/run.log@v2?"+query.Encode(), ""); rec.Code != http.StatusForbidden {
+		t.Fatal("別のファイルがダウンロードできています:", rec.Code)
+	}
+	query.Set("expires", "9999999999")
+	if rec := do(false, http.MethodGet, "/signed/run.log@v1?"+query.Encode(), ""); rec.Code != http.StatusForbidden {
+		t.Fatal("有効期限を改ざんしたURLでダウンロードできています:", rec.Code)
+	}
+
+	// 有効期限切れのURLは使用できない
+	expired := server.signURL("run.log@v1", time.Now().Add(-time.Second))
+	if rec := do(false, http.MethodGet, expired.Path, ""); rec.Code != http.StatusForbidden {
+		t.Fatal("有効期限切れのURLでダウンロードできています:", rec.Code)
+	}
+
+	// 有効期間は上限を超えられず、存在しないファイルには発行しない
+	if rec := do(true, http.MethodPost, "/api/sign/run.log?expiresIn=8760h", ""); rec.Code != http.StatusBadRequest {
+		t.Fatal("上限を超える有効期間で発行できています:", rec.Code)
+	}
+	if rec := do(true, http.MethodPost, "/api/sign/missing.log", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("存在しないファイルに発行できています:", rec.Code)
+	}
+
+	// 再起動後も同じ鍵で検証できる
+	restarted, err := NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if err := restarted.verifySignedURL("run.log@v1", query, time.Now()); err == nil {
+		t.Fatal("改ざんしたURLが検証を通過しています")
+	}
+	u, _ = url.Parse(signed.Path)
+	if err := restarted.verifySignedURL("run.log@v1", u.Query(), time.Now()); err != nil {
+		t.Fatal("再起動後に署名付きURLが検証できません:", err)
+	}
+}
+
+func TestSetMaxSignedURLLifetimeWhileServing(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload/run.log", strings.NewReader("first")))
+
+	// 配信中に上限を変更しても競合しない
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			server.SetMaxSignedURLLifetime(time.Duration(i+1) * time.Hour)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/sign/run.log?expiresIn=1h", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatal("署名付きURLが発行できません:", rec.Code)
+		}
+	}
+	<-done
+
+	server.SetMaxSignedURLLifetime(time.Minute)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/sign/run.log?expiresIn=1h", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("変更後の上限が適用されていません:", rec.Code)
+	}
+}
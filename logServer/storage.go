@@ -0,0 +1,246 @@
+package logServer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Storage ログファイルサーバーがファイルとメタデータを保存する先
+// キーは/区切りのパスで、存在しないキーを指定した場合は errors.Is(err, os.ErrNotExist) を満たすエラーを返す
+type Storage interface {
+	// Put srcの内容をkeyに保存する。すでに存在する場合は上書きする
+	Put(key string, src io.Reader) error
+	// Get keyの内容をoffsetからlengthバイト読み込む。lengthが負の場合は末尾まで読み込む
+	Get(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Stat keyの情報を取得する
+	Stat(key string) (StorageObject, error)
+	// List prefixで始まるキーの一覧をキーの昇順で取得する
+	List(prefix string) ([]StorageObject, error)
+	// Delete keyを削除する
+	Delete(key string) error
+}
+
+// StorageObject 保存先に保存されている内容の情報
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// fileImporter ローカルのファイルを移動するだけで保存できる保存先
+// 大きなファイルの保存時に内容のコピーを避けるために使用する
+type fileImporter interface {
+	PutFile(key string, path string) error
+}
+
+// objectMover 内容を複製せずにキーを変更できる保存先
+type objectMover interface {
+	Move(src string, dst string) error
+}
+
+// readerAtOpener ランダムアクセスで読み込める保存先
+type readerAtOpener interface {
+	OpenReaderAt(key string) (readerAtCloser, int64, error)
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// validateStorageKey 保存先のキーとして使用できるか確認する
+func validateStorageKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return fmt.Errorf("%v はキーとして使用できません", key)
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("%v はキーとして使用できません", key)
+		}
+	}
+	return nil
+}
+
+// notExistError 存在しないキーを示すエラーを作成する
+func notExistError(key string) error {
+	return fmt.Errorf("%v: %w", key, os.ErrNotExist)
+}
+
+// putFile ローカルのファイルを保存先に保存する。移動できる保存先であれば移動する
+func putFile(storage Storage, key string, path string) error {
+	if importer, ok := storage.(fileImporter); ok {
+		return importer.PutFile(key, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return storage.Put(key, f)
+}
+
+// moveObject srcの内容をdstへ移動する。移動に対応していない保存先では複製してから削除する
+func moveObject(storage Storage, src string, dst string) error {
+	if mover, ok := storage.(objectMover); ok {
+		return mover.Move(src, dst)
+	}
+
+	r, err := storage.Get(src, 0, -1)
+	if err != nil {
+		return err
+	}
+	err = storage.Put(dst, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return storage.Delete(src)
+}
+
+// readAll keyの内容をすべて読み込む
+func readAll(storage Storage, key string) ([]byte, error) {
+	r, err := storage.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// openReaderAt keyの内容をランダムアクセスで読み込めるように開く
+func openReaderAt(storage Storage, key string) (readerAtCloser, int64, error) {
+	if opener, ok := storage.(readerAtOpener); ok {
+		return opener.OpenReaderAt(key)
+	}
+
+	stat, err := storage.Stat(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &storageReaderAt{storage: storage, key: key, size: stat.Size}, stat.Size, nil
+}
+
+// storageReaderAtBlockSize storageReaderAtが1回に読み込むサイズ
+const storageReaderAtBlockSize = 1024 * 1024
+
+// storageReaderAt 範囲指定の読み込みでランダムアクセスを実現するio.ReaderAt
+// zipの読み込みのように小さな読み込みが続く場合に備え、直前に読み込んだ範囲をキャッシュする
+type storageReaderAt struct {
+	storage Storage
+	key     string
+	size    int64
+
+	cacheOffset int64
+	cache       []byte
+}
+
+func (r *storageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < r.size {
+		if off < r.cacheOffset || off >= r.cacheOffset+int64(len(r.cache)) {
+			length := int64(storageReaderAtBlockSize)
+			if rest := int64(len(p) - n); rest > length {
+				length = rest
+			}
+			if off+length > r.size {
+				length = r.size - off
+			}
+
+			src, err := r.storage.Get(r.key, off, length)
+			if err != nil {
+				return n, err
+			}
+			buf := make([]byte, length)
+			_, err = io.ReadFull(src, buf)
+			src.Close()
+			if err != nil {
+				return n, err
+			}
+			r.cacheOffset = off
+			r.cache = buf
+		}
+
+		copied := copy(p[n:], r.cache[off-r.cacheOffset:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *storageReaderAt) Close() error {
+	r.cache = nil
+	return nil
+}
+
+// storageReadSeeker 範囲指定の読み込みでシークを実現するio.ReadSeeker
+// http.ServeContentで範囲指定のダウンロードに応じるために使用する
+type storageReadSeeker struct {
+	storage Storage
+	key     string
+	size    int64
+	offset  int64
+	current io.ReadCloser
+}
+
+func (r *storageReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.current == nil {
+		src, err := r.storage.Get(r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.current = src
+	}
+
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *storageReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("不正なwhenceが指定されました")
+	}
+	if offset < 0 {
+		return 0, errors.New("負の位置にはシークできません")
+	}
+
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *storageReadSeeker) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
@@ -0,0 +1,174 @@
+package logServer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testStorage Storageの実装が共通して満たすべき動作を確認する
+func testStorage(t *testing.T, storage Storage) {
+	err := storage.Put("a.log", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.Put(".logServer/meta/a.log.json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 範囲指定の読み込み
+	for _, c := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, -1, "0123456789"},
+		{3, 4, "3456"},
+		{8, -1, "89"},
+		{8, 10, "89"},
+		{10, -1, ""},
+	} {
+		r, err := storage.Get("a.log", c.offset, c.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.expected {
+			t.Fatal("読み込み結果が不正です:", c.offset, c.length, string(b))
+		}
+	}
+
+	stat, err := storage.Stat("a.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Key != "a.log" || stat.Size != 10 {
+		t.Fatal("Statの結果が不正です:", stat)
+	}
+
+	// 上書き
+	err = storage.Put("a.log", strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = storage.Stat("a.log")
+	if stat.Size != 3 {
+		t.Fatal("上書きされていません:", stat)
+	}
+
+	// 一覧は接頭辞で絞り込める
+	objects, err := storage.List(".logServer/meta/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != ".logServer/meta/a.log.json" {
+		t.Fatal("一覧が不正です:", objects)
+	}
+	objects, err = storage.List("a.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "a.log" {
+		t.Fatal("一覧が不正です:", objects)
+	}
+
+	// 存在しないキーはos.ErrNotExistとなる
+	if _, err := storage.Stat("none.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("存在しないキーのStatが不正です:", err)
+	}
+	if _, err := storage.Get("none.log", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("存在しないキーのGetが不正です:", err)
+	}
+	if err := storage.Delete("none.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("存在しないキーのDeleteが不正です:", err)
+	}
+
+	err = storage.Delete("a.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("a.log"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("削除されていません:", err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage)
+
+	// 保存先を遡るキーは使用できない
+	if err := storage.Put("../escape.log", strings.NewReader("x")); err == nil {
+		t.Fatal("保存先の外に書き込めています")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestLogServerWithStorage(t *testing.T) {
+	s3 := httptest.NewServer(newFakeS3())
+	defer s3.Close()
+
+	storage, err := NewS3Storage(S3Config{Endpoint: s3.URL, Bucket: "logs", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewLogServerWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	zipData := newTestZip(t, map[string]string{"Saved/Logs/log.txt": "LogInit: Display: hello"})
+	req := httptest.NewRequest(http.MethodPost, "/upload/run.zip", zipData)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	// zipアーカイブ内のファイルを範囲指定の読み込みで参照できる
+	req = httptest.NewRequest(http.MethodGet, "/archives/run.zip/raw/Saved/Logs/log.txt", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "LogInit: Display: hello" {
+		t.Fatal("エントリの取得結果が不正です:", rec.Code, rec.Body.String())
+	}
+
+	// /files/ は範囲指定のダウンロードに対応する
+	req = httptest.NewRequest(http.MethodGet, "/files/run.zip", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "PK" {
+		t.Fatal("範囲指定のダウンロード結果が不正です:", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(ContentSHA256Header) == "" {
+		t.Fatal("SHA-256が付与されていません")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/files/", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `href="run.zip"`) || strings.Contains(rec.Body.String(), reservedDirName) {
+		t.Fatal("一覧が不正です:", rec.Body.String())
+	}
+
+	// メタデータは保存先に記録される
+	if _, err := storage.Stat(".logServer/meta/run.zip.json"); err != nil {
+		t.Fatal("メタデータが保存先に記録されていません:", err)
+	}
+}
@@ -0,0 +1,115 @@
+package logServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// metaQueryPrefix タグをクエリパラメータで指定する際の接頭辞 (例: ?meta.branch=main)
+	metaQueryPrefix = "meta."
+	// metaHeaderPrefix タグをヘッダーで指定する際の接頭辞 (例: X-Meta-Branch: main)
+	metaHeaderPrefix = "X-Meta-"
+
+	maxTags           = 64
+	maxTagValueLength = 1024
+)
+
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9_\-]{1,64}$`)
+
+// validateTags タグのキーと値が使用できるものか確認する
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("タグは%v個まで指定できます", maxTags)
+	}
+	for key, value := range tags {
+		if !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("タグのキーには英小文字・数字・_・-のみ使用できます: %v", key)
+		}
+		if len(value) > maxTagValueLength {
+			return fmt.Errorf("タグ %v の値が長すぎます", key)
+		}
+	}
+	return nil
+}
+
+// parseUploadTags アップロードのリクエストからタグを読み込む
+// クエリパラメータ meta.<key> とヘッダー X-Meta-<Key> を受け付け、キーは小文字に揃える
+func parseUploadTags(r *http.Request) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(values) > 0 {
+			tags[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
+		}
+	}
+	for name, values := range r.URL.Query() {
+		if strings.HasPrefix(name, metaQueryPrefix) && len(values) > 0 {
+			tags[strings.ToLower(strings.TrimPrefix(name, metaQueryPrefix))] = values[0]
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, validateTags(tags)
+}
+
+// tagFilter 一覧の絞り込みに使用するタグの条件
+// "key:value" の場合は値の一致、"key" の場合はタグを持つかで判定する
+type tagFilter struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func parseTagFilters(specs []string) []tagFilter {
+	filters := make([]tagFilter, 0, len(specs))
+	for _, spec := range specs {
+		filter := tagFilter{key: strings.ToLower(spec)}
+		if i := strings.Index(spec, ":"); i >= 0 {
+			filter = tagFilter{key: strings.ToLower(spec[:i]), value: spec[i+1:], hasValue: true}
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// matchTags すべての条件に一致するか
+func matchTags(tags map[string]string, filters []tagFilter) bool {
+	for _, filter := range filters {
+		value, ok := tags[filter.key]
+		if !ok || (filter.hasValue && value != filter.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// artifactTagsHandler タグを置き換える。リクエストボディにタグのJSONオブジェクトを指定する
+func (server *LogServer) artifactTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var tags map[string]string
+	err := json.NewDecoder(r.Body).Decode(&tags)
+	if err != nil {
+		http.Error(w, fmt.Sprint("タグの読み込みに失敗しました:", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := server.fileCtrl.updateTags(mux.Vars(r)["contentID"], tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	server.publish(Event{Type: EventArtifactUpdated, User: requestUser(r), Artifact: info})
+
+	writeJSON(w, info)
+}
@@ -0,0 +1,74 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadTags(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	upload := func(name string, query string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload/"+name+query, strings.NewReader(name))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// ヘッダーとクエリパラメータのどちらでも指定できる
+	rec := upload("run1.zip", "?meta.map=Lobby", map[string]string{"X-Meta-Branch": "main"})
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	rec = upload("run2.zip", "?meta.branch=release", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+
+	// 不正なキーは受け付けない
+	rec = upload("run3.zip", "?meta.b%20r=x", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("不正なタグが受け付けられています")
+	}
+
+	list := func(query string) ArtifactList {
+		req := httptest.NewRequest(http.MethodGet, "/api/artifacts"+query, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var list ArtifactList
+		json.NewDecoder(rec.Body).Decode(&list)
+		return list
+	}
+
+	result := list("?tag=branch:main&tag=map")
+	if result.Total != 1 || result.Artifacts[0].ContentID != "run1.zip" || result.Artifacts[0].Tags["map"] != "Lobby" {
+		t.Fatal("タグでの絞り込み結果が不正です:", result)
+	}
+	result = list("?tag=branch")
+	if result.Total != 2 {
+		t.Fatal("タグでの絞り込み結果が不正です:", result)
+	}
+
+	// タグを置き換える
+	req := httptest.NewRequest(http.MethodPut, "/api/artifacts/run2.zip/tags", strings.NewReader(`{"branch":"main"}`))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	result = list("?tag=branch:main")
+	if result.Total != 2 {
+		t.Fatal("タグの置き換え結果が不正です:", result)
+	}
+}
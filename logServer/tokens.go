@@ -0,0 +1,234 @@
+package logServer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// bearerPrefix APIトークンを送るAuthorizationヘッダーの接頭辞
+const bearerPrefix = "Bearer "
+
+// APIToken 発行したAPIトークンの情報
+// APIトークンはアップロード専用で、CIエージェントなどがパスワードの代わりに使用する
+type APIToken struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Prefix 空でない場合はこの接頭辞で始まるコンテンツIDにのみアップロードできる
+	Prefix string `json:"prefix,omitempty"`
+	// ExpiresAt 有効期限。ゼロ値の場合は無期限
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// expired 有効期限が切れているか
+func (token APIToken) expired(now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && now.After(token.ExpiresAt)
+}
+
+// IssuedToken /api/tokens で発行したAPIトークン
+// Tokenは発行時にのみ返し、サーバーにはハッシュのみを保存する
+type IssuedToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// tokenRecord 保存するAPIトークンの情報
+type tokenRecord struct {
+	APIToken
+	SecretSHA256 string `json:"secretSHA256"`
+}
+
+// tokenStore 発行したAPIトークンをファイルに保存して管理する
+type tokenStore struct {
+	path string
+
+	lock   sync.Mutex
+	tokens map[string]tokenRecord
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	store := &tokenStore{path: path, tokens: map[string]tokenRecord{}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []tokenRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("APIトークンの読み込みに失敗しました %v: %v", path, err)
+	}
+	for _, record := range records {
+		store.tokens[record.ID] = record
+	}
+	return store, nil
+}
+
+// save 呼び出し側でロックしておくこと
+func (store *tokenStore) save() error {
+	records := make([]tokenRecord, 0, len(store.tokens))
+	for _, record := range store.tokens {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, b)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issue APIトークンを発行する。トークンは "ID.シークレット" の形式
+func (store *tokenStore) issue(token APIToken) (IssuedToken, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return IssuedToken{}, err
+	}
+	sum := sha256.Sum256([]byte(secret))
+
+	token.ID = id
+	token.CreatedAt = time.Now()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.tokens[id] = tokenRecord{APIToken: token, SecretSHA256: hex.EncodeToString(sum[:])}
+	if err := store.save(); err != nil {
+		delete(store.tokens, id)
+		return IssuedToken{}, err
+	}
+	return IssuedToken{APIToken: token, Token: id + "." + secret}, nil
+}
+
+// list 発行済みのAPIトークンを発行日時順に取得する
+func (store *tokenStore) list() []APIToken {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	tokens := make([]APIToken, 0, len(store.tokens))
+	for _, record := range store.tokens {
+		tokens = append(tokens, record.APIToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// revoke APIトークンを無効にする
+func (store *tokenStore) revoke(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	record, ok := store.tokens[id]
+	if !ok {
+		return fmt.Errorf("APIトークン %v は存在しません", id)
+	}
+	delete(store.tokens, id)
+	if err := store.save(); err != nil {
+		store.tokens[id] = record
+		return err
+	}
+	return nil
+}
+
+// authenticate APIトークンを検証する
+func (store *tokenStore) authenticate(token string) (Identity, error) {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return Identity{}, errUnauthorized
+	}
+	id, secret := token[:i], token[i+1:]
+
+	store.lock.Lock()
+	record, ok := store.tokens[id]
+	store.lock.Unlock()
+	if !ok || record.expired(time.Now()) {
+		return Identity{}, errUnauthorized
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(record.SecretSHA256)) != 1 {
+		return Identity{}, errUnauthorized
+	}
+
+	return Identity{User: "token:" + record.Name, Role: RoleUploader, UploadOnly: true, ContentIDPrefix: record.Prefix}, nil
+}
+
+// tokenRequest /api/tokens で発行するAPIトークンの指定
+type tokenRequest struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// ExpiresIn 有効期間。例: 720h。省略した場合は無期限
+	ExpiresIn string `json:"expiresIn"`
+}
+
+func (server *LogServer) tokenCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("APIトークンの指定をJSONとして読み込めません: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "nameを指定してください", http.StatusBadRequest)
+		return
+	}
+
+	token := APIToken{Name: req.Name, Prefix: req.Prefix, CreatedBy: requestUser(r)}
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, fmt.Sprintf("expiresInの指定が不正です: %v", req.ExpiresIn), http.StatusBadRequest)
+			return
+		}
+		token.ExpiresAt = time.Now().Add(expiresIn)
+	}
+
+	issued, err := server.tokens.issue(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONWithStatus(w, http.StatusCreated, issued)
+}
+
+func (server *LogServer) tokenListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server.tokens.list())
+}
+
+func (server *LogServer) tokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	err := server.tokens.revoke(mux.Vars(r)["tokenID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
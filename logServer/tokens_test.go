@@ -0,0 +1,128 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIToken(t *testing.T) {
+	dir := t.TempDir()
+	userFilePath := filepath.Join(dir, "users.htpasswd")
+	writeUserFile(t, userFilePath, map[string]string{"root": "admin"})
+	userFile, err := LoadUserFile(userFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAuthenticator(userFile)
+	handler := server.NewHTTPHandler()
+
+	do := func(token string, method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token == "" {
+			req.SetBasicAuth("root", "root")
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("", http.MethodPost, "/api/tokens", `{"name":"ci-agent","prefix":"ci-","expiresIn":"1h"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatal(rec.Body.String())
+	}
+	var issued IssuedToken
+	json.NewDecoder(rec.Body).Decode(&issued)
+	if issued.Token == "" || issued.CreatedBy != "root" || issued.ExpiresAt.IsZero() {
+		t.Fatal("発行したAPIトークンが不正です:", issued)
+	}
+
+	// 接頭辞に一致するコンテンツIDにのみアップロードできる
+	rec = do(issued.Token, http.MethodPost, "/upload/ci-run.log", "log")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var info ArtifactInfo
+	json.NewDecoder(rec.Body).Decode(&info)
+	if info.User != "token:ci-agent" {
+		t.Fatal("アップロードしたトークンが記録されていません:", info)
+	}
+	if rec := do(issued.Token, http.MethodPost, "/upload/other.log", "log"); rec.Code != http.StatusForbidden {
+		t.Fatal("接頭辞に一致しないコンテンツIDにアップロードできています:", rec.Code)
+	}
+
+	// アップロード以外の操作はできない
+	if rec := do(issued.Token, http.MethodGet, "/files/ci-run.log", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("アップロード専用のトークンで参照できています:", rec.Code)
+	}
+	if rec := do(issued.Token, http.MethodGet, "/api/tokens", ""); rec.Code != http.StatusForbidden {
+		t.Fatal("アップロード専用のトークンでトークンの一覧が取得できています:", rec.Code)
+	}
+	for _, target := range []struct{ method, path, body string }{
+		{http.MethodPut, "/upload/ci-run.log", "overwrite"},
+		{http.MethodPost, "/api/sign/ci-run.log", ""},
+		{http.MethodPut, "/api/artifacts/ci-run.log/tags", `{"result":"ok"}`},
+		{http.MethodPut, "/api/artifacts/ci-run.log/versions/1/pin", ""},
+		{http.MethodDelete, "/api/artifacts/ci-run.log/versions/1/pin", ""},
+		{http.MethodPost, "/api/trash/0123456789abcdef/restore", ""},
+	} {
+		if rec := do(issued.Token, target.method, target.path, target.body); rec.Code != http.StatusForbidden {
+			t.Fatal("アップロード専用のトークンで実行できています:", target.method, target.path, rec.Code)
+		}
+	}
+
+	// 分割アップロードとライブログの送信はできる
+	if rec := do(issued.Token, http.MethodPost, "/uploads/ci-chunked.log", ""); rec.Code != http.StatusCreated {
+		t.Fatal("アップロード専用のトークンで分割アップロードを開始できません:", rec.Code)
+	}
+	if rec := do(issued.Token, http.MethodPost, "/live/ci-task?offset=0", "line\n"); rec.Code != http.StatusOK {
+		t.Fatal("アップロード専用のトークンでライブログを送信できません:", rec.Code)
+	}
+	if rec := do(issued.Token+"x", http.MethodPost, "/upload/ci-run2.log", "log"); rec.Code != http.StatusUnauthorized {
+		t.Fatal("誤ったトークンでアップロードできています:", rec.Code)
+	}
+
+	// 一覧にトークン本体は含まれない
+	rec = do("", http.MethodGet, "/api/tokens", "")
+	if strings.Contains(rec.Body.String(), issued.Token) || !strings.Contains(rec.Body.String(), issued.ID) {
+		t.Fatal("トークンの一覧が不正です:", rec.Body.String())
+	}
+
+	// 発行したトークンは保存され、再起動後も使用できる
+	reloaded, err := newTokenStore(server.fileCtrl.reservedPath("tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.authenticate(issued.Token); err != nil {
+		t.Fatal("保存したトークンが使用できません:", err)
+	}
+
+	// 無効にしたトークンは使用できない
+	if rec := do("", http.MethodDelete, "/api/tokens/"+issued.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(issued.Token, http.MethodPost, "/upload/ci-run2.log", "log"); rec.Code != http.StatusUnauthorized {
+		t.Fatal("無効にしたトークンでアップロードできています:", rec.Code)
+	}
+
+	// 有効期限切れのトークンは使用できない
+	expired, err := server.tokens.issue(APIToken{Name: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(expired.Token, http.MethodPost, "/upload/ci-run2.log", "log"); rec.Code != http.StatusUnauthorized {
+		t.Fatal("有効期限切れのトークンでアップロードできています:", rec.Code)
+	}
+}
@@ -0,0 +1,402 @@
+package logServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultTrashPurgeDelay ゴミ箱に移したファイルを完全に削除するまでの期間の既定値
+const defaultTrashPurgeDelay = 7 * 24 * time.Hour
+
+var (
+	// errTrashNotFound 指定したIDのファイルがゴミ箱に存在しない
+	errTrashNotFound = errors.New("ゴミ箱に存在しません")
+	// errTrashBusy 指定したIDのファイルを復元または完全に削除している最中
+	errTrashBusy = errors.New("処理中のため操作できません")
+)
+
+// TrashedArtifact ゴミ箱に移したファイル
+type TrashedArtifact struct {
+	ArtifactInfo
+	TrashID   string    `json:"trashID"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	// Versions 一緒にゴミ箱に移した過去の版の番号
+	Versions []int `json:"versions,omitempty"`
+	// PurgeAt この日時以降の保持ポリシーの適用時に完全に削除する。一覧取得時に設定する
+	PurgeAt time.Time `json:"purgeAt,omitempty"`
+}
+
+func (ctrl *fileControl) trashPrefix(id string) string {
+	return reservedDirName + "/trash/" + id + "/"
+}
+
+func (ctrl *fileControl) trashMetaKey(id string) string {
+	return ctrl.trashPrefix(id) + "meta.json"
+}
+
+func (ctrl *fileControl) trashDataKey(id string) string {
+	return ctrl.trashPrefix(id) + "data"
+}
+
+func (ctrl *fileControl) trashVersionKey(id string, version int) string {
+	return fmt.Sprintf("%sversions/v%d", ctrl.trashPrefix(id), version)
+}
+
+// trash ファイルを過去の版と合わせてゴミ箱に移す
+// 保存先での移動は時間がかかる場合があるため、commitと同様に名前を予約してから排他の外で行う
+func (ctrl *fileControl) trash(name string, user string) (TrashedArtifact, error) {
+	ctrl.commitLock.Lock()
+	if ctrl.committing[name] {
+		ctrl.commitLock.Unlock()
+		return TrashedArtifact{}, fmt.Errorf("%v は保存中のため削除できません", name)
+	}
+	ctrl.committing[name] = true
+	ctrl.commitLock.Unlock()
+
+	defer func() {
+		ctrl.commitLock.Lock()
+		delete(ctrl.committing, name)
+		ctrl.commitLock.Unlock()
+	}()
+
+	info, err := ctrl.info(name)
+	if err != nil {
+		return TrashedArtifact{}, fmt.Errorf("%v は存在しないため削除できません", name)
+	}
+	archived, err := ctrl.archivedVersions(name)
+	if err != nil {
+		return TrashedArtifact{}, err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return TrashedArtifact{}, err
+	}
+	item := TrashedArtifact{ArtifactInfo: info, TrashID: id, DeletedAt: time.Now(), DeletedBy: user}
+	for _, version := range archived {
+		item.Versions = append(item.Versions, version.Version)
+	}
+
+	// 途中で失敗しても復元できるよう、ゴミ箱の情報を先に書いておく
+	b, err := json.Marshal(item)
+	if err != nil {
+		return TrashedArtifact{}, err
+	}
+	err = ctrl.storage.Put(ctrl.trashMetaKey(id), bytes.NewReader(b))
+	if err != nil {
+		return TrashedArtifact{}, err
+	}
+
+	for _, version := range item.Versions {
+		err = moveObject(ctrl.storage, ctrl.versionKey(name, version), ctrl.trashVersionKey(id, version))
+		if err == nil {
+			err = moveObject(ctrl.storage, ctrl.versionMetaKey(name, version), ctrl.trashVersionKey(id, version)+".json")
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = moveObject(ctrl.storage, name, ctrl.trashDataKey(id))
+	}
+	if err != nil {
+		ctrl.untrash(item)
+		return TrashedArtifact{}, err
+	}
+
+	ctrl.storage.Delete(ctrl.makeMetaKey(name))
+	return item, nil
+}
+
+// untrash ゴミ箱に移したファイルと過去の版を元に戻す
+// 移動済みでないものは飛ばす。途中で失敗した場合は戻したものをゴミ箱へ移し直すため、繰り返し呼び出せる
+func (ctrl *fileControl) untrash(item TrashedArtifact) (err error) {
+	type movement struct{ src, dst string }
+	var moved []movement
+	wroteInfo := false
+	name := item.ContentID
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(moved) - 1; i >= 0; i-- {
+			if undoErr := moveObject(ctrl.storage, moved[i].dst, moved[i].src); undoErr != nil {
+				log.Printf("ゴミ箱から戻す処理の取り消しに失敗しました %v → %v: %v", moved[i].dst, moved[i].src, undoErr)
+			}
+		}
+		// ファイルが残っている場合はメタデータも残す
+		if wroteInfo && !ctrl.exists(name) {
+			ctrl.storage.Delete(ctrl.makeMetaKey(name))
+		}
+	}()
+
+	move := func(src string, dst string) error {
+		err := moveObject(ctrl.storage, src, dst)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err == nil {
+			moved = append(moved, movement{src: src, dst: dst})
+		}
+		return err
+	}
+
+	for _, version := range item.Versions {
+		if err := move(ctrl.trashVersionKey(item.TrashID, version), ctrl.versionKey(name, version)); err != nil {
+			return err
+		}
+		if err := move(ctrl.trashVersionKey(item.TrashID, version)+".json", ctrl.versionMetaKey(name, version)); err != nil {
+			return err
+		}
+	}
+
+	// 保存時と同様にメタデータを先に書く
+	if err := ctrl.writeInfo(item.ArtifactInfo); err != nil {
+		return err
+	}
+	wroteInfo = true
+	if err := move(ctrl.trashDataKey(item.TrashID), name); err != nil {
+		return err
+	}
+
+	// ファイルは戻せているため、ゴミ箱の情報を削除できなくても失敗とはしない
+	if err := ctrl.storage.Delete(ctrl.trashMetaKey(item.TrashID)); err != nil {
+		log.Printf("ゴミ箱の情報の削除に失敗しました %v: %v", item.TrashID, err)
+	}
+	return nil
+}
+
+// trashedArtifact ゴミ箱に移したファイルの情報を取得する
+func (ctrl *fileControl) trashedArtifact(id string) (TrashedArtifact, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return TrashedArtifact{}, fmt.Errorf("%v %w", id, errTrashNotFound)
+	}
+	b, err := readAll(ctrl.storage, ctrl.trashMetaKey(id))
+	if err != nil {
+		return TrashedArtifact{}, fmt.Errorf("%v %w", id, errTrashNotFound)
+	}
+	var item TrashedArtifact
+	if err := json.Unmarshal(b, &item); err != nil {
+		return TrashedArtifact{}, err
+	}
+	return item, nil
+}
+
+// restore ゴミ箱のファイルを元に戻す。同じコンテンツIDのファイルが存在する場合は戻さない
+// trashと同様に、名前とゴミ箱のIDを予約してから排他の外で移動する
+func (ctrl *fileControl) restore(id string) (ArtifactInfo, error) {
+	item, err := ctrl.trashedArtifact(id)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+
+	busyKey := ctrl.trashPrefix(id)
+	ctrl.commitLock.Lock()
+	if ctrl.committing[busyKey] {
+		ctrl.commitLock.Unlock()
+		return ArtifactInfo{}, fmt.Errorf("%v %w", id, errTrashBusy)
+	}
+	if ctrl.committing[item.ContentID] || ctrl.exists(item.ContentID) {
+		ctrl.commitLock.Unlock()
+		return ArtifactInfo{}, fmt.Errorf("%v %w", item.ContentID, errArtifactExists)
+	}
+	ctrl.committing[busyKey] = true
+	ctrl.committing[item.ContentID] = true
+	ctrl.commitLock.Unlock()
+
+	defer func() {
+		ctrl.commitLock.Lock()
+		delete(ctrl.committing, busyKey)
+		delete(ctrl.committing, item.ContentID)
+		ctrl.commitLock.Unlock()
+	}()
+
+	// 予約するまでの間に完全に削除されている場合がある
+	if _, err := ctrl.trashedArtifact(id); err != nil {
+		return ArtifactInfo{}, err
+	}
+	archived, err := ctrl.archivedVersions(item.ContentID)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	for _, version := range archived {
+		if !ctrl.belongsToTrash(item, version.Version) {
+			return ArtifactInfo{}, fmt.Errorf("%v の過去の版が存在するため復元できません: %w", item.ContentID, errArtifactExists)
+		}
+	}
+
+	if err := ctrl.untrash(item); err != nil {
+		return ArtifactInfo{}, err
+	}
+	return item.ArtifactInfo, nil
+}
+
+// belongsToTrash 保存されている過去の版が、前回の復元の途中でゴミ箱から戻したものか
+// 取り消しにも失敗して残った版であれば、復元をやり直せるようにする
+func (ctrl *fileControl) belongsToTrash(item TrashedArtifact, version int) bool {
+	for _, v := range item.Versions {
+		if v == version {
+			return !ctrl.exists(ctrl.trashVersionKey(item.TrashID, version))
+		}
+	}
+	return false
+}
+
+// purgeTrash ゴミ箱のファイルを完全に削除する
+// 削除は時間がかかる場合があるため、ゴミ箱のIDを予約してから排他の外で行う
+func (ctrl *fileControl) purgeTrash(id string) (TrashedArtifact, error) {
+	busyKey := ctrl.trashPrefix(id)
+	ctrl.commitLock.Lock()
+	if ctrl.committing[busyKey] {
+		ctrl.commitLock.Unlock()
+		return TrashedArtifact{}, fmt.Errorf("%v %w", id, errTrashBusy)
+	}
+	ctrl.committing[busyKey] = true
+	ctrl.commitLock.Unlock()
+
+	defer func() {
+		ctrl.commitLock.Lock()
+		delete(ctrl.committing, busyKey)
+		ctrl.commitLock.Unlock()
+	}()
+
+	item, err := ctrl.trashedArtifact(id)
+	if err != nil {
+		return item, err
+	}
+	objects, err := ctrl.storage.List(ctrl.trashPrefix(id))
+	if err != nil {
+		return item, err
+	}
+
+	// 途中で失敗しても一覧に残るよう、ゴミ箱の情報は最後に削除する
+	metaKey := ctrl.trashMetaKey(id)
+	for _, obj := range objects {
+		if obj.Key == metaKey {
+			continue
+		}
+		if err := ctrl.storage.Delete(obj.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return item, err
+		}
+	}
+	return item, ctrl.storage.Delete(metaKey)
+}
+
+// listTrash ゴミ箱のファイルを削除日時の新しい順に取得する
+func (ctrl *fileControl) listTrash() ([]TrashedArtifact, error) {
+	objects, err := ctrl.storage.List(reservedDirName + "/trash/")
+	if err != nil {
+		return nil, err
+	}
+
+	items := []TrashedArtifact{}
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, "/meta.json") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(obj.Key, reservedDirName+"/trash/"), "/meta.json")
+		item, err := ctrl.trashedArtifact(id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// SetTrashPurgeDelay 削除したファイルをゴミ箱に残しておく期間を設定する
+// 期間を過ぎたファイルは保持ポリシーの適用時に完全に削除する
+func (server *LogServer) SetTrashPurgeDelay(delay time.Duration) {
+	server.retentionLock.Lock()
+	defer server.retentionLock.Unlock()
+	server.trashPurgeDelay = delay
+}
+
+// listTrash ゴミ箱のファイルを完全に削除する日時を付けて取得する
+func (server *LogServer) listTrash() ([]TrashedArtifact, error) {
+	items, err := server.fileCtrl.listTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	server.retentionLock.Lock()
+	delay := server.trashPurgeDelay
+	server.retentionLock.Unlock()
+	for i := range items {
+		items[i].PurgeAt = items[i].DeletedAt.Add(delay)
+	}
+	return items, nil
+}
+
+// expiredTrash 完全に削除する日時を過ぎたゴミ箱のファイル
+func (server *LogServer) expiredTrash(now time.Time) ([]TrashedArtifact, error) {
+	items, err := server.listTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []TrashedArtifact{}
+	for _, item := range items {
+		if !now.Before(item.PurgeAt) {
+			expired = append(expired, item)
+		}
+	}
+	return expired, nil
+}
+
+// trashErrorStatus ゴミ箱の操作時のエラーに対応するステータスコード
+func trashErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTrashNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errArtifactExists), errors.Is(err, errTrashBusy):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (server *LogServer) trashListHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := server.listTrash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, items)
+}
+
+func (server *LogServer) trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := server.fileCtrl.restore(mux.Vars(r)["trashID"])
+	if err != nil {
+		http.Error(w, err.Error(), trashErrorStatus(err))
+		return
+	}
+	server.artifactSaved(info)
+	setAuditArtifact(r, info)
+	server.publish(Event{Type: EventArtifactRestored, User: requestUser(r), Artifact: info})
+	writeJSON(w, info)
+}
+
+func (server *LogServer) trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	item, err := server.fileCtrl.purgeTrash(mux.Vars(r)["trashID"])
+	if err != nil {
+		http.Error(w, err.Error(), trashErrorStatus(err))
+		return
+	}
+	setAuditArtifact(r, item.ArtifactInfo)
+	writeJSON(w, item)
+}
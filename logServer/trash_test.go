@@ -0,0 +1,304 @@
+package logServer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	do := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("ci", "")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do(http.MethodPost, "/upload/run.log", "first")
+	do(http.MethodPut, "/upload/run.log", "second")
+
+	// 削除したファイルは過去の版と合わせてゴミ箱に移る
+	rec := do(http.MethodPost, "/delete/run.log", "")
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	var deleted TrashedArtifact
+	json.NewDecoder(rec.Body).Decode(&deleted)
+	if deleted.TrashID == "" || deleted.DeletedBy != "ci" || deleted.Version != 2 || len(deleted.Versions) != 1 {
+		t.Fatal("ゴミ箱に移したファイルの情報が不正です:", deleted)
+	}
+	if rec := do(http.MethodGet, "/files/run.log", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("削除したファイルが取得できています:", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/api/trash", "")
+	var items []TrashedArtifact
+	json.NewDecoder(rec.Body).Decode(&items)
+	if len(items) != 1 || items[0].TrashID != deleted.TrashID || !items[0].PurgeAt.Equal(items[0].DeletedAt.Add(defaultTrashPurgeDelay)) {
+		t.Fatal("ゴミ箱の一覧が不正です:", items)
+	}
+
+	// 元に戻すと過去の版も戻る
+	if rec := do(http.MethodPost, "/api/trash/"+deleted.TrashID+"/restore", ""); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/files/run.log", ""); rec.Body.String() != "second" {
+		t.Fatal("元に戻したファイルが取得できません:", rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/files/run.log@v1", ""); rec.Body.String() != "first" {
+		t.Fatal("元に戻した過去の版が取得できません:", rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/api/trash/"+deleted.TrashID+"/restore", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("元に戻したファイルがゴミ箱に残っています:", rec.Code)
+	}
+
+	// 同じコンテンツIDのファイルがある場合は元に戻せない
+	rec = do(http.MethodPost, "/delete/run.log", "")
+	json.NewDecoder(rec.Body).Decode(&deleted)
+	do(http.MethodPost, "/upload/run.log", "new")
+	if rec := do(http.MethodPost, "/api/trash/"+deleted.TrashID+"/restore", ""); rec.Code != http.StatusConflict {
+		t.Fatal("同じコンテンツIDのファイルがあるのに元に戻せています:", rec.Code)
+	}
+
+	// 期間を過ぎたゴミ箱のファイルは保持ポリシーの適用時に完全に削除される
+	report, err := server.SweepRetention(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PurgedTrash) != 0 {
+		t.Fatal("期間内のファイルが削除対象になっています:", report.PurgedTrash)
+	}
+	server.SetTrashPurgeDelay(0)
+	report, err = server.SweepRetention(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PurgedTrash) != 1 || report.PurgedTrash[0].TrashID != deleted.TrashID {
+		t.Fatal("ゴミ箱のファイルが削除されていません:", report.PurgedTrash)
+	}
+	if items, _ := server.listTrash(); len(items) != 0 {
+		t.Fatal("ゴミ箱が空になっていません:", items)
+	}
+	if objects, _ := server.fileCtrl.storage.List(reservedDirName + "/trash/"); len(objects) != 0 {
+		t.Fatal("ゴミ箱のファイルが残っています:", objects)
+	}
+}
+
+func TestTrashExcludedFromMaxTotalBytes(t *testing.T) {
+	server, err := NewLogServerWithStorage(NewMemoryStorage(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, name := range []string{"old.log", "new.log"} {
+		if _, err := server.fileCtrl.saveWithInfo(name, strings.NewReader("0123456789"), uploadInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := server.fileCtrl.trash("old.log", "ci"); err != nil {
+		t.Fatal(err)
+	}
+
+	// ゴミ箱のファイルは合計サイズに含めないため、上限内の最新版は削除されない
+	server.SetRetentionPolicy(RetentionPolicy{MaxTotalBytes: 10})
+	report, err := server.SweepRetention(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Candidates) != 0 || report.TotalBytes != 10 || report.TrashBytes != 10 {
+		t.Fatal("保持ポリシーの適用結果が不正です:", report)
+	}
+}
+
+// blockingMoveStorage 指定したキーの移動をreleaseがcloseされるまで止めるStorage
+type blockingMoveStorage struct {
+	*MemoryStorage
+	blockKey string
+	moving   chan struct{}
+	release  chan struct{}
+}
+
+func (storage *blockingMoveStorage) Move(src string, dst string) error {
+	if src == storage.blockKey {
+		close(storage.moving)
+		<-storage.release
+	}
+	return storage.MemoryStorage.Move(src, dst)
+}
+
+func TestTrashMoveOutsideLock(t *testing.T) {
+	storage := &blockingMoveStorage{MemoryStorage: NewMemoryStorage(), blockKey: "slow.zip", moving: make(chan struct{}), release: make(chan struct{})}
+	fileCtrl, err := newFileControlWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCtrl.save("slow.zip", strings.NewReader("slow")); err != nil {
+		t.Fatal(err)
+	}
+
+	trashed := make(chan error)
+	go func() {
+		_, err := fileCtrl.trash("slow.zip", "ci")
+		trashed <- err
+	}()
+	<-storage.moving
+
+	// ゴミ箱へ移動中も他のファイルは保存でき、移動中のファイルは保存できない
+	if err := fileCtrl.save("other.zip", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCtrl.save("slow.zip", strings.NewReader("new")); !errors.Is(err, errArtifactExists) {
+		t.Fatal("移動中のファイルが保存できています:", err)
+	}
+
+	close(storage.release)
+	if err := <-trashed; err != nil {
+		t.Fatal(err)
+	}
+	if fileCtrl.exists("slow.zip") {
+		t.Fatal("ゴミ箱に移動されていません")
+	}
+}
+
+// failingMovesStorage 指定したキーからの移動に失敗するStorage
+type failingMovesStorage struct {
+	*MemoryStorage
+	lock     sync.Mutex
+	failKeys map[string]bool
+}
+
+func (storage *failingMovesStorage) setFailKeys(keys ...string) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.failKeys = map[string]bool{}
+	for _, key := range keys {
+		storage.failKeys[key] = true
+	}
+}
+
+func (storage *failingMovesStorage) Move(src string, dst string) error {
+	storage.lock.Lock()
+	fail := storage.failKeys[src]
+	storage.lock.Unlock()
+	if fail {
+		return errors.New("move failed")
+	}
+	return storage.MemoryStorage.Move(src, dst)
+}
+
+func TestTrashRestoreRetry(t *testing.T) {
+	storage := &failingMovesStorage{MemoryStorage: NewMemoryStorage()}
+	fileCtrl, err := newFileControlWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCtrl.save("run.log", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "second")
+	if err := ioutil.WriteFile(src, []byte("second"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fileCtrl.commit("run.log", src, "", uploadInfo{}, true); err != nil {
+		t.Fatal(err)
+	}
+	item, err := fileCtrl.trash("run.log", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 途中で失敗した場合は戻した過去の版をゴミ箱へ移し直す
+	storage.setFailKeys(fileCtrl.trashDataKey(item.TrashID))
+	if _, err := fileCtrl.restore(item.TrashID); err == nil {
+		t.Fatal("移動に失敗したのに復元できています")
+	}
+	if archived, _ := fileCtrl.archivedVersions("run.log"); len(archived) != 0 {
+		t.Fatal("戻した過去の版が残っています:", archived)
+	}
+	if fileCtrl.exists(fileCtrl.makeMetaKey("run.log")) {
+		t.Fatal("戻したメタデータが残っています")
+	}
+	if _, err := fileCtrl.trashedArtifact(item.TrashID); err != nil {
+		t.Fatal("ゴミ箱の情報が残っていません:", err)
+	}
+
+	// 取り消しにも失敗して過去の版が残った場合も、同じゴミ箱のものであれば復元をやり直せる
+	storage.setFailKeys(fileCtrl.trashDataKey(item.TrashID), fileCtrl.versionKey("run.log", 1), fileCtrl.versionMetaKey("run.log", 1))
+	if _, err := fileCtrl.restore(item.TrashID); err == nil {
+		t.Fatal("移動に失敗したのに復元できています")
+	}
+	if archived, _ := fileCtrl.archivedVersions("run.log"); len(archived) != 1 {
+		t.Fatal("取り消しに失敗した過去の版が残っていません:", archived)
+	}
+	storage.setFailKeys()
+	info, err := fileCtrl.restore(item.TrashID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 2 {
+		t.Fatal("復元したファイルの情報が不正です:", info)
+	}
+	if archived, _ := fileCtrl.archivedVersions("run.log"); len(archived) != 1 {
+		t.Fatal("過去の版が復元されていません:", archived)
+	}
+	if _, err := fileCtrl.trashedArtifact(item.TrashID); err == nil {
+		t.Fatal("復元したファイルがゴミ箱に残っています")
+	}
+}
+
+func TestTrashRestoreOutsideLock(t *testing.T) {
+	storage := &blockingMoveStorage{MemoryStorage: NewMemoryStorage(), moving: make(chan struct{}), release: make(chan struct{})}
+	fileCtrl, err := newFileControlWithStorage(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCtrl.save("slow.zip", strings.NewReader("slow")); err != nil {
+		t.Fatal(err)
+	}
+	item, err := fileCtrl.trash("slow.zip", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.blockKey = fileCtrl.trashDataKey(item.TrashID)
+	restored := make(chan error)
+	go func() {
+		_, err := fileCtrl.restore(item.TrashID)
+		restored <- err
+	}()
+	<-storage.moving
+
+	// 復元中も他のファイルは保存でき、復元中のファイルの保存とゴミ箱からの削除はできない
+	if err := fileCtrl.save("other.zip", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileCtrl.save("slow.zip", strings.NewReader("new")); !errors.Is(err, errArtifactExists) {
+		t.Fatal("復元中のファイルが保存できています:", err)
+	}
+	if _, err := fileCtrl.purgeTrash(item.TrashID); !errors.Is(err, errTrashBusy) {
+		t.Fatal("復元中のファイルがゴミ箱から削除できています:", err)
+	}
+
+	close(storage.release)
+	if err := <-restored; err != nil {
+		t.Fatal(err)
+	}
+	if !fileCtrl.exists("slow.zip") {
+		t.Fatal("復元されていません")
+	}
+}
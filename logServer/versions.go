@@ -0,0 +1,331 @@
+package logServer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// versionSeparator 過去の版を指定する場合のコンテンツIDと版番号の区切り。例: run.zip@v2
+const versionSeparator = "@v"
+
+var (
+	// errVersionPinned ピン留めされた版は削除できない
+	errVersionPinned = errors.New("ピン留めされているため削除できません")
+	// errLatestVersion 最新版は版の削除の対象にできない
+	errLatestVersion = errors.New("最新版のため版の削除はできません。ファイルごと削除してください")
+)
+
+// ArtifactVersionList /api/artifacts/{contentID}/versions のレスポンス
+type ArtifactVersionList struct {
+	ContentID string `json:"contentID"`
+	Latest    int    `json:"latest"`
+	// Versions 新しい順
+	Versions []ArtifactInfo `json:"versions"`
+}
+
+// VersionedID 版番号付きのコンテンツID
+func (info ArtifactInfo) VersionedID() string {
+	return fmt.Sprintf("%s%s%d", info.ContentID, versionSeparator, info.Version)
+}
+
+// parseVersionedID 版番号付きのコンテンツIDをコンテンツIDと版番号に分ける
+func parseVersionedID(id string) (string, int, bool) {
+	i := strings.LastIndex(id, versionSeparator)
+	if i <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(id[i+len(versionSeparator):])
+	if err != nil || version <= 0 {
+		return "", 0, false
+	}
+	return id[:i], version, true
+}
+
+func (ctrl *fileControl) versionPrefix(name string) string {
+	return reservedDirName + "/versions/" + name + "/"
+}
+
+func (ctrl *fileControl) versionKey(name string, version int) string {
+	return ctrl.versionPrefix(name) + "v" + strconv.Itoa(version)
+}
+
+func (ctrl *fileControl) versionMetaKey(name string, version int) string {
+	return ctrl.versionKey(name, version) + ".json"
+}
+
+func (ctrl *fileControl) writeVersionInfo(info ArtifactInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ctrl.storage.Put(ctrl.versionMetaKey(info.ContentID, info.Version), bytes.NewReader(b))
+}
+
+// archivedVersions 過去の版のメタデータを古い順に取得する
+func (ctrl *fileControl) archivedVersions(name string) ([]ArtifactInfo, error) {
+	objects, err := ctrl.storage.List(ctrl.versionPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []ArtifactInfo{}
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, ".json") {
+			continue
+		}
+		b, err := readAll(ctrl.storage, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		var info ArtifactInfo
+		if err := json.Unmarshal(b, &info); err != nil {
+			return nil, fmt.Errorf("%v の読み込みに失敗しました: %v", obj.Key, err)
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Version < infos[j].Version })
+	return infos, nil
+}
+
+// allArchivedVersions すべてのファイルの過去の版のメタデータを取得する
+func (ctrl *fileControl) allArchivedVersions() (map[string][]ArtifactInfo, error) {
+	objects, err := ctrl.storage.List(reservedDirName + "/versions/")
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, obj := range objects {
+		elems := strings.Split(strings.TrimPrefix(obj.Key, reservedDirName+"/versions/"), "/")
+		names[elems[0]] = true
+	}
+
+	versions := map[string][]ArtifactInfo{}
+	for name := range names {
+		infos, err := ctrl.archivedVersions(name)
+		if err != nil {
+			return nil, err
+		}
+		versions[name] = infos
+	}
+	return versions, nil
+}
+
+// archiveLatest 最新版を過去の版として退避する。退避した版のメタデータを返す
+// 呼び出し側で名前を予約しておくこと
+func (ctrl *fileControl) archiveLatest(name string) (ArtifactInfo, error) {
+	current, err := ctrl.info(name)
+	if err != nil {
+		return current, err
+	}
+
+	err = ctrl.writeVersionInfo(current)
+	if err != nil {
+		return current, err
+	}
+	err = moveObject(ctrl.storage, name, ctrl.versionKey(name, current.Version))
+	if err != nil {
+		ctrl.storage.Delete(ctrl.versionMetaKey(name, current.Version))
+		return current, err
+	}
+	return current, nil
+}
+
+// restoreLatest 退避した版を最新版に戻す
+func (ctrl *fileControl) restoreLatest(info ArtifactInfo) error {
+	err := moveObject(ctrl.storage, ctrl.versionKey(info.ContentID, info.Version), info.ContentID)
+	if err != nil {
+		return err
+	}
+	ctrl.storage.Delete(ctrl.versionMetaKey(info.ContentID, info.Version))
+	return ctrl.writeInfo(info)
+}
+
+// deleteArchivedVersions 過去の版をすべて削除する
+func (ctrl *fileControl) deleteArchivedVersions(name string) error {
+	objects, err := ctrl.storage.List(ctrl.versionPrefix(name))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := ctrl.storage.Delete(obj.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveVersion 指定した名前でファイルを保存する。すでにファイルが存在している場合は過去の版として残して置き換える
+func (ctrl *fileControl) saveVersion(name string, src io.Reader, upload uploadInfo) (ArtifactInfo, error) {
+	if err := validateContentID(name); err != nil {
+		return ArtifactInfo{}, err
+	}
+
+	tempPath, sum, err := ctrl.receive(name, src, upload)
+	if err != nil {
+		return ArtifactInfo{}, err
+	}
+	defer os.Remove(tempPath)
+
+	return ctrl.commit(name, tempPath, sum, upload, true)
+}
+
+// versions 最新版を含むすべての版のメタデータを新しい順に取得する
+func (ctrl *fileControl) versions(name string) ([]ArtifactInfo, error) {
+	if err := validateContentID(name); err != nil {
+		return nil, err
+	}
+
+	infos, err := ctrl.archivedVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	if latest, err := ctrl.info(name); err == nil {
+		infos = append(infos, latest)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("%v は存在しません", name)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Version > infos[j].Version })
+	return infos, nil
+}
+
+// findVersion 指定した版のメタデータと内容を保存しているキーを取得する
+func (ctrl *fileControl) findVersion(name string, version int) (ArtifactInfo, string, error) {
+	if err := validateContentID(name); err != nil {
+		return ArtifactInfo{}, "", err
+	}
+
+	if latest, err := ctrl.info(name); err == nil && latest.Version == version {
+		return latest, name, nil
+	}
+
+	b, err := readAll(ctrl.storage, ctrl.versionMetaKey(name, version))
+	if err != nil {
+		return ArtifactInfo{}, "", fmt.Errorf("%v は存在しません", ArtifactInfo{ContentID: name, Version: version}.VersionedID())
+	}
+	var info ArtifactInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return ArtifactInfo{}, "", err
+	}
+	return info, ctrl.versionKey(name, version), nil
+}
+
+// setPinned 指定した版のピン留めを設定する
+func (ctrl *fileControl) setPinned(name string, version int, pinned bool) (ArtifactInfo, error) {
+	ctrl.commitLock.Lock()
+	defer ctrl.commitLock.Unlock()
+
+	info, key, err := ctrl.findVersion(name, version)
+	if err != nil {
+		return info, err
+	}
+
+	info.Pinned = pinned
+	if key == name {
+		return info, ctrl.writeInfo(info)
+	}
+	return info, ctrl.writeVersionInfo(info)
+}
+
+// purgeVersion 指定した過去の版を削除する。最新版とピン留めされた版は削除できない
+func (ctrl *fileControl) purgeVersion(name string, version int) (ArtifactInfo, error) {
+	ctrl.commitLock.Lock()
+	defer ctrl.commitLock.Unlock()
+
+	info, key, err := ctrl.findVersion(name, version)
+	if err != nil {
+		return info, err
+	}
+	if key == name {
+		return info, fmt.Errorf("%v %w", info.VersionedID(), errLatestVersion)
+	}
+	if info.Pinned {
+		return info, fmt.Errorf("%v %w", info.VersionedID(), errVersionPinned)
+	}
+
+	err = ctrl.storage.Delete(key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return info, err
+	}
+	return info, ctrl.storage.Delete(ctrl.versionMetaKey(name, version))
+}
+
+// versionErrorStatus 版の操作時のエラーに対応するステータスコード
+func versionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errVersionPinned), errors.Is(err, errLatestVersion):
+		return http.StatusConflict
+	default:
+		return http.StatusNotFound
+	}
+}
+
+// parseVersionVar URLで指定された版番号を読み込む
+func parseVersionVar(r *http.Request) (int, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(mux.Vars(r)["version"], "v"))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("版番号の指定が不正です: %v", mux.Vars(r)["version"])
+	}
+	return version, nil
+}
+
+func (server *LogServer) artifactVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	contentID := mux.Vars(r)["contentID"]
+	versions, err := server.fileCtrl.versions(contentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	list := ArtifactVersionList{ContentID: contentID, Versions: versions}
+	if latest, err := server.fileCtrl.info(contentID); err == nil {
+		list.Latest = latest.Version
+	}
+	writeJSON(w, list)
+}
+
+func (server *LogServer) artifactPinHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := parseVersionVar(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := server.fileCtrl.setPinned(mux.Vars(r)["contentID"], version, r.Method == http.MethodPut)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return
+	}
+	setAuditArtifact(r, info)
+	server.publish(Event{Type: EventArtifactUpdated, User: requestUser(r), Artifact: info})
+	writeJSON(w, info)
+}
+
+func (server *LogServer) artifactPurgeVersionHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := parseVersionVar(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := server.fileCtrl.purgeVersion(mux.Vars(r)["contentID"], version)
+	if err != nil {
+		http.Error(w, err.Error(), versionErrorStatus(err))
+		return
+	}
+	setAuditArtifact(r, info)
+	writeJSON(w, info)
+}
@@ -0,0 +1,99 @@
+package logServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArtifactVersions(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	do := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// POSTは既存のファイルを上書きしない
+	if rec := do(http.MethodPost, "/upload/run.log", "first"); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/upload/run.log", "second"); rec.Code != http.StatusConflict {
+		t.Fatal("POSTで上書きできています:", rec.Code)
+	}
+
+	// PUTは過去の版を残して置き換える
+	for _, body := range []string{"second", "third"} {
+		if rec := do(http.MethodPut, "/upload/run.log", body); rec.Code != http.StatusOK {
+			t.Fatal(rec.Body.String())
+		}
+	}
+
+	// 版を指定しない場合は最新版、指定した場合はその版を取得できる
+	if rec := do(http.MethodGet, "/files/run.log", ""); rec.Body.String() != "third" {
+		t.Fatal("最新版が取得できていません:", rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/files/run.log@v1", ""); rec.Body.String() != "first" {
+		t.Fatal("過去の版が取得できていません:", rec.Body.String())
+	}
+
+	rec := do(http.MethodGet, "/api/artifacts/run.log/versions", "")
+	var list ArtifactVersionList
+	json.NewDecoder(rec.Body).Decode(&list)
+	if list.Latest != 3 || len(list.Versions) != 3 || list.Versions[2].Version != 1 {
+		t.Fatal("版の一覧が不正です:", list)
+	}
+
+	// ピン留めした版と最新版は削除できない
+	if rec := do(http.MethodPut, "/api/artifacts/run.log/versions/1/pin", ""); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, "/api/artifacts/run.log/versions/1", ""); rec.Code != http.StatusConflict {
+		t.Fatal("ピン留めした版が削除できています:", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/artifacts/run.log/versions/3", ""); rec.Code != http.StatusConflict {
+		t.Fatal("最新版が削除できています:", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/artifacts/run.log/versions/2", ""); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/files/run.log@v2", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("削除した版が取得できています:", rec.Code)
+	}
+
+	// 保持ポリシーは過去の版の数を制限し、ピン留めした版は残す
+	do(http.MethodPut, "/upload/run.log", "fourth")
+	do(http.MethodPut, "/upload/run.log", "fifth")
+	server.SetRetentionPolicy(RetentionPolicy{MaxVersions: 1})
+	report, err := server.SweepRetention(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Candidates) != 1 || report.Candidates[0].Version != 3 || !report.Candidates[0].Archived {
+		t.Fatal("保持ポリシーの削除対象が不正です:", report.Candidates)
+	}
+	versions, err := server.fileCtrl.versions("run.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Version != 5 || versions[1].Version != 4 || versions[2].Version != 1 {
+		t.Fatal("保持ポリシー適用後の版が不正です:", versions)
+	}
+
+	// ファイルを削除すると過去の版も削除される
+	if rec := do(http.MethodPost, "/delete/run.log", ""); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/api/artifacts/run.log/versions", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("削除したファイルの版が残っています:", rec.Body.String())
+	}
+}
@@ -0,0 +1,307 @@
+package logServer
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/y-akahori-ramen/ue4Runner/ueLog"
+)
+
+// maxViewerLines ビューアーに表示する最大行数
+const maxViewerLines = 50000
+
+// viewerFilter ログビューアーの絞り込み条件
+type viewerFilter struct {
+	categories map[string]bool
+	verbosity  map[ueLog.Verbosity]bool
+	from       time.Time
+	to         time.Time
+}
+
+// ビューアーの日時入力で受け付ける書式
+var viewerTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006.01.02-15.04.05"}
+
+func parseViewerTime(value string) (time.Time, error) {
+	for _, layout := range viewerTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("日時の指定が不正です: %v", value)
+}
+
+// parseViewerFilter クエリパラメータから絞り込み条件を読み込む
+//
+// category カテゴリ名。複数指定可
+// verbosity 出力レベル名。複数指定可
+// from, to 表示する時刻の範囲(UTC)
+func parseViewerFilter(values url.Values) (viewerFilter, error) {
+	filter := viewerFilter{categories: map[string]bool{}, verbosity: map[ueLog.Verbosity]bool{}}
+
+	for _, category := range values["category"] {
+		if category != "" {
+			filter.categories[category] = true
+		}
+	}
+
+	for _, name := range values["verbosity"] {
+		v, ok := ueLog.ParseVerbosity(name)
+		if !ok {
+			return filter, fmt.Errorf("出力レベルの指定が不正です: %v", name)
+		}
+		filter.verbosity[v] = true
+	}
+
+	var err error
+	if v := values.Get("from"); v != "" {
+		if filter.from, err = parseViewerTime(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if filter.to, err = parseViewerTime(v); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter viewerFilter) match(line ueLog.Line) bool {
+	if len(filter.categories) > 0 && !filter.categories[line.Category] {
+		return false
+	}
+	if len(filter.verbosity) > 0 && !filter.verbosity[line.Verbosity] {
+		return false
+	}
+	if !filter.from.IsZero() && (line.Time.IsZero() || line.Time.Before(filter.from)) {
+		return false
+	}
+	if !filter.to.IsZero() && (line.Time.IsZero() || line.Time.After(filter.to)) {
+		return false
+	}
+	return true
+}
+
+// viewerLine ビューアーに表示する1行
+type viewerLine struct {
+	ueLog.Line
+	Class string
+}
+
+// viewerPage ビューアーのテンプレートに渡す内容
+type viewerPage struct {
+	Title      string
+	RawURL     string
+	Categories []string
+	Verbosity  []string
+	Selected   url.Values
+	Lines      []viewerLine
+	TotalLines int
+	Truncated  bool
+	Entries    []ArchiveEntry
+	EntryBase  string
+}
+
+func (page viewerPage) IsSelected(key string, value string) bool {
+	for _, v := range page.Selected[key] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readViewerLines UEログを読み込み、絞り込み条件に一致する行を返す
+// タイムスタンプもカテゴリもない行はコールスタックなどの続きの行として直前の行の時刻・カテゴリ・出力レベルを引き継ぐ
+func readViewerLines(r io.Reader, filter viewerFilter) (lines []viewerLine, categories []string, total int, truncated bool, err error) {
+	categorySet := map[string]bool{}
+	var prev ueLog.Line
+
+	scanner := ueLog.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Line()
+		total++
+
+		if line.Category == "" && line.Time.IsZero() && prev.Number > 0 {
+			line.Time = prev.Time
+			line.Category = prev.Category
+			line.Verbosity = prev.Verbosity
+		} else {
+			prev = line
+		}
+		if line.Category != "" {
+			categorySet[line.Category] = true
+		}
+
+		if !filter.match(line) {
+			continue
+		}
+		if len(lines) >= maxViewerLines {
+			truncated = true
+			continue
+		}
+		lines = append(lines, viewerLine{Line: line, Class: strings.ToLower(line.Verbosity.String())})
+	}
+
+	for category := range categorySet {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	return lines, categories, total, truncated, scanner.Err()
+}
+
+// isViewableEntry ビューアーで表示するテキストファイルか
+func isViewableEntry(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".log", ".txt":
+		return true
+	}
+	return false
+}
+
+func (server *LogServer) viewerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contentID := vars["contentID"]
+	entryPath := vars["entryPath"]
+
+	filter, err := parseViewerFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := viewerPage{Title: contentID, Selected: r.URL.Query()}
+	for v := ueLog.Fatal; v <= ueLog.VeryVerbose; v++ {
+		page.Verbosity = append(page.Verbosity, v.String())
+	}
+
+	var src io.ReadCloser
+	switch {
+	case entryPath != "":
+		// zipアーカイブ内のログ
+		a, err := server.fileCtrl.openArchive(contentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer a.Close()
+
+		f, err := a.find(entryPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		src, err = f.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Title = fmt.Sprintf("%s/%s", contentID, normalizeEntryPath(entryPath))
+		page.RawURL = fmt.Sprintf("/archives/%s/raw/%s", url.PathEscape(contentID), normalizeEntryPath(entryPath))
+	case strings.ToLower(path.Ext(contentID)) == ".zip":
+		// zipアーカイブの場合はログの一覧を表示する
+		a, err := server.fileCtrl.openArchive(contentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer a.Close()
+
+		for _, entry := range a.entries() {
+			if isViewableEntry(entry.Path) {
+				page.Entries = append(page.Entries, entry)
+			}
+		}
+		page.EntryBase = fmt.Sprintf("/view/%s/", url.PathEscape(contentID))
+		page.RawURL = fmt.Sprintf("/files/%s", url.PathEscape(contentID))
+		server.renderViewer(w, page)
+		return
+	default:
+		src, err = server.fileCtrl.open(contentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		page.RawURL = fmt.Sprintf("/files/%s", url.PathEscape(contentID))
+	}
+	defer src.Close()
+
+	page.Lines, page.Categories, page.TotalLines, page.Truncated, err = readViewerLines(src, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	server.renderViewer(w, page)
+}
+
+func (server *LogServer) renderViewer(w http.ResponseWriter, page viewerPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := viewerTemplate.Execute(w, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var viewerTemplate = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; }
+header { position: sticky; top: 0; background: #f4f4f4; border-bottom: 1px solid #ccc; padding: 8px; }
+form { display: flex; flex-wrap: wrap; gap: 8px; align-items: flex-start; }
+select { min-width: 12em; }
+table { border-collapse: collapse; font-family: monospace; font-size: 13px; width: 100%; }
+td { padding: 0 6px; white-space: pre-wrap; word-break: break-all; vertical-align: top; }
+td.num { text-align: right; color: #888; user-select: none; width: 1%; white-space: nowrap; }
+td.num a { color: inherit; text-decoration: none; }
+tr:target { background: #fff3b0; }
+tr.fatal { background: #f8c6c6; font-weight: bold; }
+tr.error { background: #fde2e2; color: #a00; }
+tr.warning { background: #fff6d8; color: #850; }
+tr.verbose, tr.veryverbose { color: #888; }
+</style>
+</head>
+<body>
+<header>
+<div><b>{{.Title}}</b> <a href="{{.RawURL}}">raw</a></div>
+{{if .Entries}}
+</header>
+<ul>
+{{range .Entries}}<li><a href="{{$.EntryBase}}{{.Path}}">{{.Path}}</a> ({{.Size}} bytes)</li>
+{{end}}
+</ul>
+{{else}}
+<form method="get">
+<label>Category<br><select name="category" multiple size="5">
+{{range .Categories}}<option{{if $.IsSelected "category" .}} selected{{end}}>{{.}}</option>
+{{end}}</select></label>
+<label>Verbosity<br><select name="verbosity" multiple size="5">
+{{range .Verbosity}}<option{{if $.IsSelected "verbosity" .}} selected{{end}}>{{.}}</option>
+{{end}}</select></label>
+<label>From (UTC)<br><input type="datetime-local" step="1" name="from" value="{{.Selected.Get "from"}}"></label>
+<label>To (UTC)<br><input type="datetime-local" step="1" name="to" value="{{.Selected.Get "to"}}"></label>
+<div><button type="submit">Filter</button> <a href="?">Clear</a></div>
+</form>
+<div>{{len .Lines}} / {{.TotalLines}} lines{{if .Truncated}} (truncated){{end}}</div>
+</header>
+<table>
+{{range .Lines}}<tr id="L{{.Number}}" class="{{.Class}}"><td class="num"><a href="#L{{.Number}}">{{.Number}}</a></td><td>{{.Raw}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,89 @@
+package logServer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const viewerTestLog = "[2021.05.15-10.20.30:000][  0]LogInit: Display: start\n" +
+	"[2021.05.15-10.20.31:000][  1]LogTemp: Warning: careful\n" +
+	"[2021.05.15-10.20.32:000][  2]LogNet: Error: disconnected\n" +
+	"  at Foo()\n" +
+	"[2021.05.15-10.20.33:000][  3]LogTemp: Display: done\n"
+
+func TestReadViewerLines(t *testing.T) {
+	filter, err := parseViewerFilter(map[string][]string{"category": {"LogNet"}, "verbosity": {"Error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines, categories, total, _, err := readViewerLines(strings.NewReader(viewerTestLog), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || len(categories) != 3 {
+		t.Fatal("読み込み結果が不正です:", total, categories)
+	}
+
+	// コールスタックの行は直前の行のカテゴリを引き継ぐ
+	if len(lines) != 2 || lines[0].Number != 3 || lines[1].Number != 4 {
+		t.Fatal("絞り込み結果が不正です:", lines)
+	}
+
+	// 時刻の範囲で絞り込む
+	filter, err = parseViewerFilter(map[string][]string{"from": {"2021-05-15T10:20:31"}, "to": {"2021-05-15T10:20:31"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, _, _, _, err = readViewerLines(strings.NewReader(viewerTestLog), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Number != 2 {
+		t.Fatal("絞り込み結果が不正です:", lines)
+	}
+
+	_, err = parseViewerFilter(map[string][]string{"verbosity": {"Loud"}})
+	if err == nil {
+		t.Fatal("不正な出力レベルが受け付けられています")
+	}
+}
+
+func TestViewerHandler(t *testing.T) {
+	server, err := NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := server.NewHTTPHandler()
+
+	err = server.fileCtrl.save("run.zip", newTestZip(t, map[string]string{"Saved/Logs/log.txt": viewerTestLog}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// zipアーカイブはログの一覧を表示する
+	req := httptest.NewRequest(http.MethodGet, "/view/run.zip", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `href="/view/run.zip/Saved/Logs/log.txt"`) {
+		t.Fatal("ログの一覧が表示されていません:", rec.Body.String())
+	}
+
+	// エラー行は強調表示され、行番号へのリンクを持つ
+	req = httptest.NewRequest(http.MethodGet, "/view/run.zip/Saved/Logs/log.txt?verbosity=Error", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `<tr id="L3" class="error"><td class="num"><a href="#L3">3</a>`) {
+		t.Fatal("エラー行が表示されていません:", body)
+	}
+	if strings.Contains(body, `id="L2"`) {
+		t.Fatal("絞り込み条件に一致しない行が表示されています")
+	}
+}
@@ -0,0 +1,470 @@
+package logServer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// WebhookEventHeader 通知するイベントの種類を送るヘッダー
+	WebhookEventHeader = "X-LogServer-Event"
+	// WebhookDeliveryHeader 配信ごとのID。再送時も同じIDを送るため受信側で重複を除ける
+	WebhookDeliveryHeader = "X-LogServer-Delivery"
+	// WebhookSignatureHeader 本文のHMAC-SHA256を "sha256=16進数" の形式で送るヘッダー
+	WebhookSignatureHeader = "X-LogServer-Signature"
+
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookBackoff     = time.Second
+	// maxWebhookBackoff 再送間隔の上限
+	maxWebhookBackoff = time.Minute
+	webhookTimeout    = 10 * time.Second
+	// maxWebhookDeliveriesBytes 送信記録のファイルのサイズ上限。超えた分は古い記録から破棄する
+	maxWebhookDeliveriesBytes = 8 * 1024 * 1024
+)
+
+// WebhookSignature Webhookの本文に対する署名
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature 受信したWebhookの署名を検証する
+// signature WebhookSignatureHeaderの値
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(WebhookSignature(secret, body)), []byte(signature))
+}
+
+// Webhook イベントを通知する送信先
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events 通知するイベントの種類。空の場合はすべてのイベントを通知する
+	Events    []string  `json:"events,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// accepts 指定した種類のイベントを通知するか
+func (hook Webhook) accepts(eventType string) bool {
+	if len(hook.Events) == 0 || eventType == EventPing {
+		return true
+	}
+	for _, t := range hook.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatedWebhook /api/webhooks で登録したWebhook
+// Secretは登録時にのみ返す
+type CreatedWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// WebhookDelivery Webhookの送信1回分の記録
+type WebhookDelivery struct {
+	DeliveryID string    `json:"deliveryID"`
+	WebhookID  string    `json:"webhookID"`
+	EventID    int64     `json:"eventID"`
+	EventType  string    `json:"eventType"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhookDispatcher 登録されたWebhookへイベントを送信する
+// 失敗した場合は間隔を倍にしながら再送し、送信のたびに結果を記録する
+type webhookDispatcher struct {
+	path       string
+	deliveries *jsonLinesFile
+	client     *http.Client
+
+	lock        sync.Mutex
+	hooks       map[string]CreatedWebhook
+	maxAttempts int
+	backoff     time.Duration
+
+	// closed closeの後はlockを取得したうえで確認し、新しい送信を開始しない
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newWebhookDispatcher 登録済みのWebhookをpathから読み込む。送信の記録はdeliveriesPathに追記する
+// 送信の記録はmaxWebhookDeliveriesBytesを超えたところで古いものから破棄する
+func newWebhookDispatcher(path string, deliveriesPath string) (*webhookDispatcher, error) {
+	dispatcher := &webhookDispatcher{
+		path:        path,
+		client:      &http.Client{Timeout: webhookTimeout},
+		hooks:       map[string]CreatedWebhook{},
+		maxAttempts: defaultWebhookMaxAttempts,
+		backoff:     defaultWebhookBackoff,
+		stop:        make(chan struct{}),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var hooks []CreatedWebhook
+		if err := json.Unmarshal(b, &hooks); err != nil {
+			return nil, fmt.Errorf("Webhookの読み込みに失敗しました %v: %v", path, err)
+		}
+		for _, hook := range hooks {
+			dispatcher.hooks[hook.ID] = hook
+		}
+	}
+
+	dispatcher.deliveries, err = openRotatingJSONLinesFile(deliveriesPath, maxWebhookDeliveriesBytes)
+	if err != nil {
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+// close 再送待ちの送信を打ち切り、送信中のものが終わるまで待つ
+func (dispatcher *webhookDispatcher) close() {
+	dispatcher.lock.Lock()
+	if dispatcher.closed {
+		dispatcher.lock.Unlock()
+		return
+	}
+	dispatcher.closed = true
+	close(dispatcher.stop)
+	dispatcher.lock.Unlock()
+
+	dispatcher.wg.Wait()
+	dispatcher.deliveries.close()
+}
+
+// save 呼び出し側でロックしておくこと
+func (dispatcher *webhookDispatcher) save() error {
+	hooks := make([]CreatedWebhook, 0, len(dispatcher.hooks))
+	for _, hook := range dispatcher.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+
+	b, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dispatcher.path, b)
+}
+
+// add Webhookを登録する。secretが空の場合は作成する
+func (dispatcher *webhookDispatcher) add(hook Webhook, secret string) (CreatedWebhook, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return CreatedWebhook{}, err
+	}
+	if secret == "" {
+		if secret, err = randomHex(32); err != nil {
+			return CreatedWebhook{}, err
+		}
+	}
+	hook.ID = id
+	hook.CreatedAt = time.Now()
+	created := CreatedWebhook{Webhook: hook, Secret: secret}
+
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	dispatcher.hooks[id] = created
+	if err := dispatcher.save(); err != nil {
+		delete(dispatcher.hooks, id)
+		return CreatedWebhook{}, err
+	}
+	return created, nil
+}
+
+// list 登録済みのWebhookを登録日時順に取得する
+func (dispatcher *webhookDispatcher) list() []Webhook {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	hooks := make([]Webhook, 0, len(dispatcher.hooks))
+	for _, hook := range dispatcher.hooks {
+		hooks = append(hooks, hook.Webhook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+func (dispatcher *webhookDispatcher) get(id string) (CreatedWebhook, bool) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	hook, ok := dispatcher.hooks[id]
+	return hook, ok
+}
+
+// remove Webhookの登録を解除する。再送待ちの送信も打ち切る
+func (dispatcher *webhookDispatcher) remove(id string) error {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	hook, ok := dispatcher.hooks[id]
+	if !ok {
+		return fmt.Errorf("Webhook %v は存在しません", id)
+	}
+	delete(dispatcher.hooks, id)
+	if err := dispatcher.save(); err != nil {
+		dispatcher.hooks[id] = hook
+		return err
+	}
+	return nil
+}
+
+// setRetry 送信に失敗した場合の最大試行回数と最初の再送間隔を設定する
+func (dispatcher *webhookDispatcher) setRetry(maxAttempts int, backoff time.Duration) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	dispatcher.maxAttempts = maxAttempts
+	dispatcher.backoff = backoff
+}
+
+// dispatch イベントを受け付けるすべてのWebhookへ非同期に送信する
+func (dispatcher *webhookDispatcher) dispatch(event Event) {
+	dispatcher.lock.Lock()
+	var hooks []CreatedWebhook
+	for _, hook := range dispatcher.hooks {
+		if hook.accepts(event.Type) && event.Type != EventPing {
+			hooks = append(hooks, hook)
+		}
+	}
+	dispatcher.lock.Unlock()
+
+	for _, hook := range hooks {
+		dispatcher.send(hook, event)
+	}
+}
+
+// send 1つのWebhookへイベントを非同期に送信する。close後は送信しない
+func (dispatcher *webhookDispatcher) send(hook CreatedWebhook, event Event) {
+	// closeのwg.Waitより前にwg.Addが行われるようロックしたうえで確認する
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	if dispatcher.closed {
+		return
+	}
+
+	dispatcher.wg.Add(1)
+	go func() {
+		defer dispatcher.wg.Done()
+		dispatcher.deliver(hook, event)
+	}()
+}
+
+// deliver 成功するか最大試行回数に達するまで送信する
+func (dispatcher *webhookDispatcher) deliver(hook CreatedWebhook, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Print("Webhookの本文の作成に失敗しました:", err)
+		return
+	}
+	deliveryID, err := randomHex(8)
+	if err != nil {
+		log.Print("WebhookのIDの作成に失敗しました:", err)
+		return
+	}
+
+	dispatcher.lock.Lock()
+	maxAttempts, backoff := dispatcher.maxAttempts, dispatcher.backoff
+	dispatcher.lock.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		delivery := WebhookDelivery{DeliveryID: deliveryID, WebhookID: hook.ID, EventID: event.ID, EventType: event.Type, Attempt: attempt, Time: time.Now()}
+		delivery.StatusCode, err = dispatcher.post(hook, event.Type, deliveryID, body)
+		delivery.Success = err == nil
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := dispatcher.deliveries.append(delivery); err != nil {
+			log.Print("Webhookの送信記録の書き込みに失敗しました:", err)
+		}
+
+		if delivery.Success {
+			return
+		}
+		if attempt >= maxAttempts {
+			log.Printf("Webhookの送信に失敗しました %v %v: %v", hook.URL, event.Type, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-dispatcher.stop:
+			return
+		}
+		if _, ok := dispatcher.get(hook.ID); !ok {
+			return
+		}
+		backoff *= 2
+		if backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+// post 署名を付けて本文を送信する。2xx以外のステータスコードは失敗とする
+func (dispatcher *webhookDispatcher) post(hook CreatedWebhook, eventType string, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, eventType)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(hook.Secret, body))
+
+	resp, err := dispatcher.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("レスポンスが不正です: %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliveryHistory Webhookの送信記録を新しい順に最大limit件取得する
+func (dispatcher *webhookDispatcher) deliveryHistory(webhookID string, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := dispatcher.deliveries.scan(func(line []byte) {
+		var delivery WebhookDelivery
+		if json.Unmarshal(line, &delivery) != nil || delivery.WebhookID != webhookID {
+			return
+		}
+		deliveries = append(deliveries, delivery)
+		if len(deliveries) > limit {
+			deliveries = deliveries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return deliveries, nil
+}
+
+// SetWebhookRetry Webhookの送信に失敗した場合の最大試行回数と最初の再送間隔を設定する
+// 再送間隔は失敗するたびに倍にする
+func (server *LogServer) SetWebhookRetry(maxAttempts int, backoff time.Duration) {
+	server.webhooks.setRetry(maxAttempts, backoff)
+}
+
+// webhookRequest /api/webhooks で登録するWebhookの指定
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret 署名に使用する秘密の値。省略した場合は作成する
+	Secret string `json:"secret"`
+}
+
+func (server *LogServer) webhookCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Webhookの指定をJSONとして読み込めません: %v", err), http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, fmt.Sprintf("urlの指定が不正です: %v", req.URL), http.StatusBadRequest)
+		return
+	}
+	for _, t := range req.Events {
+		switch t {
+		case EventArtifactUploaded, EventArtifactDeleted, EventArtifactRestored, EventArtifactUpdated, EventRetentionDeleted:
+		default:
+			http.Error(w, fmt.Sprintf("不明なイベントです: %v", t), http.StatusBadRequest)
+			return
+		}
+	}
+
+	created, err := server.webhooks.add(Webhook{URL: req.URL, Events: req.Events, CreatedBy: requestUser(r)}, req.Secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSONWithStatus(w, http.StatusCreated, created)
+}
+
+func (server *LogServer) webhookListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, server.webhooks.list())
+}
+
+func (server *LogServer) webhookDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	err := server.webhooks.remove(mux.Vars(r)["webhookID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookDeliveriesHandler Webhookの送信記録を新しい順に返す。limitで件数を指定する
+func (server *LogServer) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["webhookID"]
+	if _, ok := server.webhooks.get(id); !ok {
+		http.Error(w, fmt.Sprintf("Webhook %v は存在しません", id), http.StatusNotFound)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			http.Error(w, fmt.Sprintf("limitは1から%vの範囲で指定してください: %v", maxListLimit, v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := server.webhooks.deliveryHistory(id, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, deliveries)
+}
+
+// webhookPingHandler 疎通確認のイベントを指定したWebhookにのみ送信する
+func (server *LogServer) webhookPingHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["webhookID"]
+	hook, ok := server.webhooks.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Webhook %v は存在しません", id), http.StatusNotFound)
+		return
+	}
+
+	event := Event{ID: nextEventID(), Type: EventPing, Time: time.Now(), User: requestUser(r)}
+	server.webhooks.send(hook, event)
+	writeJSONWithStatus(w, http.StatusAccepted, event)
+}
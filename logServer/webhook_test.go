@@ -0,0 +1,231 @@
+package logServer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	// 最初の送信のみ失敗する受信側
+	var lock sync.Mutex
+	var received []Event
+	var deliveryIDs []string
+	var badSignature bool
+	requests := 0
+	secret := "webhook-secret"
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifyWebhookSignature(secret, body, r.Header.Get(WebhookSignatureHeader)) {
+			badSignature = true
+		}
+		requests++
+		deliveryIDs = append(deliveryIDs, r.Header.Get(WebhookDeliveryHeader))
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	server, err := NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetWebhookRetry(3, 10*time.Millisecond)
+	handler := server.NewHTTPHandler()
+
+	do := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("root", "")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	waitReceived := func(count int) []Event {
+		for i := 0; i < 200; i++ {
+			lock.Lock()
+			n := len(received)
+			lock.Unlock()
+			if n >= count {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(received) != count {
+			t.Fatal(len(received), received)
+		}
+		return append([]Event{}, received...)
+	}
+
+	// 不正な指定は登録しない
+	if rec := do(http.MethodPost, "/api/webhooks", `{"url":"ftp://example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Fatal(rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/webhooks", `{"url":"http://example.com","events":["unknown"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatal(rec.Code)
+	}
+
+	rec := do(http.MethodPost, "/api/webhooks", `{"url":"`+receiver.URL+`","events":["artifact.uploaded","artifact.deleted"],"secret":"`+secret+`"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	var created CreatedWebhook
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID == "" || created.Secret != secret || created.CreatedBy != "root" {
+		t.Fatal(created)
+	}
+
+	// 1回目の送信に失敗しても再送される
+	do(http.MethodPost, "/upload/run1.log", "hello")
+	events := waitReceived(1)
+	if events[0].Type != EventArtifactUploaded || events[0].Artifact.ContentID != "run1.log" || events[0].User != "root" {
+		t.Fatal(events[0])
+	}
+	lock.Lock()
+	if requests != 2 || deliveryIDs[0] != deliveryIDs[1] || badSignature {
+		t.Fatal(requests, deliveryIDs, badSignature)
+	}
+	lock.Unlock()
+
+	// 送信記録は新しい順に返す
+	rec = do(http.MethodGet, "/api/webhooks/"+created.ID+"/deliveries", "")
+	var deliveries []WebhookDelivery
+	json.NewDecoder(rec.Body).Decode(&deliveries)
+	if len(deliveries) != 2 || !deliveries[0].Success || deliveries[0].Attempt != 2 || deliveries[1].Success || deliveries[1].StatusCode != http.StatusInternalServerError {
+		t.Fatal(deliveries)
+	}
+
+	// 登録していないイベントは送信しない
+	rec = do(http.MethodPost, "/delete/run1.log", "")
+	var item TrashedArtifact
+	json.NewDecoder(rec.Body).Decode(&item)
+	do(http.MethodPost, "/api/trash/"+item.TrashID+"/restore", "")
+	events = waitReceived(2)
+	if events[1].Type != EventArtifactDeleted || events[1].TrashID != item.TrashID {
+		t.Fatal(events[1])
+	}
+
+	// 疎通確認はイベントの種類の指定によらず送信する
+	if rec := do(http.MethodPost, "/api/webhooks/"+created.ID+"/test", ""); rec.Code != http.StatusAccepted {
+		t.Fatal(rec.Code)
+	}
+	events = waitReceived(3)
+	if events[2].Type != EventPing {
+		t.Fatal(events[2])
+	}
+	server.Close()
+
+	// 登録内容は再起動後も残る
+	server, err = NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler = server.NewHTTPHandler()
+	rec = do(http.MethodGet, "/api/webhooks", "")
+	var hooks []Webhook
+	json.NewDecoder(rec.Body).Decode(&hooks)
+	if len(hooks) != 1 || hooks[0].ID != created.ID || strings.Contains(rec.Body.String(), secret) {
+		t.Fatal(rec.Body.String())
+	}
+
+	if rec := do(http.MethodDelete, "/api/webhooks/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatal(rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/webhooks/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestWebhookDispatcherClose(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	dispatcher, err := newWebhookDispatcher(filepath.Join(dir, "webhooks.json"), filepath.Join(dir, "deliveries.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := dispatcher.add(Webhook{URL: receiver.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// close後の送信は行わず、closeを複数回呼んでも問題ない
+	dispatcher.close()
+	dispatcher.send(hook, Event{ID: 1, Type: EventArtifactUploaded})
+	dispatcher.dispatch(Event{ID: 2, Type: EventArtifactUploaded})
+	dispatcher.close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 0 {
+		t.Fatal("close後に送信されています:", requests)
+	}
+}
+
+func TestWebhookDeliveriesRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	lines, err := openRotatingJSONLinesFile(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lines.close()
+
+	for i := 1; i <= 100; i++ {
+		if err := lines.append(WebhookDelivery{WebhookID: "hook", Attempt: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 上限を超えた古い記録は破棄され、残った記録は古い順に読み込める
+	var attempts []int
+	err = lines.scan(func(line []byte) {
+		var delivery WebhookDelivery
+		json.Unmarshal(line, &delivery)
+		attempts = append(attempts, delivery.Attempt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) == 0 || len(attempts) >= 100 || attempts[len(attempts)-1] != 100 {
+		t.Fatal("送信記録が不正です:", attempts)
+	}
+	for i := 1; i < len(attempts); i++ {
+		if attempts[i] != attempts[i-1]+1 {
+			t.Fatal("送信記録の順序が不正です:", attempts)
+		}
+	}
+	for _, p := range []string{path, path + ".1"} {
+		stat, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() > 400 {
+			t.Fatal("送信記録のファイルが大きすぎます:", p, stat.Size())
+		}
+	}
+}
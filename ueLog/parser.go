@@ -0,0 +1,154 @@
+package ueLog
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verbosity UEログの出力レベル。値はUEのELogVerbosityに合わせている
+type Verbosity int
+
+const (
+	Fatal Verbosity = iota + 1
+	Error
+	Warning
+	Display
+	Log
+	Verbose
+	VeryVerbose
+)
+
+var verbosityNames = map[Verbosity]string{
+	Fatal:       "Fatal",
+	Error:       "Error",
+	Warning:     "Warning",
+	Display:     "Display",
+	Log:         "Log",
+	Verbose:     "Verbose",
+	VeryVerbose: "VeryVerbose",
+}
+
+func (v Verbosity) String() string {
+	if name, ok := verbosityNames[v]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// ParseVerbosity 出力レベル名から出力レベルを得る。大文字小文字は区別しない
+func ParseVerbosity(name string) (Verbosity, bool) {
+	for v, n := range verbosityNames {
+		if strings.EqualFold(n, name) {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// Line 解析したUEログの1行
+type Line struct {
+	// Number 1始まりの行番号
+	Number int
+	// Time 出力時刻(UTC)。タイムスタンプのない行はゼロ値
+	Time time.Time
+	// Frame フレームカウンタ。タイムスタンプのない行は-1
+	Frame int
+	// Category ログカテゴリ。カテゴリのない行は空文字
+	Category  string
+	Verbosity Verbosity
+	Message   string
+	// Raw 行の内容そのまま
+	Raw string
+}
+
+// [2021.05.15-10.20.30:123][  0]LogInit: Display: message
+var (
+	timestampPattern = regexp.MustCompile(`^\[(\d{4}\.\d{2}\.\d{2}-\d{2}\.\d{2}\.\d{2}):(\d{3})\]\[\s*(\d+)\]`)
+	categoryPattern  = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*): (.*)$`)
+)
+
+// ParseLine 1行を解析する
+func ParseLine(raw string) Line {
+	line := Line{Frame: -1, Verbosity: Log, Raw: raw}
+	rest := raw
+
+	if m := timestampPattern.FindStringSubmatch(rest); m != nil {
+		t, err := time.Parse("2006.01.02-15.04.05", m[1])
+		if err == nil {
+			ms, _ := strconv.Atoi(m[2])
+			line.Time = t.Add(time.Duration(ms) * time.Millisecond)
+		}
+		line.Frame, _ = strconv.Atoi(m[3])
+		rest = rest[len(m[0]):]
+	}
+
+	m := categoryPattern.FindStringSubmatch(rest)
+	if m == nil {
+		line.Message = rest
+		return line
+	}
+	line.Category = m[1]
+	rest = m[2]
+
+	// Log以外の出力レベルはカテゴリの後ろに出力される
+	// Fatalは "Fatal error:" と出力されることもある
+	if strings.HasPrefix(rest, "Fatal error: ") {
+		line.Verbosity = Fatal
+		line.Message = rest
+		return line
+	}
+	if i := strings.Index(rest, ": "); i > 0 {
+		if v, ok := ParseVerbosity(rest[:i]); ok {
+			line.Verbosity = v
+			rest = rest[i+2:]
+		}
+	}
+	line.Message = rest
+	return line
+}
+
+// Scanner UEログを1行ずつ解析する
+type Scanner struct {
+	scanner *bufio.Scanner
+	line    Line
+	number  int
+}
+
+// NewScanner 指定したReaderからUEログを読み込むScannerを作成する
+func NewScanner(r io.Reader) *Scanner {
+	scanner := bufio.NewScanner(r)
+	// コールスタックなど長い行が出力されることがあるためバッファを大きめに取る
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &Scanner{scanner: scanner}
+}
+
+// Scan 次の行を読み込む。読み込める行がなくなるかエラーが発生した場合はfalseを返す
+func (s *Scanner) Scan() bool {
+	if !s.scanner.Scan() {
+		return false
+	}
+	s.number++
+
+	raw := strings.TrimRight(s.scanner.Text(), "\r")
+	if s.number == 1 {
+		raw = strings.TrimPrefix(raw, "\ufeff")
+	}
+
+	s.line = ParseLine(raw)
+	s.line.Number = s.number
+	return true
+}
+
+// Line 最後に読み込んだ行
+func (s *Scanner) Line() Line {
+	return s.line
+}
+
+// Err 読み込み中に発生したエラー
+func (s *Scanner) Err() error {
+	return s.scanner.Err()
+}
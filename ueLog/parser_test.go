@@ -0,0 +1,63 @@
+package ueLog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	line := ParseLine("[2021.05.15-10.20.30:123][ 42]LogInit: Warning: something happened")
+	expectedTime := time.Date(2021, 5, 15, 10, 20, 30, 123*int(time.Millisecond), time.UTC)
+	if !line.Time.Equal(expectedTime) || line.Frame != 42 {
+		t.Fatal("タイムスタンプの解析結果が不正です:", line)
+	}
+	if line.Category != "LogInit" || line.Verbosity != Warning || line.Message != "something happened" {
+		t.Fatal("解析結果が不正です:", line)
+	}
+
+	// 出力レベルが省略された行はLog扱い
+	line = ParseLine("LogTemp: hello: world")
+	if line.Category != "LogTemp" || line.Verbosity != Log || line.Message != "hello: world" {
+		t.Fatal("解析結果が不正です:", line)
+	}
+
+	// カテゴリのない行
+	line = ParseLine("Log file open, 05/15/21 10:20:30")
+	if line.Category != "" || line.Frame != -1 || !line.Time.IsZero() || line.Message != "Log file open, 05/15/21 10:20:30" {
+		t.Fatal("解析結果が不正です:", line)
+	}
+
+	line = ParseLine("[2021.05.15-10.20.30:123][  0]LogWindows: Fatal error: [File:Foo.cpp] [Line: 10]")
+	if line.Verbosity != Fatal {
+		t.Fatal("Fatalとして解析されていません:", line)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	log := "\ufeffLog file open\r\n" +
+		"[2021.05.15-10.20.30:123][  0]LogInit: Display: start\r\n" +
+		"[2021.05.15-10.20.31:000][  1]LogTemp: Warning: w1\r\n" +
+		"[2021.05.15-10.20.31:000][  1]LogTemp: Error: e1\r\n" +
+		"[2021.05.15-10.20.31:000][  1]LogNet: Error: e2\r\n" +
+		"[2021.05.15-10.20.32:000][  2]LogTemp: Fatal: f1\r\n" +
+		"[2021.05.15-10.20.32:000][  2]LogTemp: Fatal: f2\r\n"
+
+	summary, err := Summarize(strings.NewReader(log), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Errors != 2 || summary.Warnings != 1 || summary.Fatals != 2 {
+		t.Fatal("集計結果が不正です:", summary)
+	}
+	if summary.Categories["LogTemp"] != (CategoryCount{Fatals: 2, Errors: 1, Warnings: 1}) {
+		t.Fatal("カテゴリごとの集計結果が不正です:", summary.Categories)
+	}
+	if _, ok := summary.Categories["LogInit"]; ok {
+		t.Fatal("Fatal/Error/Warningのないカテゴリが集計されています")
+	}
+	if len(summary.FatalMessages) != 1 || summary.FatalMessages[0] != "f1" {
+		t.Fatal("Fatalのメッセージが不正です:", summary.FatalMessages)
+	}
+}
@@ -0,0 +1,66 @@
+package ueLog
+
+import (
+	"io"
+	"os"
+)
+
+// CategoryCount カテゴリごとのFatal/Error/Warningの出力数
+type CategoryCount struct {
+	Fatals   int `json:"fatals"`
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+}
+
+// Summary UEログの集計結果
+type Summary struct {
+	Fatals   int `json:"fatals"`
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+	// Categories Fatal/Error/Warningが出力されたカテゴリごとの出力数
+	Categories map[string]CategoryCount `json:"categories"`
+	// FatalMessages 先頭から指定数までのFatalのメッセージ
+	FatalMessages []string `json:"fatalMessages"`
+}
+
+// Summarize UEログを読み込み、Fatal/Error/Warningの出力数と先頭からmaxFatalMessages件までのFatalのメッセージを集計する
+func Summarize(r io.Reader, maxFatalMessages int) (Summary, error) {
+	summary := Summary{Categories: map[string]CategoryCount{}, FatalMessages: []string{}}
+
+	scanner := NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Line()
+
+		count := summary.Categories[line.Category]
+		switch line.Verbosity {
+		case Fatal:
+			summary.Fatals++
+			count.Fatals++
+			if len(summary.FatalMessages) < maxFatalMessages {
+				summary.FatalMessages = append(summary.FatalMessages, line.Message)
+			}
+		case Error:
+			summary.Errors++
+			count.Errors++
+		case Warning:
+			summary.Warnings++
+			count.Warnings++
+		default:
+			continue
+		}
+		summary.Categories[line.Category] = count
+	}
+
+	return summary, scanner.Err()
+}
+
+// SummarizeFile 指定したUEログファイルを集計する
+func SummarizeFile(path string, maxFatalMessages int) (Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Summary{Categories: map[string]CategoryCount{}, FatalMessages: []string{}}, err
+	}
+	defer f.Close()
+
+	return Summarize(f, maxFatalMessages)
+}
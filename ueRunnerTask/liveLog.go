@@ -0,0 +1,126 @@
+package ueRunnerTask
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// defaultLiveLogInterval 実行中のUEログを送信する間隔の既定値
+	defaultLiveLogInterval = 2 * time.Second
+	// maxLiveLogChunk 1回で送信する最大サイズ
+	maxLiveLogChunk = 1024 * 1024
+)
+
+// LiveLogStreamer 実行中のUEログを逐次送信できるアップローダー
+type LiveLogStreamer interface {
+	// LiveLogInterval 追記された内容を送信する間隔。0の場合は送信しない
+	LiveLogInterval() time.Duration
+	// AppendLiveLog taskIDのライブログのoffsetの位置からbを送信し、送信先が受信済みのサイズを返す
+	AppendLiveLog(taskID string, offset int64, b []byte) (int64, error)
+	// FinishLiveLog taskIDのライブログを終了し、Uploadでアップロードしたファイルと関連付ける。ライブログを閲覧するURLを返す
+	// path Uploadに指定したファイルパス。アップロードしていない場合は空
+	FinishLiveLog(taskID string, path string) (string, error)
+}
+
+// TailLiveLog pathのファイルに追記された内容を一定間隔でtaskIDのライブログとして送信する
+// sinceより前に更新されたファイルは前回の実行で出力されたものとして扱い、更新されるまで送信しない
+// 行の途中までしか書かれていない場合は改行まで待つ。ctxが完了すると残りをすべて送信して戻る
+func TailLiveLog(ctx context.Context, streamer LiveLogStreamer, taskID string, path string, since time.Time) {
+	interval := streamer.LiveLogInterval()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var offset int64
+	failed := false
+	for {
+		final := false
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			final = true
+		}
+
+		sent, err := sendLiveLog(streamer, taskID, path, since, offset, final)
+		if err != nil {
+			// 送信先が停止している間に同じエラーを出し続けないよう、失敗し始めたときのみ出力する
+			if !failed {
+				log.Printf("[%s]ライブログの送信に失敗しました: %v", taskID, err)
+			}
+			failed = true
+		} else {
+			failed = false
+		}
+		if sent < offset {
+			log.Printf("[%s]UEログ %v が作り直されたためライブログの送信を終了します", taskID, path)
+			return
+		}
+		offset = sent
+
+		if final {
+			return
+		}
+	}
+}
+
+// sendLiveLog offset以降に追記された内容を送信し、送信済みのサイズを返す
+// ファイルがoffsetより小さくなっていた場合はファイルのサイズを返す
+func sendLiveLog(streamer LiveLogStreamer, taskID string, path string, since time.Time, offset int64, final bool) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if stat.ModTime().Before(since) {
+		return offset, nil
+	}
+	if stat.Size() < offset {
+		return stat.Size(), nil
+	}
+
+	buf := make([]byte, maxLiveLogChunk)
+	for offset < stat.Size() {
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 && err != nil && err != io.EOF {
+			return offset, err
+		}
+		b := buf[:n]
+		// 書き込み途中の行は次回に送る
+		if !final {
+			i := bytes.LastIndexByte(b, '\n')
+			if i < 0 {
+				return offset, nil
+			}
+			b = b[:i+1]
+		}
+		if len(b) == 0 {
+			return offset, nil
+		}
+
+		sent, err := streamer.AppendLiveLog(taskID, offset, b)
+		if err != nil {
+			return offset, err
+		}
+		if sent <= offset {
+			// 送信先が受け付けなかった
+			return offset, nil
+		}
+		offset = sent
+	}
+	return offset, nil
+}
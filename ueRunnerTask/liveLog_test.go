@@ -0,0 +1,95 @@
+package ueRunnerTask_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/y-akahori-ramen/ue4Runner/logServer"
+	"github.com/y-akahori-ramen/ue4Runner/ueRunnerTask"
+)
+
+func TestTailLiveLog(t *testing.T) {
+	logSrv, err := logServer.NewLogServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSrv.Close()
+	fileServer := httptest.NewServer(logSrv.NewHTTPHandler())
+	defer fileServer.Close()
+
+	uploader := ueRunnerTask.NewLogServerUploader(fileServer.URL)
+	uploader.SetLiveLogInterval(10 * time.Millisecond)
+
+	// 前回の実行のログは送信しない
+	logPath := filepath.Join(t.TempDir(), "log.txt")
+	err = ioutil.WriteFile(logPath, []byte("previous run\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(logPath, past, past)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	since := time.Now()
+	go func() {
+		defer close(done)
+		ueRunnerTask.TailLiveLog(ctx, &uploader, "task-1", logPath, since)
+	}()
+
+	// UEがログを作り直して追記していく
+	// ファイルの更新時刻の精度を考慮して間を空ける
+	time.Sleep(50 * time.Millisecond)
+	f, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("line1\nline2\nline")
+	f.Sync()
+
+	// 書き込み途中の行は改行まで送らない
+	time.Sleep(100 * time.Millisecond)
+	listResp, err := http.Get(fileServer.URL + "/api/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []logServer.LiveLogStatus
+	json.NewDecoder(listResp.Body).Decode(&list)
+	listResp.Body.Close()
+	if len(list) != 1 || list[0].Size != int64(len("line1\nline2\n")) {
+		t.Fatal(list)
+	}
+	f.WriteString("3")
+	f.Close()
+
+	// 終了時に書き込み途中の行も送る
+	cancel()
+	<-done
+	liveURL, err := uploader.FinishLiveLog("task-1", filepath.Join(t.TempDir(), "task-1.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if liveURL != fileServer.URL+"/live/task-1" {
+		t.Fatal(liveURL)
+	}
+
+	resp, err := http.Get(liveURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "line1\nline2\nline3" {
+		t.Fatal(string(b))
+	}
+}
@@ -0,0 +1,124 @@
+package ueRunnerTask
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// タスクの実行結果
+// freezeとcancelはUEを強制終了した実行で、それまでに出力されたものはアップロードされる
+const (
+	OutcomeSucceeded     = "succeeded"
+	OutcomeFreeze        = "freeze"
+	OutcomeCancel        = "cancel"
+	OutcomeLaunchError   = "launch_error"
+	OutcomeArchiveError  = "archive_error"
+	OutcomeUploadError   = "upload_error"
+	OutcomeInternalError = "internal_error"
+)
+
+// Metrics タスクの実行状況のメトリクス
+// nilの場合は何も記録しない
+type Metrics struct {
+	registry *prometheus.Registry
+
+	started        prometheus.Counter
+	finished       *prometheus.CounterVec
+	busy           prometheus.Gauge
+	runDuration    *prometheus.HistogramVec
+	archiveBytes   prometheus.Histogram
+	uploadDuration *prometheus.HistogramVec
+}
+
+// NewMetrics タスクの実行状況のメトリクスを作成する
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		started: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "taskrunner_tasks_started_total",
+			Help: "開始したタスク数",
+		}),
+		finished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "taskrunner_tasks_finished_total",
+			Help: "実行結果ごとの終了したタスク数",
+		}, []string{"outcome"}),
+		busy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "taskrunner_busy",
+			Help: "実行中のタスク数",
+		}),
+		runDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "taskrunner_ue_run_duration_seconds",
+			Help:    "UEの終了理由ごとの起動から終了までの時間",
+			Buckets: []float64{10, 30, 60, 300, 600, 1800, 3600, 7200, 14400},
+		}, []string{"termination"}),
+		archiveBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "taskrunner_archive_bytes",
+			Help:    "アップロードする実行結果のzipのサイズ",
+			Buckets: prometheus.ExponentialBuckets(1024*1024, 4, 8),
+		}),
+		uploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "taskrunner_upload_duration_seconds",
+			Help:    "成否ごとの実行結果のzipのアップロードにかかった時間",
+			Buckets: []float64{0.5, 1, 5, 15, 60, 300, 900},
+		}, []string{"result"}),
+	}
+
+	// 一度も発生していない結果も0として取得できるようにする
+	for _, outcome := range []string{OutcomeSucceeded, OutcomeFreeze, OutcomeCancel, OutcomeLaunchError, OutcomeArchiveError, OutcomeUploadError, OutcomeInternalError} {
+		metrics.finished.WithLabelValues(outcome)
+	}
+
+	metrics.registry.MustRegister(
+		metrics.started,
+		metrics.finished,
+		metrics.busy,
+		metrics.runDuration,
+		metrics.archiveBytes,
+		metrics.uploadDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return metrics
+}
+
+// Handler /metrics のハンドラー
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// taskStarted タスクの開始を記録する。戻り値の関数にタスクの実行結果を渡して終了を記録する
+func (metrics *Metrics) taskStarted() func(outcome string) {
+	if metrics == nil {
+		return func(string) {}
+	}
+	metrics.started.Inc()
+	metrics.busy.Inc()
+	return func(outcome string) {
+		metrics.busy.Dec()
+		metrics.finished.WithLabelValues(outcome).Inc()
+	}
+}
+
+// ueFinished UEの実行時間を記録する
+func (metrics *Metrics) ueFinished(result ueRunResult) {
+	if metrics == nil {
+		return
+	}
+	metrics.runDuration.WithLabelValues(result.Termination).Observe(result.Duration.Seconds())
+}
+
+// uploaded 実行結果のzipのサイズとアップロードにかかった時間を記録する
+func (metrics *Metrics) uploaded(size int64, duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.archiveBytes.Observe(float64(size))
+	metrics.uploadDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
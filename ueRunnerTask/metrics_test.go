@@ -0,0 +1,38 @@
+package ueRunnerTask_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/y-akahori-ramen/ue4Runner/ueRunnerTask"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := ueRunnerTask.NewMetrics()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal(rec.Code)
+	}
+	b, _ := ioutil.ReadAll(rec.Body)
+	body := string(b)
+
+	// タスクを実行する前から実行結果ごとの値を取得できる
+	for _, expected := range []string{
+		`taskrunner_tasks_started_total 0`,
+		`taskrunner_busy 0`,
+		`taskrunner_tasks_finished_total{outcome="succeeded"} 0`,
+		`taskrunner_tasks_finished_total{outcome="freeze"} 0`,
+		`taskrunner_tasks_finished_total{outcome="cancel"} 0`,
+		`taskrunner_tasks_finished_total{outcome="launch_error"} 0`,
+		`taskrunner_tasks_finished_total{outcome="upload_error"} 0`,
+		`taskrunner_archive_bytes_count 0`,
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Fatal(expected, "\n", body)
+		}
+	}
+}
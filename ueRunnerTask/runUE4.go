@@ -19,6 +19,27 @@ import (
 	"github.com/y-akahori-ramen/ziptool"
 )
 
+// UEの終了理由
+const (
+	// ueExited UEが自ら終了した
+	ueExited = "exited"
+	// ueFrozen UEログが更新されなくなったため強制終了した
+	ueFrozen = "freeze"
+	// ueCanceled 外部からのキャンセルにより強制終了した
+	ueCanceled = "cancel"
+)
+
+// errUELaunch UEを起動できなかった
+var errUELaunch = errors.New("UEを起動できません")
+
+// ueRunResult runUE4の実行結果
+type ueRunResult struct {
+	// Termination UEの終了理由
+	Termination string
+	// Duration UEの起動から終了までの時間
+	Duration time.Duration
+}
+
 // getLatestModTime 指定したディレクトリ以下のうち最も更新時間が最新のものを取得する。ディレクトリが存在しない場合はエラーを返す
 func getLatestModTime(dir_path string) (time.Time, error) {
 	latest_time := time.Time{}
@@ -116,6 +137,17 @@ func terminateUE(exeNameWithoutExt string) error {
 	return nil
 }
 
+// exeBaseName 拡張子を除いたexeファイル名
+func exeBaseName(exe string) string {
+	return filepath.Base(exe[:len(exe)-len(filepath.Ext(exe))])
+}
+
+// savedDirPath 指定したUEパッケージのsavedディレクトリのパス
+// Windowsの場合はexeの同階層にexeファイル名の名前のディレクトリがあり、その中にsavedディレクトリが作られる。
+func savedDirPath(exe string) string {
+	return filepath.Join(filepath.Dir(exe), exeBaseName(exe), "Saved")
+}
+
 // runUE4 UE4パッケージを実行し実行時に出力されたSavedディレクトリ内のファイルを指定された場所にzip出力する
 // この関数はWindowsのみで動作する
 //
@@ -135,33 +167,34 @@ func terminateUE(exeNameWithoutExt string) error {
 // 　UE起動時の追加引数
 // 　フリーズ判定する関係でUEログのファイル名はlogFileNameで渡された名前で固定される
 // 　additionalArgにUEログファイル名指定が含まれる場合はエラーとなる
-func runUE4(ctx context.Context, exe string, logfileName string, outputName string, timeOutDuration time.Duration, additionalArg ...string) error {
+//
+// UEを起動できなかった場合はerrUELaunchを含むエラーを返す
+func runUE4(ctx context.Context, exe string, logfileName string, outputName string, timeOutDuration time.Duration, additionalArg ...string) (ueRunResult, error) {
+	result := ueRunResult{Termination: ueExited}
 
 	// Windowsのみの対応
 	if runtime.GOOS != "windows" {
-		return errors.New("Windows以外からは利用できません")
+		return result, fmt.Errorf("%w: Windows以外からは利用できません", errUELaunch)
 	}
 
 	// 指定のexeは存在しているか
 	stat, err := os.Stat(exe)
 	if os.IsNotExist(err) {
-		return fmt.Errorf("%vは存在しません", exe)
+		return result, fmt.Errorf("%w: %vは存在しません", errUELaunch, exe)
 	}
 	if stat.IsDir() {
-		return fmt.Errorf("%vはディレクトリです。実行可能ファイルを指定してください。", exe)
+		return result, fmt.Errorf("%w: %vはディレクトリです。実行可能ファイルを指定してください。", errUELaunch, exe)
 	}
 
 	// additionalArgにログファイル名を指定するオプションが存在しないか
 	for _, arg := range additionalArg {
 		if strings.Contains(arg, "-log=") {
-			return fmt.Errorf("additionalArgでログファイル名の指定がされています: %v", arg)
+			return result, fmt.Errorf("%w: additionalArgでログファイル名の指定がされています: %v", errUELaunch, arg)
 		}
 	}
 
-	// savedディレクトリのパス作成
-	// Windowsの場合はexeの同階層にexeファイル名の名前のディレクトリがあり、その中にsavedディレクトリが作られる。
-	exeNameWithoutExt := filepath.Base(exe[:len(exe)-len(filepath.Ext(exe))])
-	savedDir := filepath.Join(filepath.Dir(exe), exeNameWithoutExt, "Saved")
+	exeNameWithoutExt := exeBaseName(exe)
+	savedDir := savedDirPath(exe)
 
 	// 起動前にsavedディレクトリ内の更新時刻のうち最も新しい時刻を調べる。
 	// この時刻より後の更新時刻になっているものが今回の起動により作られたファイルとなる。
@@ -183,6 +216,8 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 	// フリーズ判定の開始
 	// 一定時間ファイル更新がないか、contextが完了した場合にUEを強制終了させる。
 	logFilePath := filepath.Join(savedDir, "Logs", logfileName)
+	// 強制終了した理由。監視の終了後に参照する
+	termination := ueExited
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -201,6 +236,7 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 				stat, err := os.Stat(logFilePath)
 				if err != nil {
 					log.Printf("ファイル %s の状態取得に失敗しました。UEを強制終了します。", logFilePath)
+					termination = ueFrozen
 					terminateUE(exeNameWithoutExt)
 					return
 				}
@@ -208,6 +244,7 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 				diff := stat.ModTime().Sub(prev_mod_time)
 				if diff == 0 {
 					log.Printf("ファイル %s が %v 経過しても変化ありませんでした。UEを強制終了します。", logFilePath, timeOutDuration)
+					termination = ueFrozen
 					terminateUE(exeNameWithoutExt)
 					return
 				}
@@ -215,6 +252,7 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 				prev_mod_time = stat.ModTime()
 			case <-ctx.Done():
 				log.Print("外部からキャンセルが指示されました。UEを強制終了します。")
+				termination = ueCanceled
 				terminateUE(exeNameWithoutExt)
 				return
 			case <-completeUE.Done():
@@ -226,21 +264,30 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 
 	// UE4起動
 	args := append([]string{fmt.Sprintf("-log=%v", logfileName)}, additionalArg...)
-	exec.Command(exe, args...).Run()
+	launchedAt := time.Now()
+	err = exec.Command(exe, args...).Run()
+	result.Duration = time.Since(launchedAt)
 	comple()
 	wg.Wait()
+	result.Termination = termination
+
+	// 強制終了した場合などの終了コードは問わず、起動できなかった場合のみエラーとする
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return result, fmt.Errorf("%w: %v", errUELaunch, err)
+	}
 
 	// 今回の実行により更新されたファイルを一時ディレクトリへコピーし、zipにまとめる
 	tempDir, err := ioutil.TempDir("", "*")
 	if err != nil {
-		return err
+		return result, err
 	}
 	defer os.RemoveAll(tempDir)
 
 	tempSavedDir := filepath.Join(tempDir, "Saved")
 	err = os.Mkdir(tempSavedDir, 0777)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	for _, dirName := range checkDirNames {
@@ -253,5 +300,5 @@ func runUE4(ctx context.Context, exe string, logfileName string, outputName stri
 	if err == nil {
 		log.Print("実行結果をアーカイブしました:", outputName)
 	}
-	return err
+	return result, err
 }
@@ -0,0 +1,82 @@
+package ueRunnerTask
+
+import (
+	"context"
+	"sync"
+)
+
+// runningTasks 実行中のタスク
+// 終了時に新しいタスクの開始を止め、実行中のタスクをキャンセルして完了を待てるようにする
+type runningTasks struct {
+	lock    sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+
+	// canceled 実行中のタスクをすべてキャンセルする際にcloseされる
+	canceled   chan struct{}
+	cancelOnce sync.Once
+}
+
+func newRunningTasks() *runningTasks {
+	return &runningTasks{canceled: make(chan struct{})}
+}
+
+// begin タスクの開始を記録し、cancelAllでもキャンセルされるcontextを返す
+// 開始を止めている場合はfalseを返す。trueの場合はタスクの完了時に戻り値の関数を呼ぶこと
+func (tasks *runningTasks) begin(ctx context.Context) (context.Context, func(), bool) {
+	tasks.lock.Lock()
+	defer tasks.lock.Unlock()
+	if tasks.stopped {
+		return ctx, nil, false
+	}
+	tasks.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-tasks.canceled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel()
+		tasks.wg.Done()
+	}, true
+}
+
+// accepting 新しいタスクを開始できるか
+func (tasks *runningTasks) accepting() bool {
+	tasks.lock.Lock()
+	defer tasks.lock.Unlock()
+	return !tasks.stopped
+}
+
+// stop 新しいタスクの開始を止める
+func (tasks *runningTasks) stop() {
+	tasks.lock.Lock()
+	defer tasks.lock.Unlock()
+	tasks.stopped = true
+}
+
+// cancelAll 実行中のタスクをすべてキャンセルする
+func (tasks *runningTasks) cancelAll() {
+	tasks.cancelOnce.Do(func() { close(tasks.canceled) })
+}
+
+// wait 実行中のタスクの完了を待つ。先にctxが完了した場合はそのエラーを返す
+// stopの後に呼び出すこと
+func (tasks *runningTasks) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		tasks.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
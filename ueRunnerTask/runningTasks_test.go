@@ -0,0 +1,92 @@
+package ueRunnerTask
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/y-akahori-ramen/gojobcoordinatortest"
+)
+
+func TestTaskFactoryDrain(t *testing.T) {
+	factory := TaskFactory{tasks: newRunningTasks()}
+	taskCtx, end, ok := factory.tasks.begin(context.Background())
+	if !ok {
+		t.Fatal("タスクを開始できません")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- factory.Drain(ctx) }()
+	for factory.tasks.accepting() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 終了処理中は新しいタスクを開始しない
+	if _, _, ok := factory.tasks.begin(context.Background()); ok {
+		t.Fatal("終了処理中にタスクを開始できています")
+	}
+	if _, err := factory.NewTask(&gojobcoordinatortest.TaskStartRequest{}); err == nil {
+		t.Fatal("終了処理中にタスクを作成できています")
+	}
+
+	// 実行中のタスクはキャンセルせずに完了を待つ
+	select {
+	case err := <-drained:
+		t.Fatal("実行中のタスクの完了を待っていません:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if taskCtx.Err() != nil {
+		t.Fatal("Drainでタスクがキャンセルされています")
+	}
+
+	end()
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+
+	// 繰り返し呼び出しても問題ない
+	if err := factory.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTaskFactoryShutdown(t *testing.T) {
+	factory := TaskFactory{tasks: newRunningTasks()}
+	taskCtx, end, ok := factory.tasks.begin(context.Background())
+	if !ok {
+		t.Fatal("タスクを開始できません")
+	}
+
+	// Drainの期限が過ぎてもタスクはキャンセルされない
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := factory.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Drainの期限切れのエラーが不正です:", err)
+	}
+	if taskCtx.Err() != nil {
+		t.Fatal("Drainでタスクがキャンセルされています")
+	}
+
+	// Shutdownは実行中のタスクをキャンセルし、完了しなければ期限切れのエラーを返す
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := factory.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Shutdownの期限切れのエラーが不正です:", err)
+	}
+	select {
+	case <-taskCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdownでタスクがキャンセルされていません")
+	}
+
+	// キャンセルされたタスクが完了すればShutdownは成功する
+	end()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := factory.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
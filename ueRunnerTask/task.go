@@ -2,18 +2,26 @@ package ueRunnerTask
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/y-akahori-ramen/gojobcoordinatortest"
+	"github.com/y-akahori-ramen/ue4Runner/ueLog"
 )
 
 const (
 	TaskName = "UE4Runner"
+
+	// ueLogFileName UE起動時に指定するログファイル名
+	ueLogFileName = "log.txt"
+	// defaultMaxFatalMessages TaskResultに含めるFatalのメッセージ数の既定値
+	defaultMaxFatalMessages = 10
 )
 
 // TaskParam タスク設定
@@ -21,12 +29,20 @@ const (
 type TaskParam struct {
 	LogFileServer string
 	Args          []string
+	// MaxFatalMessages TaskResultに含めるFatalのメッセージ数。0の場合は既定値を使用する
+	MaxFatalMessages int
 }
 
 // TaskResult タスク成功時の戻り値
 // タスクが成功した場合に gojobcoordinatortest.TaskStatusResponseのResultValuesに指定される
 type TaskResult struct {
 	ZipURL string
+	// SignedZipURL 認証なしでzipをダウンロードできる有効期限付きのURL。アップローダーが発行しない場合は空
+	SignedZipURL string
+	// LiveLogURL 実行中に送信したUEログを閲覧するURL。zipと関連付けられている。送信しなかった場合は空
+	LiveLogURL string
+	// LogSummary UEログのFatal/Error/Warningの集計結果
+	LogSummary ueLog.Summary
 }
 
 // Task UE4を実行しSaved以下に出力されたファイルをzipにまとめ指定のファイルサーバーにアップロードする
@@ -36,10 +52,37 @@ type Task struct {
 	timeOut  time.Duration
 	param    TaskParam
 	uploader Uploader
+	metrics  *Metrics
+	tasks    *runningTasks
+}
+
+// outcomeOf UEを実行できた場合の実行結果
+func outcomeOf(result ueRunResult) string {
+	switch result.Termination {
+	case ueFrozen:
+		return OutcomeFreeze
+	case ueCanceled:
+		return OutcomeCancel
+	}
+	return OutcomeSucceeded
 }
 
 // Run タスク実行
 func (task *Task) Run(ctx context.Context, taskID string, done chan<- *gojobcoordinatortest.TaskResult) {
+	// 途中で失敗した場合は失敗した箇所に応じた結果を記録する
+	outcome := OutcomeInternalError
+	finished := task.metrics.taskStarted()
+	defer func() { finished(outcome) }()
+
+	// 終了処理が始まった場合もキャンセルされるようにする
+	ctx, end, ok := task.tasks.begin(ctx)
+	if !ok {
+		outcome = OutcomeCancel
+		done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: false}
+		return
+	}
+	defer end()
+
 	tempDir, err := ioutil.TempDir("", "*")
 	if err != nil {
 		done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: false}
@@ -52,31 +95,103 @@ func (task *Task) Run(ctx context.Context, taskID string, done chan<- *gojobcoor
 	zipPath := filepath.Join(tempDir, zipName)
 
 	logger := log.New(log.Default().Writer(), fmt.Sprintf("[%s]", taskID), log.Default().Flags())
+
+	// 終了を待たずにUEログを閲覧できるよう、実行中に追記された内容を逐次送信する
+	ueLogPath := filepath.Join(savedDirPath(task.exePath), "Logs", ueLogFileName)
+	finishLiveLog := func(string) string { return "" }
+	if streamer, ok := task.uploader.(LiveLogStreamer); ok && streamer.LiveLogInterval() > 0 {
+		tailCtx, stopTail := context.WithCancel(context.Background())
+		tailDone := make(chan struct{})
+		go func() {
+			defer close(tailDone)
+			TailLiveLog(tailCtx, streamer, taskID, ueLogPath, time.Now())
+		}()
+
+		// 残りを送信し終えてから、アップロードしたzipと関連付けて終了する
+		finishLiveLog = func(uploadedPath string) string {
+			stopTail()
+			<-tailDone
+			liveURL, err := streamer.FinishLiveLog(taskID, uploadedPath)
+			if err != nil {
+				logger.Print(err)
+			}
+			return liveURL
+		}
+	}
+
 	logger.Print("UEを起動します:", task.exePath, " Args:", task.param.Args)
-	err = runUE4(ctx, task.exePath, "log.txt", zipPath, task.timeOut, task.param.Args...)
+	runResult, err := runUE4(ctx, task.exePath, ueLogFileName, zipPath, task.timeOut, task.param.Args...)
+	if !errors.Is(err, errUELaunch) {
+		task.metrics.ueFinished(runResult)
+	}
 	if err != nil {
-		logger.Print("UE実行でエラーが発生しました")
+		logger.Print("UE実行でエラーが発生しました:", err)
+		outcome = OutcomeArchiveError
+		if errors.Is(err, errUELaunch) {
+			outcome = OutcomeLaunchError
+		}
+		finishLiveLog("")
 		done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: false}
 		return
 	}
 
+	// アーカイブをダウンロードせずに実行結果を判断できるようUEログを集計する
+	maxFatalMessages := task.param.MaxFatalMessages
+	if maxFatalMessages <= 0 {
+		maxFatalMessages = defaultMaxFatalMessages
+	}
+	logSummary, err := ueLog.SummarizeFile(ueLogPath, maxFatalMessages)
+	if err != nil {
+		logger.Print("UEログの集計に失敗しました:", err)
+	}
+
 	// ファイルサーバーへzipをアップロードする
 	logger.Printf("出力されたzipをアップロードします file:%s", zipPath)
-	downloadURL, err := task.uploader.Upload(zipPath)
+	meta := map[string]string{
+		"task-id":  taskID,
+		"exe-path": task.exePath,
+		"args":     strings.Join(task.param.Args, " "),
+	}
+	var zipSize int64
+	if stat, err := os.Stat(zipPath); err == nil {
+		zipSize = stat.Size()
+	}
+	uploadStart := time.Now()
+	var downloadURL string
+	if metaUploader, ok := task.uploader.(MetaUploader); ok {
+		downloadURL, err = metaUploader.UploadWithMeta(zipPath, meta)
+	} else {
+		downloadURL, err = task.uploader.Upload(zipPath)
+	}
+	task.metrics.uploaded(zipSize, time.Since(uploadStart), err)
 
 	if err != nil {
 		logger.Printf("zipアップロードに失敗しました:%v", err)
+		outcome = OutcomeUploadError
+		finishLiveLog("")
 		done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: false}
 		return
 	}
+	liveLogURL := finishLiveLog(zipPath)
+
+	// 課題管理システムなどに貼り付けられるよう署名付きURLも発行する
+	// 発行に失敗してもアップロードは完了しているためタスクは成功とする
+	var signedURL string
+	if signer, ok := task.uploader.(URLSigner); ok {
+		signedURL, err = signer.SignURL(zipPath)
+		if err != nil {
+			logger.Print(err)
+		}
+	}
 
-	// アップロードしたzipのダウンロードURLを結果として返す
-	resultParam := TaskResult{ZipURL: downloadURL}
+	// アップロードしたzipのダウンロードURLとUEログの集計結果を結果として返す
+	resultParam := TaskResult{ZipURL: downloadURL, SignedZipURL: signedURL, LiveLogURL: liveLogURL, LogSummary: logSummary}
 	mapData, err := gojobcoordinatortest.StructToMap(resultParam)
 	if err != nil {
 		logger.Print("パラメータ生成に失敗しました:", err)
 		done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: false}
 		return
 	}
+	outcome = outcomeOf(runResult)
 	done <- &gojobcoordinatortest.TaskResult{ID: taskID, Success: true, ResultValues: &mapData}
 }
@@ -1,6 +1,7 @@
 package ueRunnerTask
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -16,6 +17,8 @@ type TaskFactory struct {
 	exePath  string
 	timeOut  time.Duration
 	uploader Uploader
+	metrics  *Metrics
+	tasks    *runningTasks
 }
 
 // NewTaskFactory TaskUE4RunnerFactoryを作成する
@@ -32,16 +35,41 @@ func NewTaskFactory(exePath string, timeOut time.Duration, uploader Uploader) (T
 		return TaskFactory{}, fmt.Errorf("ファイルが存在しません:%s", exePath)
 	}
 
-	return TaskFactory{exePath: exePath, timeOut: timeOut, uploader: uploader}, nil
+	return TaskFactory{exePath: exePath, timeOut: timeOut, uploader: uploader, tasks: newRunningTasks()}, nil
+}
+
+// SetMetrics タスクの実行状況を記録するメトリクスを設定する
+func (factory *TaskFactory) SetMetrics(metrics *Metrics) {
+	factory.metrics = metrics
+}
+
+// Drain 新しいタスクの開始を止め、実行中のタスクが完了するのを待つ
+// 先にctxが完了した場合はそのエラーを返す
+func (factory *TaskFactory) Drain(ctx context.Context) error {
+	factory.tasks.stop()
+	return factory.tasks.wait(ctx)
+}
+
+// Shutdown 新しいタスクの開始を止め、実行中のタスクをキャンセルして完了を待つ
+// キャンセルされたタスクはUEを強制終了し、それまでに出力されたものをアップロードしてから完了する
+// 先にctxが完了した場合はそのエラーを返す
+func (factory *TaskFactory) Shutdown(ctx context.Context) error {
+	factory.tasks.stop()
+	factory.tasks.cancelAll()
+	return factory.tasks.wait(ctx)
 }
 
 // NewTask gojobcoordinatortestのタスク開始リクエストを受け取り、タスクを返す
 func (factory *TaskFactory) NewTask(req *gojobcoordinatortest.TaskStartRequest) (gojobcoordinatortest.Task, error) {
+	if !factory.tasks.accepting() {
+		return nil, errors.New("終了処理中のため新しいタスクを開始できません")
+	}
+
 	var runnerParam TaskParam
 	err := gojobcoordinatortest.MapToStruct(*req.Params, &runnerParam)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Task{exePath: factory.exePath, param: runnerParam, timeOut: factory.timeOut, uploader: factory.uploader}, nil
+	return &Task{exePath: factory.exePath, param: runnerParam, timeOut: factory.timeOut, uploader: factory.uploader, metrics: factory.metrics, tasks: factory.tasks}, nil
 }
@@ -2,12 +2,42 @@ package ueRunnerTask
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+const (
+	// defaultChunkSize このサイズを超えるファイルは分割アップロードする
+	defaultChunkSize = 8 * 1024 * 1024
+	// defaultMaxRetries 分割アップロードで連続して失敗した場合に再試行する回数
+	defaultMaxRetries = 5
+	// contentSHA256Header logServerが受信内容の検証に使用するヘッダー
+	contentSHA256Header = "X-Content-SHA256"
+	// defaultSignedURLLifetime 署名付きURLの有効期間の既定値
+	defaultSignedURLLifetime = 7 * 24 * time.Hour
+	// maxMetaCount, maxMetaValueLength logServerがタグとして受け付ける付加情報の個数と値の長さ(バイト)の上限
+	maxMetaCount       = 64
+	maxMetaValueLength = 1024
+)
+
+var metaKeyPattern = regexp.MustCompile(`^[a-z0-9_\-]{1,64}$`)
+
 // Uploader zipファイルのアップローダーインターフェイス
 type Uploader interface {
 	// Upload ファイルをアップロードし、アップロードしたファイルをダウンロードするURLを返す
@@ -15,16 +45,46 @@ type Uploader interface {
 	Upload(path string) (string, error)
 }
 
+// MetaUploader アップロードするファイルに付加情報を付与できるアップローダー
+type MetaUploader interface {
+	// UploadWithMeta 付加情報を付与してファイルをアップロードし、ダウンロードするURLを返す
+	// 付加情報を付与できなくてもアップロード自体は失敗させない
+	// path アップロードするファイルパス
+	// meta アップロードしたファイルに付与するタスクIDなどの付加情報
+	UploadWithMeta(path string, meta map[string]string) (string, error)
+}
+
+// URLSigner 認証なしでダウンロードできる有効期限付きのURLを発行できるアップローダー
+type URLSigner interface {
+	// SignURL Uploadでアップロードしたファイルの署名付きURLを返す。発行しない設定の場合は空文字を返す
+	// path Uploadに指定したファイルパス
+	SignURL(path string) (string, error)
+}
+
 // LogServerUploader logServerへアップロードするアップローダー
 type LogServerUploader struct {
-	url      string
-	user     string
-	password string
+	url        string
+	user       string
+	password   string
+	token      string
+	chunkSize  int64
+	maxRetries int
+
+	signedURLLifetime time.Duration
+	liveLogInterval   time.Duration
+	// client CA証明書を指定した場合に使用するHTTPクライアント。nilの場合はhttp.DefaultClientを使用する
+	client *http.Client
 }
 
 // NewLogServerUploaderWithBasicAuth Basic認証付きのlogServer用アップローダー
 func NewLogServerUploaderWithBasicAuth(url string, username string, password string) LogServerUploader {
-	return LogServerUploader{url: url, user: username, password: password}
+	return LogServerUploader{url: url, user: username, password: password, chunkSize: defaultChunkSize, maxRetries: defaultMaxRetries, signedURLLifetime: defaultSignedURLLifetime, liveLogInterval: defaultLiveLogInterval}
+}
+
+// NewLogServerUploaderWithToken logServerが発行したAPIトークンで認証するlogServer用アップローダー
+// APIトークンはアップロード専用で署名付きURLを発行できないため、既定では発行しない
+func NewLogServerUploaderWithToken(url string, token string) LogServerUploader {
+	return LogServerUploader{url: url, token: token, chunkSize: defaultChunkSize, maxRetries: defaultMaxRetries, liveLogInterval: defaultLiveLogInterval}
 }
 
 // NewLogServerUploader logServer用アップローダー
@@ -32,35 +92,395 @@ func NewLogServerUploader(url string) LogServerUploader {
 	return NewLogServerUploaderWithBasicAuth(url, "", "")
 }
 
+// LoadToken APIトークンをファイルまたは環境変数から読み込む
+// コマンドライン引数に指定するとプロセス一覧から見えてしまうため、これらの方法で受け渡す
+// pathが空でなければファイルから、空であれば環境変数envNameから読み込む。どちらもない場合は空文字を返す
+func LoadToken(path string, envName string) (string, error) {
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("APIトークンの読み込みに失敗しました: %v", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("APIトークンのファイルが空です: %v", path)
+		}
+		return token, nil
+	}
+
+	if envName != "" {
+		return strings.TrimSpace(os.Getenv(envName)), nil
+	}
+	return "", nil
+}
+
+// SetCACert logServerのサーバー証明書の検証に使用するCA証明書(PEM形式)を設定する
+// 設定した場合はOSが信頼するCAは使用せず、このCAで署名された証明書のみを信頼する
+// logServerの自己署名CA(ca.pem)を配布して指定することを想定している
+func (uploader *LogServerUploader) SetCACert(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("CA証明書の読み込みに失敗しました: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("CA証明書が含まれていません: %v", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	uploader.client = &http.Client{Transport: transport}
+	return nil
+}
+
+// httpClient リクエストの送信に使用するHTTPクライアント
+func (uploader *LogServerUploader) httpClient() *http.Client {
+	if uploader.client != nil {
+		return uploader.client
+	}
+	return http.DefaultClient
+}
+
+// SetSignedURLLifetime SignURLで発行する署名付きURLの有効期間を設定する。0の場合は発行しない
+func (uploader *LogServerUploader) SetSignedURLLifetime(lifetime time.Duration) {
+	uploader.signedURLLifetime = lifetime
+}
+
+// SetLiveLogInterval 実行中のUEログをlogServerへ送信する間隔を設定する。0の場合は送信しない
+func (uploader *LogServerUploader) SetLiveLogInterval(interval time.Duration) {
+	uploader.liveLogInterval = interval
+}
+
+// SetChunkSize 分割アップロードの1回あたりの送信サイズを設定する
+// このサイズを超えるファイルは分割アップロードし、通信が途切れた場合は続きから再開する
+// 0以下の場合は既定値を使用する
+func (uploader *LogServerUploader) SetChunkSize(size int64) {
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	uploader.chunkSize = size
+}
+
 func (uploader *LogServerUploader) Upload(path string) (string, error) {
+	return uploader.UploadWithMeta(path, nil)
+}
+
+// UploadWithMeta 付加情報をlogServerのタグとして付与してアップロードする
+// logServerが受け付けない付加情報はアップロードが拒否されないよう送信前に除外または切り詰める
+func (uploader *LogServerUploader) UploadWithMeta(path string, meta map[string]string) (string, error) {
 
 	// ファイルサーバーへzipをアップロードする
+	// 付加情報はlogServerのタグとしてクエリパラメータで送る
 	fileID := filepath.Base(path)
-	postUrl := fmt.Sprintf("%s/upload/%s", uploader.url, fileID)
+	query := url.Values{}
+	for key, value := range sanitizeMeta(meta) {
+		query.Set("meta."+key, value)
+	}
 
-	file, err := ioutil.ReadFile(path)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("ファイル読み込みに失敗しました: %v %v: ", path, err)
+	}
+
+	if stat.Size() > uploader.chunkSize {
+		err = uploader.uploadChunked(path, fileID, query, stat.Size())
+	} else {
+		err = uploader.uploadWhole(path, fileID, query)
+	}
 	if err != nil {
-		return "", fmt.Errorf("ファイル読み込みに失敗しました: %v %v: ", file, err)
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/files/%s", uploader.url, fileID), nil
+}
+
+// sanitizeMeta logServerがタグとして受け付ける付加情報だけを返す
+// キーが使用できないものは除外し、長すぎる値はUTF-8の文字の途中で切れないよう切り詰める
+func sanitizeMeta(meta map[string]string) map[string]string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		if metaKeyPattern.MatchString(strings.ToLower(key)) {
+			keys = append(keys, key)
+		}
+	}
+	// 上限を超える場合も毎回同じ付加情報が残るようキーの順に選ぶ
+	sort.Strings(keys)
+	if len(keys) > maxMetaCount {
+		keys = keys[:maxMetaCount]
 	}
 
-	req, err := http.NewRequest(http.MethodPost, postUrl, bytes.NewBuffer(file))
+	sanitized := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value := meta[key]
+		if len(value) > maxMetaValueLength {
+			n := maxMetaValueLength
+			for n > 0 && !utf8.RuneStart(value[n]) {
+				n--
+			}
+			value = value[:n]
+		}
+		sanitized[strings.ToLower(key)] = value
+	}
+	return sanitized
+}
+
+func (uploader *LogServerUploader) newRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		return "", fmt.Errorf("HTTPリクエストの作成に失敗しました: %v", err)
+		return nil, fmt.Errorf("HTTPリクエストの作成に失敗しました: %v", err)
 	}
 
-	if uploader.user != "" && uploader.password != "" {
+	if uploader.token != "" {
+		req.Header.Set("Authorization", "Bearer "+uploader.token)
+	} else if uploader.user != "" && uploader.password != "" {
 		req.SetBasicAuth(uploader.user, uploader.password)
 	}
+	return req, nil
+}
+
+// uploadWhole ファイル全体を1回のリクエストでアップロードする
+func (uploader *LogServerUploader) uploadWhole(path string, fileID string, query url.Values) error {
+	postUrl := fmt.Sprintf("%s/upload/%s?%s", uploader.url, fileID, query.Encode())
 
-	resp, err := http.DefaultClient.Do(req)
+	file, err := ioutil.ReadFile(path)
 	if err != nil {
-		return "", fmt.Errorf("ファイルアップロードに失敗しました: %v", err)
+		return fmt.Errorf("ファイル読み込みに失敗しました: %v %v: ", path, err)
+	}
+
+	req, err := uploader.newRequest(http.MethodPost, postUrl, bytes.NewBuffer(file))
+	if err != nil {
+		return err
+	}
+
+	// サーバー側で受信内容を検証させる
+	sum := sha256.Sum256(file)
+	req.Header.Set(contentSHA256Header, hex.EncodeToString(sum[:]))
+
+	resp, err := uploader.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("ファイルアップロードに失敗しました: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("ファイルアップロードのレスポンスが不正です: %v", http.StatusText(resp.StatusCode))
+		return fmt.Errorf("ファイルアップロードのレスポンスが不正です: %v", http.StatusText(resp.StatusCode))
 	}
 
-	return fmt.Sprintf("%s/files/%s", uploader.url, fileID), nil
+	return nil
+}
+
+// uploadSessionStatus logServerの分割アップロードの状態
+type uploadSessionStatus struct {
+	SessionID string `json:"sessionID"`
+	Offset    int64  `json:"offset"`
+}
+
+// uploadChunked logServerの分割アップロードを使用してアップロードする
+// 送信に失敗した場合はサーバーが受信済みの位置を問い合わせて続きから再開する
+func (uploader *LogServerUploader) uploadChunked(path string, fileID string, query url.Values, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ファイル読み込みに失敗しました: %v %v: ", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("ファイル読み込みに失敗しました: %v %v: ", path, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// 分割アップロード開始
+	uploadsURL := fmt.Sprintf("%s/uploads/%s", uploader.url, fileID)
+	req, err := uploader.newRequest(http.MethodPost, fmt.Sprintf("%s?%s", uploadsURL, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+
+	var status uploadSessionStatus
+	err = uploader.doJSON(req, http.StatusCreated, &status)
+	if err != nil {
+		return fmt.Errorf("分割アップロードの開始に失敗しました: %v", err)
+	}
+	sessionURL := fmt.Sprintf("%s/%s", uploadsURL, status.SessionID)
+
+	// 失敗した場合はサーバーに受信途中のデータを残さないよう中止する
+	if err := uploader.sendChunks(file, sessionURL, size, sum); err != nil {
+		uploader.abortUpload(sessionURL)
+		return err
+	}
+	return nil
+}
+
+// sendChunks 分割アップロードのセッションにファイルを送信して確定させる
+func (uploader *LogServerUploader) sendChunks(file *os.File, sessionURL string, size int64, sum string) error {
+	var status uploadSessionStatus
+	offset := int64(0)
+	failures := 0
+	for offset < size {
+		length := uploader.chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		req, err := uploader.newRequest(http.MethodPut, sessionURL, io.NewSectionReader(file, offset, length))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = length
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+		err = uploader.doJSON(req, http.StatusOK, &status)
+		if err == nil && status.Offset <= offset {
+			err = fmt.Errorf("受信済みの位置が進んでいません: %v", status.Offset)
+		}
+		if err == nil {
+			offset = status.Offset
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > uploader.maxRetries {
+			return fmt.Errorf("分割アップロードに失敗しました: %v", err)
+		}
+		time.Sleep(time.Second * time.Duration(failures))
+
+		// サーバーが受信できた位置から再開する
+		req, err = uploader.newRequest(http.MethodGet, sessionURL, nil)
+		if err != nil {
+			return err
+		}
+		if err := uploader.doJSON(req, http.StatusOK, &status); err == nil {
+			offset = status.Offset
+		}
+	}
+
+	// 受信内容をSHA-256で検証して保存を確定させる
+	req, err := uploader.newRequest(http.MethodPost, sessionURL+"/finalize", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentSHA256Header, sum)
+
+	resp, err := uploader.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("分割アップロードの確定に失敗しました: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("分割アップロードの確定のレスポンスが不正です: %v", http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+// abortUpload 分割アップロードを中止する
+// 中止できなくても受信途中のデータはサーバーで期限切れとして破棄されるため、結果は問わない
+func (uploader *LogServerUploader) abortUpload(sessionURL string) {
+	req, err := uploader.newRequest(http.MethodDelete, sessionURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := uploader.httpClient().Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// doJSON リクエストを送信し、期待したステータスコードであればレスポンスのJSONを読み込む
+func (uploader *LogServerUploader) doJSON(req *http.Request, expectedStatus int, dst interface{}) error {
+	resp, err := uploader.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("レスポンスが不正です: %v", http.StatusText(resp.StatusCode))
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// SignURL アップロードしたファイルの署名付きURLをlogServerに発行してもらう
+func (uploader *LogServerUploader) SignURL(path string) (string, error) {
+	if uploader.signedURLLifetime <= 0 {
+		return "", nil
+	}
+
+	query := url.Values{}
+	query.Set("expiresIn", uploader.signedURLLifetime.String())
+	req, err := uploader.newRequest(http.MethodPost, fmt.Sprintf("%s/api/sign/%s?%s", uploader.url, url.PathEscape(filepath.Base(path)), query.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var signed struct {
+		Path string `json:"path"`
+	}
+	if err := uploader.doJSON(req, http.StatusOK, &signed); err != nil {
+		return "", fmt.Errorf("署名付きURLの発行に失敗しました: %v", err)
+	}
+	return uploader.url + signed.Path, nil
+}
+
+// LiveLogInterval 実行中のUEログを送信する間隔
+func (uploader *LogServerUploader) LiveLogInterval() time.Duration {
+	return uploader.liveLogInterval
+}
+
+// liveLogStatus logServerが受信済みのライブログの状態
+type liveLogStatus struct {
+	Size int64 `json:"size"`
+}
+
+// AppendLiveLog 実行中のUEログをlogServerのライブログに追記する
+// 送信位置がlogServerの受信済みのサイズと一致しない場合も、logServerの受信済みのサイズを返す
+func (uploader *LogServerUploader) AppendLiveLog(taskID string, offset int64, b []byte) (int64, error) {
+	req, err := uploader.newRequest(http.MethodPost, fmt.Sprintf("%s/live/%s?offset=%d", uploader.url, url.PathEscape(taskID), offset), bytes.NewReader(b))
+	if err != nil {
+		return offset, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := uploader.httpClient().Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return offset, fmt.Errorf("レスポンスが不正です: %v", http.StatusText(resp.StatusCode))
+	}
+
+	var status liveLogStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return offset, err
+	}
+	return status.Size, nil
+}
+
+// FinishLiveLog ライブログを終了し、アップロードしたファイルと関連付ける
+func (uploader *LogServerUploader) FinishLiveLog(taskID string, path string) (string, error) {
+	contentID := ""
+	if path != "" {
+		contentID = filepath.Base(path)
+	}
+	body, err := json.Marshal(map[string]string{"contentID": contentID})
+	if err != nil {
+		return "", err
+	}
+	liveURL := fmt.Sprintf("%s/live/%s", uploader.url, url.PathEscape(taskID))
+	req, err := uploader.newRequest(http.MethodPost, liveURL+"/finish", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var status liveLogStatus
+	if err := uploader.doJSON(req, http.StatusOK, &status); err != nil {
+		return "", fmt.Errorf("ライブログの終了に失敗しました: %v", err)
+	}
+	return liveURL, nil
 }
@@ -0,0 +1,278 @@
+package ueRunnerTask_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-akahori-ramen/ue4Runner/logServer"
+	"github.com/y-akahori-ramen/ue4Runner/ueRunnerTask"
+)
+
+// brokenReader 指定したバイト数を読んだところで通信断を模したエラーを返す
+type brokenReader struct {
+	src    io.Reader
+	remain int
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.src.Read(p)
+	r.remain -= n
+	return n, err
+}
+
+func TestLogServerUploaderResume(t *testing.T) {
+	dir := t.TempDir()
+	logSrv, err := logServer.NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSrv.Close()
+
+	// 最初の分割送信だけ途中で切断させる
+	handler := logSrv.NewHTTPHandler()
+	broken := false
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && !broken {
+			broken = true
+			r.Body = ioutil.NopCloser(&brokenReader{src: r.Body, remain: 10})
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer fileServer.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	srcPath := filepath.Join(t.TempDir(), "run.zip")
+	err = ioutil.WriteFile(srcPath, content, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := ueRunnerTask.NewLogServerUploader(fileServer.URL)
+	uploader.SetChunkSize(32)
+	url, err := uploader.UploadWithMeta(srcPath, map[string]string{
+		"task-id": "task1",
+		// logServerの上限を超える付加情報があってもアップロードは失敗しない
+		"args":        strings.Repeat("-arg ", 1000),
+		"Invalid Key": "value",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != fileServer.URL+"/files/run.zip" {
+		t.Fatal("ダウンロードURLが不正です:", url)
+	}
+	if !broken {
+		t.Fatal("分割アップロードが使用されていません")
+	}
+
+	uploaded, err := ioutil.ReadFile(filepath.Join(dir, "run.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Fatal("アップロードされた内容が一致しません")
+	}
+
+	// 付加情報がタグとして記録される
+	resp, err := http.Get(fileServer.URL + "/api/artifacts/run.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info logServer.ArtifactInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Tags["task-id"] != "task1" {
+		t.Fatal("タグが記録されていません:", info)
+	}
+	if len(info.Tags["args"]) != 1024 {
+		t.Fatal("長すぎる付加情報が切り詰められていません:", len(info.Tags["args"]))
+	}
+}
+
+func TestLogServerUploaderAbort(t *testing.T) {
+	dir := t.TempDir()
+	logSrv, err := logServer.NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSrv.Close()
+
+	// 確定に失敗させ、セッションが中止されることを確認する
+	handler := logSrv.NewHTTPHandler()
+	var aborted string
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/finalize") {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			aborted = r.URL.Path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer fileServer.Close()
+
+	srcPath := filepath.Join(t.TempDir(), "run.zip")
+	err = ioutil.WriteFile(srcPath, bytes.Repeat([]byte("0123456789"), 10), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := ueRunnerTask.NewLogServerUploader(fileServer.URL)
+	uploader.SetChunkSize(32)
+	_, err = uploader.Upload(srcPath)
+	if err == nil {
+		t.Fatal("確定に失敗したのにエラーになりません")
+	}
+	if aborted == "" {
+		t.Fatal("分割アップロードが中止されていません")
+	}
+
+	resp, err := http.Get(fileServer.URL + aborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("中止したセッションが残っています:", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "run.zip")); !os.IsNotExist(err) {
+		t.Fatal("中止したファイルが保存されています")
+	}
+}
+
+func TestLogServerUploaderToken(t *testing.T) {
+	dir := t.TempDir()
+	logSrv, err := logServer.NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSrv.Close()
+	logSrv.SetAuthenticator(logServer.NewSingleUserAuthenticator("root", "password"))
+	fileServer := httptest.NewServer(logSrv.NewHTTPHandler())
+	defer fileServer.Close()
+
+	// 管理者としてアップロード専用のAPIトークンを発行する
+	req, err := http.NewRequest(http.MethodPost, fileServer.URL+"/api/tokens", strings.NewReader(`{"name":"ci","prefix":"run"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("root", "password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var issued logServer.IssuedToken
+	err = json.NewDecoder(resp.Body).Decode(&issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err = ioutil.WriteFile(tokenPath, []byte(issued.Token+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ueRunnerTask.LoadToken(tokenPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	srcDir := t.TempDir()
+	for _, name := range []string{"run.zip", "other.zip"} {
+		err = ioutil.WriteFile(filepath.Join(srcDir, name), content, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 分割アップロードもAPIトークンで認証される
+	uploader := ueRunnerTask.NewLogServerUploaderWithToken(fileServer.URL, token)
+	uploader.SetChunkSize(32)
+	if _, err := uploader.Upload(filepath.Join(srcDir, "run.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploader.Upload(filepath.Join(srcDir, "other.zip")); err == nil {
+		t.Fatal("接頭辞に一致しないファイルがアップロードできています")
+	}
+
+	uploaded, err := ioutil.ReadFile(filepath.Join(dir, "run.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Fatal("アップロードされた内容が一致しません")
+	}
+
+	// アップロード専用のAPIトークンでは署名付きURLを発行しない。発行を指定してもできない
+	if signedURL, err := uploader.SignURL(filepath.Join(srcDir, "run.zip")); err != nil || signedURL != "" {
+		t.Fatal(signedURL, err)
+	}
+	uploader.SetSignedURLLifetime(time.Hour)
+	if _, err := uploader.SignURL(filepath.Join(srcDir, "run.zip")); err == nil {
+		t.Fatal("APIトークンで署名付きURLが発行できています")
+	}
+}
+
+func TestLogServerUploaderCACert(t *testing.T) {
+	dir := t.TempDir()
+	logSrv, err := logServer.NewLogServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSrv.Close()
+
+	cert, err := logSrv.SelfSignedTLSCert([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileServer := httptest.NewUnstartedServer(logSrv.NewHTTPHandler())
+	fileServer.TLS = &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}
+	fileServer.StartTLS()
+	defer fileServer.Close()
+
+	srcPath := filepath.Join(t.TempDir(), "run.zip")
+	err = ioutil.WriteFile(srcPath, []byte("zip"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CA証明書を指定しない場合は自己署名の証明書を信頼しない
+	uploader := ueRunnerTask.NewLogServerUploader(fileServer.URL)
+	if _, err := uploader.Upload(srcPath); err == nil {
+		t.Fatal("CA証明書を指定せずにアップロードできています")
+	}
+
+	err = uploader.SetCACert(cert.CAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploader.Upload(srcPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploader.SignURL(srcPath); err != nil {
+		t.Fatal(err)
+	}
+}